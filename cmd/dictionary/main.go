@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/soyoslab/soy_log_generator/pkg/compressor"
+)
+
+// maxSampleBytes bounds the bytes of the sample lines which are loaded
+const maxSampleBytes = 64 * 1024 * 1024
+
+// readSamples reads the lines of the sample log files
+func readSamples(filenames []string) ([][]byte, error) {
+	samples := [][]byte{}
+	total := 0
+	for _, filename := range filenames {
+		fp, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(fp)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() && total < maxSampleBytes {
+			line := append(append([]byte{}, scanner.Bytes()...), '\n')
+			samples = append(samples, line)
+			total += len(line)
+		}
+		err = scanner.Err()
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// getDictID derives the dictionary id from the samples
+// The id is in the private range of the zstd format (32768 or over).
+func getDictID(samples [][]byte) uint32 {
+	hash := crc32.NewIEEE()
+	for _, sample := range samples {
+		hash.Write(sample)
+	}
+	return 32768 + hash.Sum32()%(1<<31-32768)
+}
+
+func main() {
+	size := flag.Int("size", 16*1024, "dictionary content size in bytes")
+	id := flag.Uint("id", 0, "dictionary id which versions the dictionary (0: derived from the samples)")
+	output := flag.String("out", ".", "directory where the dictionary is stored (e.g. the directory of config.json)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] sample.log...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if uint64(*id) > math.MaxUint32 {
+		fmt.Fprintf(flag.CommandLine.Output(), "dictionary id %d is over %d\n", *id, uint64(math.MaxUint32))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	samples, err := readSamples(flag.Args())
+	if err != nil {
+		log.Fatalf("sample read failed: %v", err)
+	}
+	dictID := uint32(*id)
+	if dictID == 0 {
+		dictID = getDictID(samples)
+	}
+	dict, err := compressor.TrainZstdDict(samples, *size, dictID)
+	if err != nil {
+		log.Fatalf("dictionary training failed: %v", err)
+	}
+	path := filepath.Join(*output, fmt.Sprintf("zstd-dict-%d.bin", dictID))
+	if err = ioutil.WriteFile(path, dict, 0644); err != nil {
+		log.Fatalf("dictionary write failed: %v", err)
+	}
+	fmt.Println(path)
+}
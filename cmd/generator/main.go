@@ -4,14 +4,17 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"syscall"
 
 	"flag"
 	"sync"
 	"time"
 
 	"github.com/soyoslab/soy_log_generator/pkg/classifier"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
 	"github.com/soyoslab/soy_log_generator/pkg/transport"
 )
 
@@ -19,6 +22,10 @@ var wg sync.WaitGroup
 var c *classifier.Classifier
 var backupInterval int
 var mutex *sync.Mutex
+var current *transport.Transport
+var currentMutex sync.Mutex
+var hotScore = metrics.DefaultRegistry.NewHistogram("generator_classifier_hot_score", "Hot probability of the cold lines by the Bayesian classifier.",
+	[]float64{1e-14, 1e-12, 1e-10, 1e-8, 1e-6, 1e-4, 1e-2, 0.1, 0.5, 0.9})
 
 func filter(str string, isHot bool) bool {
 	if isHot {
@@ -32,6 +39,7 @@ func filter(str string, isHot bool) bool {
 	c.Learn(str, classifier.Cold)
 	mutex.Unlock()
 	result, _ := c.Classify(str)
+	hotScore.Observe(result[classifier.Hot])
 	if result[classifier.Hot] > 1e-10 {
 		log.Println("insert hot string", str, isHot, result)
 		return true
@@ -46,6 +54,8 @@ func run(configFilePath string) {
 		goto exit
 	}
 	defer t.Close()
+	setCurrent(t)
+	defer setCurrent(nil)
 	log.Println("transport running start")
 	err = t.Run()
 	if err != nil {
@@ -57,6 +67,30 @@ exit:
 	wg.Done()
 }
 
+func setCurrent(t *transport.Transport) {
+	currentMutex.Lock()
+	current = t
+	currentMutex.Unlock()
+}
+
+func reload(configFilePath string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Println("reload the config file", configFilePath)
+		currentMutex.Lock()
+		t := current
+		currentMutex.Unlock()
+		if t == nil {
+			log.Println("transport is not running, the config is applied on the next run")
+			continue
+		}
+		if err := t.Reload(configFilePath); err != nil {
+			log.Println("reload failed:", err)
+		}
+	}
+}
+
 func backup() {
 	for {
 		mutex.Lock()
@@ -99,6 +133,7 @@ func main() {
 	backupInterval = *interval
 	go backup()
 	log.Println("backup runs every", backupInterval, "seconds")
+	go reload(*configFilePath)
 	for {
 		defer func() {
 			err := recover()
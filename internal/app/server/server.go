@@ -2,25 +2,46 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/kr/pretty"
 	"github.com/smallnest/rpcx/server"
+	"github.com/smallnest/rpcx/share"
 	"github.com/soyoslab/soy_log_collector/pkg/rpc"
+	"github.com/soyoslab/soy_log_generator/pkg/auth"
 	"github.com/soyoslab/soy_log_generator/pkg/compressor"
+	"github.com/soyoslab/soy_log_generator/pkg/delivery"
 )
 
-type hotPort int
-type coldPort int
-type initPort int
+// port has the verifier of the requests (nil accepts any request)
+type port struct {
+	verifier *auth.Verifier
+}
+
+type hotPort struct{ port }
+type coldPort struct{ port }
+type initPort struct{ port }
 
-var mapTable map[string][]string
+var mapTable = make(map[string][]string)
+var codecTable = make(map[string]compressor.Compressor)
+var tableMutex sync.RWMutex
+var windows = make(map[string]*delivery.Window)
+var duplicates uint64
+var windowMutex sync.Mutex
 
 // printPacket prints the information in the packet
-func printPacket(packet rpc.LogMessage, prefix string, isCompressed bool, compressor compressor.Compressor) {
+// The compressed buffer is decoded by its frame or magic number first, and by the codec of Init otherwise.
+func printPacket(packet rpc.LogMessage, prefix string, isCompressed bool, codec compressor.Compressor) {
 	if isCompressed {
-		buffer, err := compressor.Decompress(packet.Buffer)
+		buffer, err := compressor.DecompressAuto(packet.Buffer)
+		if err == compressor.ErrUnknownFormat {
+			buffer, err = codec.Decompress(packet.Buffer)
+		}
 		if err != nil {
 			log.Panic("Packet decompress failed")
 		}
@@ -34,34 +55,206 @@ func printPacket(packet rpc.LogMessage, prefix string, isCompressed bool, compre
 	}
 }
 
+// authenticate verifies the credential of the request before the packet is used
+func (p *port) authenticate(ctx context.Context, service string, args *rpc.LogMessage) error {
+	if p.verifier == nil {
+		return nil
+	}
+	metadata, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	if err := p.verifier.Verify(metadata, service, args, time.Now()); err != nil {
+		log.Printf("%s push of %s is rejected: %v", service, (*args).Namespace, err)
+		return err
+	}
+	return nil
+}
+
+// resolveMapTable sets the file map table of the namespace to the packet
+// The packet of the unknown namespace or file index is rejected, so the generator sends Init again.
+func resolveMapTable(args *rpc.LogMessage) error {
+	tableMutex.RLock()
+	table, ok := mapTable[(*args).Namespace]
+	tableMutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("namespace %s is not registered", (*args).Namespace)
+	}
+	for _, idx := range (*args).Files.Indexes {
+		if int(idx) >= len(table) {
+			return fmt.Errorf("file index %d of namespace %s is not registered", idx, (*args).Namespace)
+		}
+	}
+	(*args).Files.MapTable = table
+	return nil
+}
+
+// getSequence returns the window of the packet's session and its sequence (nil if it has no sequence)
+func getSequence(ctx context.Context, args *rpc.LogMessage) (*delivery.Window, uint64) {
+	metadata, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	seq, err := strconv.ParseUint(metadata[delivery.MetaSequence], 10, 64)
+	if err != nil {
+		return nil, 0
+	}
+	key := (*args).Namespace + "/" + metadata[delivery.MetaSession]
+	windowMutex.Lock()
+	defer windowMutex.Unlock()
+	if windows[key] == nil {
+		windows[key] = new(delivery.Window)
+	}
+	log.Printf("packet %d of %s (lines: %s)", seq, key, metadata[delivery.MetaLines])
+	return windows[key], seq
+}
+
+// isDuplicated records the sequence of the packet and checks it was already received
+// The check and the record are one step, so the retransmission which arrives during
+// the processing isn't processed twice. The duplicated packet is acknowledged again.
+func isDuplicated(ctx context.Context, window *delivery.Window, seq uint64) bool {
+	if window == nil {
+		return false
+	}
+	windowMutex.Lock()
+	duplicated := !window.Add(seq)
+	if duplicated {
+		duplicates++
+	}
+	windowMutex.Unlock()
+	if duplicated {
+		log.Printf("duplicated packet %d is ignored", seq)
+		acknowledge(ctx, window, seq)
+	}
+	return duplicated
+}
+
+// acknowledge replies the sequence of the processed packet
+func acknowledge(ctx context.Context, window *delivery.Window, seq uint64) {
+	if window == nil {
+		return
+	}
+	if reply, ok := ctx.Value(share.ResMetaDataKey).(map[string]string); ok {
+		reply[delivery.MetaAck] = strconv.FormatUint(seq, 10)
+	}
+}
+
+// Duplicates returns the number of the duplicated packets which are ignored
+func Duplicates() uint64 {
+	windowMutex.Lock()
+	defer windowMutex.Unlock()
+	return duplicates
+}
+
 func (p *hotPort) Push(ctx context.Context, args *rpc.LogMessage, reply *rpc.Reply) error {
-	(*args).Files.MapTable = mapTable[(*args).Namespace]
+	if err := p.authenticate(ctx, "hot", args); err != nil {
+		return err
+	}
+	if err := resolveMapTable(args); err != nil {
+		return err
+	}
+	window, seq := getSequence(ctx, args)
+	if isDuplicated(ctx, window, seq) {
+		return nil
+	}
 	log.Printf("hot: %# v", pretty.Formatter(*args))
 	printPacket(*args, "HOT", false, &compressor.GzipComp{})
+	acknowledge(ctx, window, seq)
 	return nil
 }
 
 func (p *coldPort) Push(ctx context.Context, args *rpc.LogMessage, reply *rpc.Reply) error {
-	(*args).Files.MapTable = mapTable[(*args).Namespace]
+	if err := p.authenticate(ctx, "cold", args); err != nil {
+		return err
+	}
+	if err := resolveMapTable(args); err != nil {
+		return err
+	}
+	window, seq := getSequence(ctx, args)
+	if isDuplicated(ctx, window, seq) {
+		return nil
+	}
+	tableMutex.RLock()
+	codec, ok := codecTable[(*args).Namespace]
+	tableMutex.RUnlock()
 	log.Printf("cold: %# v", pretty.Formatter(*args))
-	printPacket(*args, fmt.Sprintf("COLD(%v)", len((*args).Buffer)), true, &compressor.GzipComp{})
+	if !ok {
+		codec = &compressor.GzipComp{}
+	}
+	printPacket(*args, fmt.Sprintf("COLD(%v)", len((*args).Buffer)), true, codec)
+	acknowledge(ctx, window, seq)
 	return nil
 }
 
+// getCodec returns the compressor of the codec in the request metadata (gzip if not specified)
+func getCodec(ctx context.Context) (compressor.Compressor, error) {
+	metadata, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	name := metadata["compression"]
+	if len(name) == 0 {
+		name = compressor.CodecGzip
+	}
+	return compressor.New(name, 0)
+}
+
+// checkDictionary checks the zstd dictionary in the request metadata is registered
+// The dictionary is picked by the id of the zstd frame when the cold packet is decompressed.
+func checkDictionary(ctx context.Context) error {
+	metadata, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	if len(metadata["dictionary"]) == 0 {
+		return nil
+	}
+	id, err := strconv.ParseUint(metadata["dictionary"], 10, 32)
+	if err != nil {
+		return err
+	}
+	_, err = compressor.ZstdDict(uint32(id))
+	return err
+}
+
 func (p *initPort) Push(ctx context.Context, args *rpc.LogMessage, reply *rpc.Reply) error {
+	if err := p.authenticate(ctx, "init", args); err != nil {
+		return err
+	}
+	codec, err := getCodec(ctx)
+	if err != nil {
+		return err
+	}
+	if err = checkDictionary(ctx); err != nil {
+		return err
+	}
+	tableMutex.Lock()
 	mapTable[(*args).Namespace] = (*args).Files.MapTable
+	codecTable[(*args).Namespace] = codec
+	tableMutex.Unlock()
 	log.Printf("mapping table: %# v", pretty.Formatter((*args).Files.MapTable))
 	return nil
 }
 
+// Reset clears the file map tables and the codecs like the restarted collector
+func Reset() {
+	tableMutex.Lock()
+	mapTable = make(map[string][]string)
+	codecTable = make(map[string]compressor.Compressor)
+	tableMutex.Unlock()
+}
+
+// newServer returns the testing server which has the ports
+func newServer(verifier *auth.Verifier, options ...server.OptionFn) *server.Server {
+	s := server.NewServer(options...)
+	s.RegisterName("HotPort", &hotPort{port{verifier}}, "")
+	s.RegisterName("ColdPort", &coldPort{port{verifier}}, "")
+	s.RegisterName("Init", &initPort{port{verifier}}, "")
+	return s
+}
+
 // Run runs the testing server program
 func Run() {
-	mapTable = make(map[string][]string)
-	s := server.NewServer()
-	s.RegisterName("HotPort", new(hotPort), "")
-	s.RegisterName("ColdPort", new(coldPort), "")
-	s.RegisterName("Init", new(initPort), "")
 	// Don't change the address of `localhost:8972`
 	// Because this program uses in the `pkg/transport/transport_test.go`
-	s.Serve("tcp", "localhost:8972")
+	newServer(nil).Serve("tcp", "localhost:8972")
+}
+
+// RunTLS runs the testing server program which accepts the TLS connections at the address
+// The client certificate is verified if the TLS configuration requires it.
+func RunTLS(address string, tlsConfig *tls.Config) error {
+	return newServer(nil, server.WithTLSConfig(tlsConfig)).Serve("tcp", address)
+}
+
+// RunAuth runs the testing server program which rejects the unauthenticated pushes at the address
+func RunAuth(address string, verifier *auth.Verifier) error {
+	return newServer(verifier).Serve("tcp", address)
 }
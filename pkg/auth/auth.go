@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soyoslab/soy_log_collector/pkg/rpc"
+)
+
+const (
+	// ModeNone sends no credential
+	ModeNone = "none"
+	// ModeToken sends the secret as the bearer token
+	ModeToken = "token"
+	// ModeHMAC sends the HMAC-SHA256 signature of the packet by the secret
+	ModeHMAC = "hmac"
+)
+
+const (
+	// MetaAuthorization is the rpcx metadata key of the bearer token ("Bearer <token>")
+	MetaAuthorization = "authorization"
+	// MetaTimestamp is the rpcx metadata key of the signing time (unix seconds)
+	MetaTimestamp = "auth-timestamp"
+	// MetaNonce is the rpcx metadata key of the random value which makes each signature unique
+	MetaNonce = "auth-nonce"
+	// MetaSignature is the rpcx metadata key of the hex encoded signature
+	MetaSignature = "auth-signature"
+	// DefaultMaxSkew is the maximum difference between the signing time and the verifying time
+	DefaultMaxSkew = time.Duration(5) * time.Minute
+)
+
+// ErrUnauthenticated is returned when the request has no valid credential
+var ErrUnauthenticated = errors.New("unauthenticated request")
+
+// Signer attaches the credential to the request metadata
+type Signer struct {
+	mode   string
+	secret []byte
+}
+
+// Verifier checks the credential in the request metadata
+// Zero MaxSkew uses the DefaultMaxSkew. The nonces of the valid signatures are
+// kept until their signing time is expired, so the replayed request is rejected.
+type Verifier struct {
+	Mode    string
+	Secret  []byte
+	MaxSkew time.Duration
+	nonces  map[string]time.Time
+	pruned  time.Time
+	mutex   sync.Mutex
+}
+
+// IsValidMode checks the authentication mode is supported
+func IsValidMode(mode string) bool {
+	switch mode {
+	case ModeNone, ModeToken, ModeHMAC:
+		return true
+	}
+	return false
+}
+
+// LoadSecret reads the secret from the file, or from the environment variable if the file isn't set
+// The surrounding spaces (e.g. the newline at the end of the file) are removed.
+func LoadSecret(filename string, env string) ([]byte, error) {
+	var secret string
+	switch {
+	case len(filename) != 0:
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		secret = string(data)
+	case len(env) != 0:
+		secret = os.Getenv(env)
+	}
+	secret = strings.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, errors.New("authentication secret is empty")
+	}
+	return []byte(secret), nil
+}
+
+// NewSigner returns the signer of the mode
+// The secret isn't used in ModeNone.
+func NewSigner(mode string, secret []byte) (*Signer, error) {
+	if !IsValidMode(mode) {
+		return nil, fmt.Errorf("invalid authentication mode %q", mode)
+	}
+	if mode != ModeNone && len(secret) == 0 {
+		return nil, errors.New("authentication secret is empty")
+	}
+	return &Signer{mode: mode, secret: secret}, nil
+}
+
+// Sign adds the credential of the service's packet to the metadata
+// The nil signer adds nothing.
+func (s *Signer) Sign(metadata map[string]string, service string, packet *rpc.LogMessage, now time.Time) {
+	if s == nil {
+		return
+	}
+	switch s.mode {
+	case ModeToken:
+		metadata[MetaAuthorization] = "Bearer " + string(s.secret)
+	case ModeHMAC:
+		nonce := make([]byte, 16)
+		rand.Read(nonce)
+		metadata[MetaTimestamp] = strconv.FormatInt(now.Unix(), 10)
+		metadata[MetaNonce] = hex.EncodeToString(nonce)
+		metadata[MetaSignature] = hex.EncodeToString(signature(s.secret, service, metadata, packet))
+	}
+}
+
+// Verify checks the credential of the service's packet in the metadata
+func (v *Verifier) Verify(metadata map[string]string, service string, packet *rpc.LogMessage, now time.Time) error {
+	switch v.Mode {
+	case ModeNone:
+		return nil
+	case ModeToken:
+		token := strings.TrimPrefix(metadata[MetaAuthorization], "Bearer ")
+		if len(v.Secret) == 0 || subtle.ConstantTimeCompare([]byte(token), v.Secret) != 1 {
+			return ErrUnauthenticated
+		}
+		return nil
+	case ModeHMAC:
+		return v.verifySignature(metadata, service, packet, now)
+	}
+	return fmt.Errorf("invalid authentication mode %q", v.Mode)
+}
+
+// verifySignature checks the signature, the signing time and the nonce
+func (v *Verifier) verifySignature(metadata map[string]string, service string, packet *rpc.LogMessage, now time.Time) error {
+	maxSkew := v.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	timestamp := metadata[MetaTimestamp]
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrUnauthenticated
+	}
+	skew := now.Sub(time.Unix(signed, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%w: signature is expired (skew: %v)", ErrUnauthenticated, skew)
+	}
+	expected, err := hex.DecodeString(metadata[MetaSignature])
+	if err != nil || len(v.Secret) == 0 || !hmac.Equal(expected, signature(v.Secret, service, metadata, packet)) {
+		return ErrUnauthenticated
+	}
+	if !v.useNonce(metadata[MetaNonce], time.Unix(signed, 0).Add(maxSkew), now, maxSkew) {
+		return fmt.Errorf("%w: nonce is already used", ErrUnauthenticated)
+	}
+	return nil
+}
+
+// useNonce records the nonce until it is expired and reports whether it is new
+// The expired nonces are pruned at most once per maxSkew.
+func (v *Verifier) useNonce(nonce string, expires time.Time, now time.Time, maxSkew time.Duration) bool {
+	if len(nonce) == 0 {
+		return false
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.nonces == nil {
+		v.nonces = make(map[string]time.Time)
+	}
+	if now.Sub(v.pruned) > maxSkew {
+		for key, expiration := range v.nonces {
+			if now.After(expiration) {
+				delete(v.nonces, key)
+			}
+		}
+		v.pruned = now
+	}
+	if _, ok := v.nonces[nonce]; ok {
+		return false
+	}
+	v.nonces[nonce] = expires
+	return true
+}
+
+// signature returns the HMAC-SHA256 of the service, the metadata and the packet
+// Every field is length-prefixed, so the boundaries can't be moved. The metadata
+// (e.g. the timestamp, the nonce and the delivery sequences) is signed in the key
+// order except the signature itself and the keys reserved by rpcx ("__" prefix).
+func signature(secret []byte, service string, metadata map[string]string, packet *rpc.LogMessage) []byte {
+	mac := hmac.New(sha256.New, secret)
+	field := func(data []byte) {
+		var length [binary.MaxVarintLen64]byte
+		mac.Write(length[:binary.PutUvarint(length[:], uint64(len(data)))])
+		mac.Write(data)
+	}
+	field([]byte(service))
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		if key != MetaSignature && !strings.HasPrefix(key, "__") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	field([]byte(strconv.Itoa(len(keys))))
+	for _, key := range keys {
+		field([]byte(key))
+		field([]byte(metadata[key]))
+	}
+	field([]byte(packet.Namespace))
+	field([]byte(strconv.Itoa(len(packet.Files.MapTable))))
+	for _, filename := range packet.Files.MapTable {
+		field([]byte(filename))
+	}
+	field(packet.Files.Indexes)
+	info := make([]byte, 16*len(packet.Info))
+	for i, entry := range packet.Info {
+		binary.BigEndian.PutUint64(info[16*i:], uint64(entry.Timestamp))
+		binary.BigEndian.PutUint64(info[16*i+8:], entry.Length)
+	}
+	field(info)
+	field(packet.Buffer)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,146 @@
+package auth_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soyoslab/soy_log_collector/pkg/rpc"
+	"github.com/soyoslab/soy_log_generator/pkg/auth"
+)
+
+func getPacket() *rpc.LogMessage {
+	packet := &rpc.LogMessage{Namespace: "test:host", Buffer: []byte("critical error")}
+	packet.Files.MapTable = []string{"/var/log/test.log"}
+	packet.Files.Indexes = []uint8{0}
+	packet.Info = []rpc.LogInfo{{Timestamp: 1626663600, Length: 14}}
+	return packet
+}
+
+func sign(t *testing.T, mode string, secret string, service string, packet *rpc.LogMessage, now time.Time) map[string]string {
+	signer, err := auth.NewSigner(mode, []byte(secret))
+	if err != nil {
+		t.Fatalf("signer creation failed %v", err)
+	}
+	metadata := map[string]string{}
+	signer.Sign(metadata, service, packet, now)
+	return metadata
+}
+
+func TestToken(t *testing.T) {
+	now := time.Now()
+	verifier := &auth.Verifier{Mode: auth.ModeToken, Secret: []byte("s3cret")}
+	if err := verifier.Verify(sign(t, auth.ModeToken, "s3cret", "init", getPacket(), now), "init", getPacket(), now); err != nil {
+		t.Errorf("valid token is rejected %v", err)
+	}
+	if err := verifier.Verify(sign(t, auth.ModeToken, "wrong", "init", getPacket(), now), "init", getPacket(), now); err == nil {
+		t.Errorf("wrong token is accepted")
+	}
+	if err := verifier.Verify(map[string]string{}, "init", getPacket(), now); err == nil {
+		t.Errorf("request without the token is accepted")
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	now := time.Now()
+	verifier := &auth.Verifier{Mode: auth.ModeHMAC, Secret: []byte("s3cret"), MaxSkew: time.Minute}
+	metadata := sign(t, auth.ModeHMAC, "s3cret", "init", getPacket(), now)
+	if err := verifier.Verify(metadata, "init", getPacket(), now.Add(30*time.Second)); err != nil {
+		t.Errorf("valid signature is rejected %v", err)
+	}
+	if err := verifier.Verify(metadata, "hot", getPacket(), now); err == nil {
+		t.Errorf("signature of the other service is accepted")
+	}
+	if err := verifier.Verify(metadata, "init", getPacket(), now.Add(2*time.Minute)); err == nil {
+		t.Errorf("expired signature is accepted")
+	}
+	if err := verifier.Verify(sign(t, auth.ModeHMAC, "wrong", "init", getPacket(), now), "init", getPacket(), now); err == nil {
+		t.Errorf("signature of the wrong secret is accepted")
+	}
+
+	tampers := map[string]func(*rpc.LogMessage){
+		"namespace": func(p *rpc.LogMessage) { p.Namespace = "other:host" },
+		"map-table": func(p *rpc.LogMessage) { p.Files.MapTable[0] = "/etc/shadow" },
+		"indexes":   func(p *rpc.LogMessage) { p.Files.Indexes[0] = 1 },
+		"info":      func(p *rpc.LogMessage) { p.Info[0].Length = 8 },
+		"buffer":    func(p *rpc.LogMessage) { p.Buffer[0] = 'C' },
+	}
+	for name, tamper := range tampers {
+		packet := getPacket()
+		tamper(packet)
+		if err := verifier.Verify(metadata, "init", packet, now); err == nil {
+			t.Errorf("tampered %s is accepted", name)
+		}
+	}
+}
+
+func TestSignedMetadata(t *testing.T) {
+	now := time.Now()
+	verifier := &auth.Verifier{Mode: auth.ModeHMAC, Secret: []byte("s3cret")}
+	signer, _ := auth.NewSigner(auth.ModeHMAC, []byte("s3cret"))
+	signed := func() map[string]string {
+		metadata := map[string]string{"sequence": "1", "lines": "0:1:1"}
+		signer.Sign(metadata, "hot", getPacket(), now)
+		return metadata
+	}
+	metadata := signed()
+	if err := verifier.Verify(metadata, "hot", getPacket(), now); err != nil {
+		t.Errorf("valid signature is rejected %v", err)
+	}
+	if err := verifier.Verify(metadata, "hot", getPacket(), now); err == nil {
+		t.Errorf("replayed nonce is accepted")
+	}
+	for _, key := range []string{"sequence", "lines", auth.MetaNonce} {
+		metadata = signed()
+		metadata[key] = "2"
+		if err := verifier.Verify(metadata, "hot", getPacket(), now); err == nil {
+			t.Errorf("tampered %s is accepted", key)
+		}
+	}
+	metadata = signed()
+	delete(metadata, "sequence")
+	if err := verifier.Verify(metadata, "hot", getPacket(), now); err == nil {
+		t.Errorf("removed metadata is accepted")
+	}
+	if err := verifier.Verify(signed(), "hot", getPacket(), now); err != nil {
+		t.Errorf("signature of the new nonce is rejected %v", err)
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	dir, err := os.MkdirTemp("", "auth-test")
+	if err != nil {
+		t.Fatalf("test directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "secret")
+	os.WriteFile(filename, []byte("file-secret\n"), 0600)
+	os.Setenv("AUTH_TEST_SECRET", "env-secret")
+	defer os.Unsetenv("AUTH_TEST_SECRET")
+
+	if secret, err := auth.LoadSecret(filename, "AUTH_TEST_SECRET"); err != nil || string(secret) != "file-secret" {
+		t.Errorf("secret isn't read from the file %q %v", secret, err)
+	}
+	if secret, err := auth.LoadSecret("", "AUTH_TEST_SECRET"); err != nil || string(secret) != "env-secret" {
+		t.Errorf("secret isn't read from the environment %q %v", secret, err)
+	}
+	if _, err := auth.LoadSecret("", "AUTH_TEST_EMPTY"); err == nil {
+		t.Errorf("empty secret is accepted")
+	}
+	if _, err := auth.LoadSecret(filepath.Join(dir, "none"), ""); err == nil {
+		t.Errorf("missing secret file is accepted")
+	}
+}
+
+func TestInvalidMode(t *testing.T) {
+	if _, err := auth.NewSigner("basic", []byte("s3cret")); err == nil {
+		t.Errorf("invalid mode is accepted")
+	}
+	if _, err := auth.NewSigner(auth.ModeHMAC, nil); err == nil {
+		t.Errorf("empty secret is accepted")
+	}
+	if err := (&auth.Verifier{Mode: "basic"}).Verify(map[string]string{}, "init", getPacket(), time.Now()); err == nil {
+		t.Errorf("invalid mode is verified")
+	}
+}
@@ -3,25 +3,77 @@ package buffering
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"os"
+
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+)
+
+const (
+	// StartAtResume starts from the saved checkpoint (end of the file if there is none)
+	StartAtResume = "resume"
+	// StartAtEnd starts from the end of the file
+	StartAtEnd = "end"
+	// StartAtBeginning starts from the beginning of the file
+	StartAtBeginning = "beginning"
 )
 
+var (
+	linesRead     = metrics.DefaultRegistry.NewCounter("generator_lines_read_total", "Number of the lines read from the file.", "file")
+	bytesRead     = metrics.DefaultRegistry.NewCounter("generator_bytes_read_total", "Bytes read from the file.", "file")
+	checkpointLag = metrics.DefaultRegistry.NewGauge("generator_checkpoint_lag_bytes", "Bytes of the file which are not handed off yet.", "file")
+)
+
+// Options contains the optional settings of the Buffering structure
+// If Acknowledge is set, the offset is committed by the tickets of the lines
+// instead of after handing off them (see checkpoint.Tracker).
+// Pending returns the start of the first line which the line processing function
+// still holds (e.g. the pending multiline event), and the offset isn't committed beyond it.
+type Options struct {
+	Start       string
+	Checkpoint  *checkpoint.Registry
+	Acknowledge bool
+	Pending     func() (LineStart, bool)
+}
+
+// LineStart is the start position of a line
+// It is appended to the args of the line if Options.Pending is set.
+type LineStart struct {
+	File   *os.File
+	Offset int64
+}
+
 // Buffering structure contains the file information and line processing function
 type Buffering struct {
 	file                   *os.File
 	name                   string
 	reader                 *bufio.Reader
 	lineProcessingFunction func(string, interface{}) error
+	checkpoint             *checkpoint.Registry
+	acknowledge            bool
+	tracker                *checkpoint.Tracker
+	pending                func() (LineStart, bool)
 }
 
 // NewBuffering makes a new structure based on Buffering type
+// The file is read from the end without checkpoint.
 func NewBuffering(filename string, processFunction func(string, interface{}) error) (*Buffering, error) {
+	return NewBufferingWithOptions(filename, processFunction, Options{Start: StartAtEnd})
+}
+
+// NewBufferingWithOptions makes a new structure based on Buffering type with the options
+func NewBufferingWithOptions(filename string, processFunction func(string, interface{}) error, options Options) (*Buffering, error) {
 	var err error
 
 	buffering := new(Buffering)
 
 	buffering.name = filename
+	buffering.checkpoint = options.Checkpoint
+	buffering.acknowledge = options.Acknowledge && options.Checkpoint != nil
+	buffering.pending = options.Pending
 	if processFunction == nil {
 		err = errors.New("buffering's process function must be specified")
 		goto exception
@@ -31,8 +83,13 @@ func NewBuffering(filename string, processFunction func(string, interface{}) err
 	if err != nil {
 		goto exception
 	}
-	buffering.file.Seek(0, io.SeekEnd)
+	err = buffering.seekToStart(options.Start)
+	if err != nil {
+		buffering.file.Close()
+		goto exception
+	}
 	buffering.reader = bufio.NewReader(buffering.file)
+	buffering.track()
 
 	return buffering, err
 
@@ -40,8 +97,88 @@ exception:
 	return nil, err
 }
 
+// seekToStart moves the offset to the start position
+func (b *Buffering) seekToStart(start string) error {
+	var err error
+	switch start {
+	case StartAtBeginning:
+		_, err = b.file.Seek(0, io.SeekStart)
+	case StartAtEnd:
+		_, err = b.file.Seek(0, io.SeekEnd)
+	case StartAtResume, "":
+		err = b.seekToCheckpoint()
+	default:
+		err = fmt.Errorf("invalid start position %q", start)
+	}
+	return err
+}
+
+// seekToCheckpoint moves the offset to the saved checkpoint
+// If the saved file is replaced by another file, this starts from the beginning
+// because the whole contents are written after the checkpoint.
+func (b *Buffering) seekToCheckpoint() error {
+	var err error
+	if b.checkpoint == nil {
+		_, err = b.file.Seek(0, io.SeekEnd)
+		return err
+	}
+	entry, ok := b.checkpoint.Get(b.name)
+	if !ok {
+		_, err = b.file.Seek(0, io.SeekEnd)
+		return err
+	}
+	if entry.Match(b.file) {
+		_, err = b.file.Seek(entry.Offset, io.SeekStart)
+		return err
+	}
+	log.Printf("checkpoint of %s doesn't match the file, start from the beginning\n", b.name)
+	_, err = b.file.Seek(0, io.SeekStart)
+	return err
+}
+
+// track starts tracking the acknowledgements of the lines of the opened file
+// The tickets of the former file or offsets are ignored after this.
+func (b *Buffering) track() {
+	if !b.acknowledge {
+		return
+	}
+	b.tracker.Close()
+	b.tracker = checkpoint.NewTracker(b.checkpoint, b.name, b.file)
+}
+
+// commit records the offset of the lines handed off to the checkpoint
+// If the lines are acknowledged by the tickets, this only saves the acknowledged offset.
+// The lines held by the line processing function aren't handed off yet, so the offset
+// stops at the first of them.
+// The registry is written only when the offset has changed and its save interval has passed.
+func (b *Buffering) commit(offset int64) error {
+	if b.checkpoint == nil {
+		return nil
+	}
+	if b.acknowledge {
+		return b.checkpoint.Save()
+	}
+	if b.pending != nil {
+		if start, ok := b.pending(); ok && start.File == b.file && start.Offset < offset {
+			offset = start.Offset
+		}
+	}
+	entry, err := checkpoint.NewEntry(b.file, offset)
+	if err != nil {
+		return err
+	}
+	b.checkpoint.Update(b.name, entry)
+	return b.checkpoint.Save()
+}
+
 // Close collects the resources in the Buffering structure
+// The pending changes of the checkpoint are saved.
 func (b *Buffering) Close() {
+	checkpointLag.Delete(b.name)
+	b.tracker.Close()
+	if err := b.checkpoint.Flush(); err != nil {
+		log.Println("checkpoint save failed:", err)
+	}
 	b.file.Close()
 	b.file = nil
 }
@@ -74,19 +211,57 @@ exception:
 }
 
 // UpdateToValidOffset changes current offset to valid offset
+// The file which is smaller than the offset was truncated (e.g. copytruncate),
+// so the whole contents are new and read from the beginning.
 func (b *Buffering) UpdateToValidOffset() {
 	if isValid, _ := b.IsValidFileSize(); !isValid {
-		b.file.Seek(0, io.SeekEnd)
+		b.file.Seek(0, io.SeekStart)
+		b.reader.Reset(b.file)
+		b.track()
+	}
+}
+
+// IsRotated checks the path indicates another file than the opened one
+// A removed path is also rotated because the new file will be created.
+func (b *Buffering) IsRotated() (bool, error) {
+	pathStat, err := os.Stat(b.name)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	fileStat, err := b.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(pathStat, fileStat), nil
+}
+
+// Reopen opens the path again and reads the new file from the beginning
+// Note that the rotated file must be drained by DoReadLines before calling this.
+func (b *Buffering) Reopen() error {
+	file, err := os.Open(b.name)
+	if err != nil {
+		return err
 	}
+	b.tracker.Close()
+	b.file.Close()
+	b.file = file
+	b.reader.Reset(b.file)
+	b.track()
+	return nil
 }
 
 // DoReadLines does the read "lines" until encountering the EOF
 // Note that DoReadLines()'s args directly pass to buffering's line processing functions.
 // In other words, line processing function can hold the `[]interface{}` not `interface{}`.
 // Therfore, you must think this to when you create the line processing function.
+// If the lines are acknowledged, checkpoint.Position of the line's end is appended to the args,
+// and if Options.Pending is set, LineStart of the line is appended.
 func (b *Buffering) DoReadLines(args ...interface{}) (int64, error) {
 	var str string
 	var err error = nil
+	var lines, bytes int64 = 0, 0
 	file := b.file
 	offset, _ := file.Seek(0, io.SeekCurrent)
 
@@ -102,16 +277,49 @@ func (b *Buffering) DoReadLines(args ...interface{}) (int64, error) {
 		} else if err != nil {
 			goto exception
 		}
-		err = b.lineProcessingFunction(str, args)
+		err = b.lineProcessingFunction(str, b.lineArgs(args, offset, offset+int64(len(str))))
 		if err != nil {
 			goto exception
 		}
 		offset += (int64(len(str)))
+		lines++
+		bytes += int64(len(str))
 	}
 exception:
+	b.record(lines, bytes, offset)
+	if commitErr := b.commit(offset); err == nil {
+		err = commitErr
+	}
 	return offset, err
 }
 
+// lineArgs appends the position of the line's end to the args if the lines are acknowledged,
+// and the line's start if the lines can be held by the line processing function
+func (b *Buffering) lineArgs(args []interface{}, start int64, end int64) []interface{} {
+	if b.tracker == nil && b.pending == nil {
+		return args
+	}
+	args = args[:len(args):len(args)]
+	if b.tracker != nil {
+		args = append(args, b.tracker.At(end))
+	}
+	if b.pending != nil {
+		args = append(args, LineStart{File: b.file, Offset: start})
+	}
+	return args
+}
+
+// record updates the metrics of the lines handed off
+func (b *Buffering) record(lines int64, bytes int64, offset int64) {
+	if lines > 0 {
+		linesRead.Add(float64(lines), b.name)
+		bytesRead.Add(float64(bytes), b.name)
+	}
+	if size, err := b.GetFileSize(); err == nil {
+		checkpointLag.Set(float64(size-offset), b.name)
+	}
+}
+
 // SetProcessingFunction sets the processing line function
 func (b *Buffering) SetProcessingFunction(processFunction func(string, interface{}) error) {
 	b.lineProcessingFunction = processFunction
@@ -2,13 +2,17 @@ package buffering_test
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/soyoslab/soy_log_generator/pkg/buffering"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
 )
 
 func setup(prefix string) (*buffering.Buffering, error) {
@@ -111,7 +115,7 @@ func TestUpdateToValidOffset(t *testing.T) {
 		log.Fatalf("testFile write failed %v\n", err)
 	}
 
-	target, _ := b.GetFile().Seek(0, io.SeekEnd)
+	target, _ := b.GetFile().Seek(0, io.SeekStart)
 	b.GetFile().Seek(1, io.SeekEnd)
 	b.UpdateToValidOffset()
 	current, _ := b.GetFile().Seek(0, io.SeekCurrent)
@@ -175,3 +179,212 @@ func TestDoReadLinesInvalidFunction(t *testing.T) {
 		t.Errorf("do readlines invalid function %v", err)
 	}
 }
+
+func TestCheckpointResume(t *testing.T) {
+	b, _ := setup("test-checkpoint-resume")
+	defer teardown(b)
+	dir, _ := os.MkdirTemp("", "test-checkpoint-resume")
+	defer os.RemoveAll(dir)
+	registry, err := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		t.Fatalf("checkpoint open failed %v", err)
+	}
+	stringList := writeFiles(b.GetFile().Name())
+	options := buffering.Options{Start: buffering.StartAtBeginning, Checkpoint: registry}
+
+	read := []string{}
+	processFunction := func(str string, _ interface{}) error {
+		read = append(read, str)
+		return nil
+	}
+	first, err := buffering.NewBufferingWithOptions(b.GetFile().Name(), processFunction, options)
+	if err != nil {
+		t.Fatalf("buffering generation failed %v", err)
+	}
+	first.DoReadLines()
+	first.Close()
+
+	targetFile, _ := os.OpenFile(b.GetFile().Name(), os.O_WRONLY|os.O_APPEND, 0755)
+	targetFile.WriteString("555555\n")
+	targetFile.Close()
+
+	options.Start = buffering.StartAtResume
+	second, err := buffering.NewBufferingWithOptions(b.GetFile().Name(), processFunction, options)
+	if err != nil {
+		t.Fatalf("buffering generation failed %v", err)
+	}
+	defer second.Close()
+	second.DoReadLines()
+	if len(read) != len(stringList)+1 || read[len(read)-1] != "555555\n" {
+		t.Errorf("resume doesn't continue from the checkpoint %v", read)
+	}
+}
+
+func TestCheckpointPending(t *testing.T) {
+	b, _ := setup("test-checkpoint-pending")
+	defer teardown(b)
+	dir, _ := os.MkdirTemp("", "test-checkpoint-pending")
+	defer os.RemoveAll(dir)
+	registry, err := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	if err != nil {
+		t.Fatalf("checkpoint open failed %v", err)
+	}
+	stringList := writeFiles(b.GetFile().Name())
+
+	var held *buffering.LineStart
+	processFunction := func(str string, args interface{}) error {
+		for _, arg := range args.([]interface{}) {
+			if start, ok := arg.(buffering.LineStart); ok && held == nil && str == stringList[2] {
+				held = &start
+			}
+		}
+		return nil
+	}
+	pending := func() (buffering.LineStart, bool) {
+		if held == nil {
+			return buffering.LineStart{}, false
+		}
+		return *held, true
+	}
+	options := buffering.Options{Start: buffering.StartAtBeginning, Checkpoint: registry, Pending: pending}
+	first, err := buffering.NewBufferingWithOptions(b.GetFile().Name(), processFunction, options)
+	if err != nil {
+		t.Fatalf("buffering generation failed %v", err)
+	}
+	first.DoReadLines(b.GetFile().Name())
+	first.Close()
+	if held == nil {
+		t.Fatalf("line start isn't passed to the processing function")
+	}
+
+	read := []string{}
+	options = buffering.Options{Start: buffering.StartAtResume, Checkpoint: registry}
+	second, err := buffering.NewBufferingWithOptions(b.GetFile().Name(), func(str string, _ interface{}) error {
+		read = append(read, str)
+		return nil
+	}, options)
+	if err != nil {
+		t.Fatalf("buffering generation failed %v", err)
+	}
+	defer second.Close()
+	second.DoReadLines()
+	if len(read) != 3 || read[0] != stringList[2] {
+		t.Errorf("held lines aren't read again after the restart %v", read)
+	}
+}
+
+func TestCheckpointAcknowledge(t *testing.T) {
+	b, _ := setup("test-checkpoint-acknowledge")
+	defer teardown(b)
+	dir, _ := os.MkdirTemp("", "test-checkpoint-acknowledge")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	registry, err := checkpoint.Open(path)
+	if err != nil {
+		t.Fatalf("checkpoint open failed %v", err)
+	}
+	filename := b.GetFile().Name()
+	writeFiles(filename)
+	options := buffering.Options{Start: buffering.StartAtBeginning, Checkpoint: registry, Acknowledge: true}
+
+	tickets := []*checkpoint.Ticket{}
+	processFunction := func(_ string, args interface{}) error {
+		position, ok := args.([]interface{})[1].(checkpoint.Position)
+		if !ok {
+			t.Fatalf("position of the line isn't passed %v", args)
+		}
+		tickets = append(tickets, position.Track())
+		return nil
+	}
+	ack, err := buffering.NewBufferingWithOptions(filename, processFunction, options)
+	if err != nil {
+		t.Fatalf("buffering generation failed %v", err)
+	}
+	defer ack.Close()
+	ack.DoReadLines(filename)
+	if _, ok := registry.Get(filename); ok || len(tickets) != 5 {
+		t.Fatalf("unacknowledged lines are committed (tickets: %d)", len(tickets))
+	}
+
+	tickets[1].Done()
+	if _, ok := registry.Get(filename); ok {
+		t.Errorf("offset passes the unacknowledged line")
+	}
+	tickets[0].Done()
+	tickets[3].Done()
+	if entry, _ := registry.Get(filename); entry.Offset != 5 {
+		t.Errorf("offset isn't the low-water mark (offset: %d)", entry.Offset)
+	}
+	tickets[2].Done()
+	ack.DoReadLines(filename)
+	saved, _ := checkpoint.Open(path)
+	if entry, _ := saved.Get(filename); entry.Offset != 14 {
+		t.Errorf("acknowledged offset isn't saved (offset: %d)", entry.Offset)
+	}
+}
+
+func TestInvalidStartPosition(t *testing.T) {
+	b, _ := setup("test-invalid-start-position")
+	defer teardown(b)
+	options := buffering.Options{Start: "middle"}
+	_, err := buffering.NewBufferingWithOptions(b.GetFile().Name(), func(_ string, _ interface{}) error { return nil }, options)
+	if err == nil {
+		t.Errorf("invalid start position is accepted")
+	}
+}
+
+func TestReopen(t *testing.T) {
+	b, _ := setup("test-reopen")
+	defer teardown(b)
+	filename := b.GetFile().Name()
+	stringList := writeFiles(filename)
+
+	if rotated, _ := b.IsRotated(); rotated {
+		t.Errorf("same file is evaluated to rotated")
+	}
+	os.Rename(filename, filename+".1")
+	defer os.Remove(filename + ".1")
+	if rotated, _ := b.IsRotated(); !rotated {
+		t.Errorf("renamed file is evaluated to not rotated")
+	}
+	writeFiles(filename)
+	if rotated, _ := b.IsRotated(); !rotated {
+		t.Errorf("recreated file is evaluated to not rotated")
+	}
+
+	i := 0
+	b.SetProcessingFunction(func(str string, _ interface{}) error {
+		if str != stringList[i] {
+			t.Errorf("string is not equal %s <> %s", str, stringList[i])
+		}
+		i++
+		return nil
+	})
+	if err := b.Reopen(); err != nil {
+		t.Fatalf("reopen failed %v", err)
+	}
+	b.DoReadLines()
+	if i != len(stringList) {
+		t.Errorf("new file isn't read from the beginning (%d lines)", i)
+	}
+}
+
+func TestReadMetrics(t *testing.T) {
+	b, _ := setup("test-read-metrics")
+	defer teardown(b)
+	filename := b.GetFile().Name()
+	writeFiles(filename)
+	b.DoReadLines()
+
+	buffer := &strings.Builder{}
+	metrics.DefaultRegistry.Write(buffer)
+	for _, expected := range []string{
+		fmt.Sprintf("generator_lines_read_total{file=%q} 5", filename),
+		fmt.Sprintf("generator_bytes_read_total{file=%q} 20", filename),
+		fmt.Sprintf("generator_checkpoint_lag_bytes{file=%q} 0", filename),
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("metric %s isn't recorded", expected)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FingerprintSize is the maximum number of leading bytes used for the fingerprint
+const FingerprintSize = 1024
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// Entry contains the saved reading state of a file
+type Entry struct {
+	Device          uint64 `json:"device"`
+	Inode           uint64 `json:"inode"`
+	Offset          int64  `json:"offset"`
+	Fingerprint     uint64 `json:"fingerprint"`
+	FingerprintSize int64  `json:"fingerprintSize"`
+}
+
+// Registry contains the checkpoints of the every watched file
+// If the save interval is set, Save writes the changes at most once per interval.
+type Registry struct {
+	path     string
+	entries  map[string]Entry
+	dirty    bool
+	interval time.Duration
+	saved    time.Time
+	mutex    sync.Mutex
+}
+
+// Open loads the registry from the path
+// Note that a missing file is not an error; it gives an empty registry.
+func Open(path string) (*Registry, error) {
+	if len(path) == 0 {
+		return nil, errors.New("checkpoint path must be specified")
+	}
+	r := new(Registry)
+	r.path = path
+	r.entries = make(map[string]Entry)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return r, nil
+	}
+	err = json.Unmarshal(b, &r.entries)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetPath returns the path of the registry file
+func (r *Registry) GetPath() string {
+	return r.path
+}
+
+// Get returns the saved entry of the filename
+func (r *Registry) Get(filename string) (Entry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.entries[filename]
+	return entry, ok
+}
+
+// SetSaveInterval sets the minimum interval between the writes of Save
+func (r *Registry) SetSaveInterval(interval time.Duration) {
+	r.mutex.Lock()
+	r.interval = interval
+	r.mutex.Unlock()
+}
+
+// Update replaces the entry of the filename in memory
+// Call Save to make the change durable. The same entry doesn't change the registry.
+func (r *Registry) Update(filename string, entry Entry) {
+	r.mutex.Lock()
+	if current, ok := r.entries[filename]; !ok || current != entry {
+		r.entries[filename] = entry
+		r.dirty = true
+	}
+	r.mutex.Unlock()
+}
+
+// Delete removes the entry of the filename
+func (r *Registry) Delete(filename string) {
+	r.mutex.Lock()
+	if _, ok := r.entries[filename]; ok {
+		delete(r.entries, filename)
+		r.dirty = true
+	}
+	r.mutex.Unlock()
+}
+
+// Save writes the registry to the disk when it has changed
+// The changes within the save interval from the last write are kept in memory
+// until the next Save after the interval or Flush.
+func (r *Registry) Save() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.interval > 0 && time.Since(r.saved) < r.interval {
+		return nil
+	}
+	return r.save()
+}
+
+// Flush writes the registry to the disk when it has changed regardless of the save interval
+func (r *Registry) Flush() error {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.save()
+}
+
+// save writes the changed registry
+// The contents are written to a temporary file and renamed to the path,
+// so a crash leaves either the previous or the new registry.
+func (r *Registry) save() error {
+	if !r.dirty {
+		return nil
+	}
+	b, err := json.Marshal(r.entries)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(r.path, b)
+	if err == nil {
+		r.dirty, r.saved = false, time.Now()
+	}
+	return err
+}
+
+// Close saves the registry
+func (r *Registry) Close() error {
+	return r.Flush()
+}
+
+// writeFileAtomic writes the data to the temporary file and renames it to the path
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	fp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := fp.Name()
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir flushes the directory entry after the rename
+// Some platforms cannot sync a directory, so the error is ignored.
+func syncDir(dir string) {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	fp.Sync()
+	fp.Close()
+}
+
+// Fingerprint calculates the checksum of the file's leading bytes
+// It returns the checksum and the number of bytes used to calculate it.
+func Fingerprint(file *os.File, size int64) (uint64, int64, error) {
+	if size > FingerprintSize {
+		size = FingerprintSize
+	}
+	buffer := make([]byte, size)
+	n, err := file.ReadAt(buffer, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	return crc64.Checksum(buffer[:n], crcTable), int64(n), nil
+}
+
+// NewEntry makes the entry of the file which is read until the offset
+func NewEntry(file *os.File, offset int64) (Entry, error) {
+	entry := Entry{}
+	stat, err := file.Stat()
+	if err != nil {
+		return entry, err
+	}
+	entry.Device, entry.Inode = FileID(stat)
+	entry.Offset = offset
+	entry.Fingerprint, entry.FingerprintSize, err = Fingerprint(file, stat.Size())
+	return entry, err
+}
+
+// Match checks the entry was saved from the given file
+func (e Entry) Match(file *os.File) bool {
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	device, inode := FileID(stat)
+	if device != e.Device || inode != e.Inode {
+		return false
+	}
+	if stat.Size() < e.FingerprintSize || stat.Size() < e.Offset {
+		return false
+	}
+	fingerprint, size, err := Fingerprint(file, e.FingerprintSize)
+	if err != nil || size != e.FingerprintSize {
+		return false
+	}
+	return fingerprint == e.Fingerprint
+}
@@ -0,0 +1,177 @@
+package checkpoint_test
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+)
+
+func setup(prefix string) (*os.File, string) {
+	log.SetFlags(log.Lshortfile)
+	testFile, err := os.CreateTemp("", prefix)
+	if err != nil {
+		log.Fatalf("test file creation failed: %v", err)
+	}
+	dir, err := os.MkdirTemp("", prefix)
+	if err != nil {
+		log.Fatalf("test directory creation failed: %v", err)
+	}
+	return testFile, filepath.Join(dir, "checkpoint.json")
+}
+
+func teardown(file *os.File, path string) {
+	file.Close()
+	os.Remove(file.Name())
+	os.RemoveAll(filepath.Dir(path))
+}
+
+func TestOpenInvalidPath(t *testing.T) {
+	_, err := checkpoint.Open("")
+	if err == nil {
+		t.Errorf("empty path is accepted")
+	}
+}
+
+func TestSaveAndOpen(t *testing.T) {
+	file, path := setup("test-checkpoint-save")
+	defer teardown(file, path)
+	file.WriteString("0123456789\n")
+
+	r, err := checkpoint.Open(path)
+	if err != nil {
+		t.Fatalf("open failed %v", err)
+	}
+	entry, err := checkpoint.NewEntry(file, 11)
+	if err != nil {
+		t.Fatalf("new entry failed %v", err)
+	}
+	r.Update(file.Name(), entry)
+	if err = r.Close(); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+
+	r, err = checkpoint.Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed %v", err)
+	}
+	saved, ok := r.Get(file.Name())
+	if !ok || saved != entry {
+		t.Errorf("saved entry mismatch %v <> %v", saved, entry)
+	}
+	if !saved.Match(file) {
+		t.Errorf("saved entry doesn't match the same file")
+	}
+	matches, _ := filepath.Glob(path + ".tmp*")
+	if len(matches) != 0 {
+		t.Errorf("temporary files remain %v", matches)
+	}
+}
+
+func TestSaveInterval(t *testing.T) {
+	file, path := setup("test-checkpoint-interval")
+	defer teardown(file, path)
+
+	r, err := checkpoint.Open(path)
+	if err != nil {
+		t.Fatalf("open failed %v", err)
+	}
+	r.SetSaveInterval(time.Hour)
+	r.Update(file.Name(), checkpoint.Entry{Offset: 1})
+	if err = r.Save(); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("first save isn't written %v", err)
+	}
+	r.Update(file.Name(), checkpoint.Entry{Offset: 2})
+	r.Save()
+	if saved, _ := checkpoint.Open(path); saved == nil || mustGet(saved, file.Name()).Offset != 1 {
+		t.Errorf("save within the interval is written")
+	}
+	if err = r.Flush(); err != nil {
+		t.Fatalf("flush failed %v", err)
+	}
+	if saved, _ := checkpoint.Open(path); saved == nil || mustGet(saved, file.Name()).Offset != 2 {
+		t.Errorf("flush isn't written")
+	}
+
+	flushed, _ := os.Stat(path)
+	r.Update(file.Name(), checkpoint.Entry{Offset: 2})
+	r.Flush()
+	if unchanged, _ := os.Stat(path); !os.SameFile(flushed, unchanged) || os.SameFile(stat, flushed) {
+		t.Errorf("unchanged registry is written again")
+	}
+}
+
+func mustGet(r *checkpoint.Registry, filename string) checkpoint.Entry {
+	entry, _ := r.Get(filename)
+	return entry
+}
+
+func TestMatchReplacedFile(t *testing.T) {
+	file, path := setup("test-checkpoint-replaced")
+	defer teardown(file, path)
+	file.WriteString("0123456789\n")
+	entry, _ := checkpoint.NewEntry(file, 11)
+
+	file.Truncate(0)
+	file.WriteAt([]byte("9876543210\n"), 0)
+	if entry.Match(file) {
+		t.Errorf("entry matches the changed contents")
+	}
+	file.Truncate(5)
+	if entry.Match(file) {
+		t.Errorf("entry matches the truncated file")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	file, path := setup("test-checkpoint-delete")
+	defer teardown(file, path)
+	r, _ := checkpoint.Open(path)
+	r.Update(file.Name(), checkpoint.Entry{Offset: 1})
+	r.Delete(file.Name())
+	if _, ok := r.Get(file.Name()); ok {
+		t.Errorf("deleted entry exists")
+	}
+}
+
+func TestTracker(t *testing.T) {
+	file, path := setup("test-checkpoint-tracker")
+	defer teardown(file, path)
+	file.WriteString("0\n11\n222\n")
+	r, _ := checkpoint.Open(path)
+	tracker := checkpoint.NewTracker(r, file.Name(), file)
+	first, second, third := tracker.At(2).Track(), tracker.At(5).Track(), tracker.At(9).Track()
+
+	third.Done()
+	if _, ok := r.Get(file.Name()); ok {
+		t.Errorf("offset passes the unacknowledged lines")
+	}
+	first.Done()
+	first.Done()
+	if entry, _ := r.Get(file.Name()); entry.Offset != 2 || tracker.Pending() != 2 {
+		t.Errorf("invalid low-water mark (offset: %d, pending: %d)", entry.Offset, tracker.Pending())
+	}
+	second.Done()
+	if entry, _ := r.Get(file.Name()); entry.Offset != 9 || !entry.Match(file) || tracker.Pending() != 0 {
+		t.Errorf("acknowledged lines aren't committed (offset: %d, pending: %d)", entry.Offset, tracker.Pending())
+	}
+
+	late := tracker.At(12).Track()
+	tracker.Close()
+	if err := late.Done(); err != nil {
+		t.Errorf("closed tracker fails %v", err)
+	}
+	if entry, _ := r.Get(file.Name()); entry.Offset != 9 {
+		t.Errorf("closed tracker commits the offset %d", entry.Offset)
+	}
+	if err := (checkpoint.Position{}).Track().Done(); err != nil {
+		t.Errorf("untracked position fails %v", err)
+	}
+}
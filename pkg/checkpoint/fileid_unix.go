@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package checkpoint
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileID returns the device and inode number of the file
+func FileID(stat os.FileInfo) (uint64, uint64) {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(sys.Dev), uint64(sys.Ino)
+}
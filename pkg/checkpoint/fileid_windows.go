@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package checkpoint
+
+import (
+	"os"
+)
+
+// FileID returns the device and inode number of the file
+// Windows doesn't expose them through os.FileInfo, so the fingerprint
+// is the only way to identify the file.
+func FileID(stat os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
@@ -0,0 +1,126 @@
+package checkpoint
+
+import (
+	"os"
+	"sync"
+)
+
+// Tracker commits the offset of a file only after the lines before it are acknowledged
+// The committed offset is the low-water mark: the end of the latest line such that
+// it and all the former lines are acknowledged, so the unacknowledged lines are
+// read again after a crash.
+type Tracker struct {
+	registry *Registry
+	name     string
+	file     *os.File
+	pending  []*Ticket
+	closed   bool
+	mutex    sync.Mutex
+}
+
+// Ticket is the line (or the joined lines) which is handed off but not acknowledged yet
+// The ticket which is handed off to several destinations needs their acknowledgements (see Add).
+type Ticket struct {
+	tracker *Tracker
+	offset  int64
+	refs    int
+	done    bool
+}
+
+// Position is the end offset of the line read from the tracked file
+type Position struct {
+	tracker *Tracker
+	offset  int64
+}
+
+// NewTracker makes the tracker which commits the offsets of the file to the registry
+// The name is the key of the registry entry.
+func NewTracker(registry *Registry, name string, file *os.File) *Tracker {
+	return &Tracker{registry: registry, name: name, file: file}
+}
+
+// At returns the position of the line which ends at the offset
+func (t *Tracker) At(offset int64) Position {
+	return Position{tracker: t, offset: offset}
+}
+
+// Track returns the ticket of the line which ends at the position
+// The tickets must be taken in the order of the offsets.
+// It returns nil if the position isn't tracked.
+func (p Position) Track() *Ticket {
+	t := p.tracker
+	if t == nil {
+		return nil
+	}
+	ticket := &Ticket{tracker: t, offset: p.offset, refs: 1}
+	t.mutex.Lock()
+	if !t.closed {
+		t.pending = append(t.pending, ticket)
+	}
+	t.mutex.Unlock()
+	return ticket
+}
+
+// Pending returns the number of the unacknowledged tickets
+func (t *Tracker) Pending() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.pending)
+}
+
+// Close detaches the tracker from the file
+// The tickets acknowledged later don't change the registry,
+// so call this before closing the file or reading it from another offset.
+func (t *Tracker) Close() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	t.closed = true
+	t.pending = nil
+	t.mutex.Unlock()
+}
+
+// Add adds the number of the acknowledgements needed before the ticket is done
+func (k *Ticket) Add(n int) {
+	if k == nil {
+		return
+	}
+	k.tracker.mutex.Lock()
+	k.refs += n
+	k.tracker.mutex.Unlock()
+}
+
+// Done acknowledges the ticket and updates the registry entry to the low-water mark
+// when all the acknowledgements are received. Call Registry.Save to make the change durable.
+func (k *Ticket) Done() error {
+	if k == nil {
+		return nil
+	}
+	t := k.tracker
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if k.done || t.closed {
+		return nil
+	}
+	k.refs--
+	if k.refs > 0 {
+		return nil
+	}
+	k.done = true
+	committed := int64(-1)
+	for len(t.pending) > 0 && t.pending[0].done {
+		committed = t.pending[0].offset
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+	}
+	if committed < 0 {
+		return nil
+	}
+	entry, err := NewEntry(t.file, committed)
+	if err != nil {
+		return err
+	}
+	t.registry.Update(t.name, entry)
+	return nil
+}
@@ -1,7 +1,138 @@
 package compressor
 
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// CodecNone sends the data as it is
+	CodecNone = "none"
+	// CodecGzip compresses the data by gzip (level: 1-9)
+	CodecGzip = "gzip"
+	// CodecZstd compresses the data by zstandard (level: 1-22)
+	CodecZstd = "zstd"
+	// CodecSnappy compresses the data by the snappy block format
+	CodecSnappy = "snappy"
+	// CodecS2 compresses the data by the s2 block format (level: 1-3)
+	CodecS2 = "s2"
+	// CodecLz4 compresses the data by the lz4 frame format (level: 1-9)
+	CodecLz4 = "lz4"
+)
+
 // Compressor is generic interface for compressor algorithms
 type Compressor interface {
 	Compress(data []byte) ([]byte, error)
 	Decompress(data []byte) ([]byte, error)
 }
+
+// Factory makes the compressor of the level
+// Zero level means the default level of the codec.
+type Factory func(level int) (Compressor, error)
+
+// codec contains the frame identifier and the factory of the codec
+type codec struct {
+	id      byte
+	factory Factory
+}
+
+var (
+	codecs      = make(map[string]codec)
+	codecNames  = make(map[byte]string)
+	codecsMutex sync.RWMutex
+)
+
+func init() {
+	Register(CodecNone, 0, func(level int) (Compressor, error) {
+		return &NoneComp{}, checkLevel(CodecNone, level, 0)
+	})
+	Register(CodecGzip, 1, func(level int) (Compressor, error) {
+		return &GzipComp{Level: level}, checkLevel(CodecGzip, level, 9)
+	})
+	Register(CodecZstd, 2, func(level int) (Compressor, error) {
+		return &ZstdComp{Level: level}, checkLevel(CodecZstd, level, 22)
+	})
+	Register(CodecSnappy, 3, func(level int) (Compressor, error) {
+		return &SnappyComp{}, checkLevel(CodecSnappy, level, 0)
+	})
+	Register(CodecS2, 4, func(level int) (Compressor, error) {
+		return &S2Comp{Level: level}, checkLevel(CodecS2, level, 3)
+	})
+	Register(CodecLz4, 5, func(level int) (Compressor, error) {
+		return &Lz4Comp{Level: level}, checkLevel(CodecLz4, level, 9)
+	})
+}
+
+// checkLevel checks the level is between 0 and the max level of the codec
+func checkLevel(name string, level int, max int) error {
+	if level < 0 || level > max {
+		return fmt.Errorf("invalid %s compression level %d (max: %d)", name, level, max)
+	}
+	return nil
+}
+
+// Register adds the compressor factory to the registry
+// The id identifies the codec in the framed payload. The factory which has the
+// same name is replaced, and it panics when the id is used by another codec.
+func Register(name string, id byte, factory Factory) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	if registered, ok := codecNames[id]; ok && registered != name {
+		panic(fmt.Sprintf("codec id %d is registered by %s", id, registered))
+	}
+	if previous, ok := codecs[name]; ok {
+		delete(codecNames, previous.id)
+	}
+	codecs[name] = codec{id: id, factory: factory}
+	codecNames[id] = name
+}
+
+// New returns the compressor of the codec name and the level
+func New(name string, level int) (Compressor, error) {
+	codecsMutex.RLock()
+	c, ok := codecs[name]
+	codecsMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %q", name)
+	}
+	compressor, err := c.factory(level)
+	if err != nil {
+		return nil, err
+	}
+	return compressor, nil
+}
+
+// getCodecID returns the frame identifier of the codec
+func getCodecID(name string) (byte, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown compression codec %q", name)
+	}
+	return c.id, nil
+}
+
+// getCodecName returns the codec name of the frame identifier
+func getCodecName(id byte) (string, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	name, ok := codecNames[id]
+	if !ok {
+		return "", fmt.Errorf("unknown compression codec id %d", id)
+	}
+	return name, nil
+}
+
+// Names returns the registered codec names in order
+func Names() []string {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
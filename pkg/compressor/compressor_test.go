@@ -1,11 +1,17 @@
 package compressor_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/soyoslab/soy_log_generator/pkg/compressor"
 )
 
@@ -176,3 +182,260 @@ func BenchmarkZstdDecompress4KB(b *testing.B) {
 		_ = result
 	}
 }
+
+func TestRegistry(t *testing.T) {
+	source := []byte(strings.Repeat("Hello World ", 128))
+	levels := map[string][]int{
+		compressor.CodecNone:   {0},
+		compressor.CodecGzip:   {0, 1, 9},
+		compressor.CodecZstd:   {0, 1, 22},
+		compressor.CodecSnappy: {0},
+		compressor.CodecS2:     {0, 1, 2, 3},
+		compressor.CodecLz4:    {0, 1, 9},
+	}
+	if len(compressor.Names()) != len(levels) {
+		t.Errorf("invalid registered codecs %v", compressor.Names())
+	}
+	for name, list := range levels {
+		for _, level := range list {
+			c, err := compressor.New(name, level)
+			if err != nil {
+				t.Fatalf("%s(%d) creation failed %v", name, level, err)
+			}
+			buffer, err := c.Compress(source)
+			if err != nil {
+				t.Errorf("%s(%d) compress failed %v", name, level, err)
+			}
+			target, err := c.Decompress(buffer)
+			if err != nil || string(target) != string(source) {
+				t.Errorf("%s(%d) decompress failed %v", name, level, err)
+			}
+		}
+	}
+}
+
+func TestRegistryInvalid(t *testing.T) {
+	if _, err := compressor.New("brotli", 0); err == nil {
+		t.Errorf("unknown codec is created")
+	}
+	if _, err := compressor.New(compressor.CodecGzip, 10); err == nil {
+		t.Errorf("invalid level is accepted")
+	}
+	if _, err := compressor.New(compressor.CodecSnappy, 1); err == nil {
+		t.Errorf("level of the codec without levels is accepted")
+	}
+}
+
+func TestFrame(t *testing.T) {
+	source := []byte(strings.Repeat("Hello World ", 128))
+	for _, name := range compressor.Names() {
+		c, err := compressor.NewFramed(name, 0)
+		if err != nil {
+			t.Fatalf("%s framed compressor creation failed %v", name, err)
+		}
+		buffer, err := c.Compress(source)
+		if err != nil {
+			t.Errorf("%s frame compress failed %v", name, err)
+		}
+		target, err := compressor.DecompressAuto(buffer)
+		if err != nil || string(target) != string(source) {
+			t.Errorf("%s frame isn't decompressed automatically %v", name, err)
+		}
+		if _, err = compressor.DecompressAuto(buffer[:5]); err == nil {
+			t.Errorf("%s truncated frame is decompressed", name)
+		}
+	}
+	if _, err := compressor.DecompressAuto([]byte("SLGF\xfe\x00")); err == nil {
+		t.Errorf("frame of the unknown codec is decompressed")
+	}
+	if _, err := compressor.DecompressAuto([]byte("SLGF\x00\x05data")); err == nil {
+		t.Errorf("frame length mismatch isn't detected")
+	}
+}
+
+func TestDecompressAuto(t *testing.T) {
+	source := []byte(strings.Repeat("Hello World ", 128))
+	for _, name := range []string{compressor.CodecGzip, compressor.CodecZstd, compressor.CodecLz4} {
+		c, _ := compressor.New(name, 0)
+		buffer, _ := c.Compress(source)
+		target, err := compressor.DecompressAuto(buffer)
+		if err != nil || string(target) != string(source) {
+			t.Errorf("%s magic number isn't detected %v", name, err)
+		}
+	}
+	c, _ := compressor.New(compressor.CodecSnappy, 0)
+	buffer, _ := c.Compress(source)
+	if _, err := compressor.DecompressAuto(buffer); err != compressor.ErrUnknownFormat {
+		t.Errorf("unframed snappy block is detected %v", err)
+	}
+}
+
+func TestConcurrentCompress(t *testing.T) {
+	var wait sync.WaitGroup
+	for _, c := range []compressor.Compressor{&compressor.GzipComp{}, &compressor.ZstdComp{Level: 3}} {
+		for i := 0; i < 8; i++ {
+			wait.Add(1)
+			go func(c compressor.Compressor, i int) {
+				defer wait.Done()
+				for n := 0; n < 32; n++ {
+					source := strings.Repeat(fmt.Sprintf("line %d-%d ", i, n), 64)
+					buffer, err := c.Compress([]byte(source))
+					if err != nil {
+						t.Errorf("%T concurrent compress failed %v", c, err)
+						return
+					}
+					target, err := c.Decompress(buffer)
+					if err != nil || string(target) != source {
+						t.Errorf("%T concurrent decompress returns the other data %v", c, err)
+						return
+					}
+				}
+			}(c, i)
+		}
+	}
+	wait.Wait()
+}
+
+// unpooledGzip is the gzip compressor which allocates the writer and the reader on every call
+// It is the baseline of the pooling benchmarks.
+type unpooledGzip struct{}
+
+func (u *unpooledGzip) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(data)
+	writer.Close()
+	return buffer.Bytes(), err
+}
+
+func (u *unpooledGzip) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// unpooledZstd is the zstd compressor which creates the encoder and the decoder on every call
+// It is the baseline of the pooling benchmarks.
+type unpooledZstd struct{}
+
+func (u *unpooledZstd) Compress(data []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, make([]byte, 0, len(data))), nil
+}
+
+func (u *unpooledZstd) Decompress(data []byte) ([]byte, error) {
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+	return decoder.DecodeAll(data, nil)
+}
+
+// getLogLines returns the log-like data of the size
+func getLogLines(size int) []byte {
+	var b strings.Builder
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "2021-07-19T11:25:09Z INFO request %d served in %dms (%s)\n", i, i%97, getRandomString(8))
+	}
+	return []byte(b.String()[:size])
+}
+
+// BenchmarkPooling compares the pooled compressors with the per-call baselines
+// Run with -benchmem to see the allocation reduction.
+func BenchmarkPooling(b *testing.B) {
+	compressors := []struct {
+		name string
+		c    compressor.Compressor
+	}{
+		{"gzip/unpooled", &unpooledGzip{}},
+		{"gzip/pooled", &compressor.GzipComp{}},
+		{"zstd/unpooled", &unpooledZstd{}},
+		{"zstd/pooled", &compressor.ZstdComp{}},
+	}
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"4KB", 4096},
+		{"16MB", 4096 * 4096},
+	}
+	for _, size := range sizes {
+		data := getLogLines(size.size)
+		for _, target := range compressors {
+			compressed, _ := target.c.Compress(data)
+			b.Run(target.name+"/compress/"+size.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				for n := 0; n < b.N; n++ {
+					target.c.Compress(data)
+				}
+			})
+			b.Run(target.name+"/decompress/"+size.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				for n := 0; n < b.N; n++ {
+					target.c.Decompress(compressed)
+				}
+			})
+		}
+	}
+}
+
+// getLogSamples returns the log lines as the samples of the dictionary training
+func getLogSamples(count int) [][]byte {
+	samples := [][]byte{}
+	levels := []string{"INFO", "WARN", "DEBUG"}
+	for i := 0; i < count; i++ {
+		line := fmt.Sprintf("2021-07-19T11:%02d:%02dZ %s [http-server] request GET /api/v1/users/%d served in %dms user-agent=Mozilla/5.0\n",
+			i%60, (i*7)%60, levels[i%len(levels)], rand.Intn(100000), rand.Intn(1000))
+		samples = append(samples, []byte(line))
+	}
+	return samples
+}
+
+func TestZstdDict(t *testing.T) {
+	dict, err := compressor.TrainZstdDict(getLogSamples(2000), 4096, 1001)
+	if err != nil {
+		t.Fatalf("dictionary training failed %v", err)
+	}
+	if id, err := compressor.ZstdDictID(dict); err != nil || id != 1001 {
+		t.Errorf("invalid dictionary id %d %v", id, err)
+	}
+	if _, err = (&compressor.ZstdComp{DictID: 1001}).Compress([]byte("test")); err == nil {
+		t.Errorf("unregistered dictionary is used")
+	}
+	if _, err = compressor.RegisterZstdDict(dict); err != nil {
+		t.Fatalf("dictionary registration failed %v", err)
+	}
+
+	source := bytes.Join(getLogSamples(30), nil)
+	plain, _ := (&compressor.ZstdComp{}).Compress(source)
+	c := &compressor.ZstdComp{DictID: 1001}
+	buffer, err := c.Compress(source)
+	if err != nil {
+		t.Fatalf("compress with the dictionary failed %v", err)
+	}
+	if len(buffer) >= len(plain) {
+		t.Errorf("dictionary doesn't improve the ratio (dictionary: %d, plain: %d)", len(buffer), len(plain))
+	}
+	target, err := compressor.DecompressAuto(buffer)
+	if err != nil || string(target) != string(source) {
+		t.Errorf("frame of the dictionary isn't decompressed %v", err)
+	}
+
+	other, _ := compressor.TrainZstdDict(getLogSamples(100), 1024, 1001)
+	if _, err = compressor.RegisterZstdDict(other); err == nil {
+		t.Errorf("another dictionary of the same id is registered")
+	}
+	if _, err = compressor.TrainZstdDict([][]byte{[]byte("a"), []byte("b")}, 1024, 1002); err == nil {
+		t.Errorf("dictionary is trained without the common content")
+	}
+}
@@ -0,0 +1,111 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// ErrUnknownFormat is returned when the payload is neither framed nor has a known magic number
+var ErrUnknownFormat = errors.New("unknown compressed payload format")
+
+var (
+	// frameMagic is the prefix of the framed payload
+	frameMagic        = []byte("SLGF")
+	gzipMagic         = []byte{0x1f, 0x8b}
+	zstdMagic         = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic          = []byte{0x04, 0x22, 0x4d, 0x18}
+	snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+	s2StreamMagic     = []byte("\xff\x06\x00\x00S2sTwO")
+)
+
+// FramedComp is a compressor which prefixes the codec identifier and the uncompressed length
+// The frame is the magic "SLGF", the codec id (1 byte), the uncompressed length (uvarint)
+// and the compressed data. Its Decompress reads any payload regardless of the codec.
+type FramedComp struct {
+	Codec      string
+	Compressor Compressor
+}
+
+// NewFramed returns the framed compressor of the codec name and the level
+func NewFramed(name string, level int) (*FramedComp, error) {
+	compressor, err := New(name, level)
+	if err != nil {
+		return nil, err
+	}
+	return &FramedComp{Codec: name, Compressor: compressor}, nil
+}
+
+// Compress compresses the data and prefixes the frame header
+func (f *FramedComp) Compress(data []byte) ([]byte, error) {
+	id, err := getCodecID(f.Codec)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := f.Compressor.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(frameMagic)+1+binary.MaxVarintLen64)
+	n := copy(header, frameMagic)
+	header[n] = id
+	n++
+	n += binary.PutUvarint(header[n:], uint64(len(data)))
+	return append(header[:n], compressed...), nil
+}
+
+// Decompress decompresses the framed or the detectable payload
+func (f *FramedComp) Decompress(data []byte) ([]byte, error) {
+	return DecompressAuto(data)
+}
+
+// DecompressAuto decompresses the payload without knowing its codec
+// The framed payload is decoded by its codec id, and the unframed payload is
+// detected by the magic number of gzip, zstd, lz4 frame and snappy/s2 stream.
+// The unframed snappy/s2 block and the uncompressed data return ErrUnknownFormat.
+func DecompressAuto(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, frameMagic):
+		return decompressFrame(data[len(frameMagic):])
+	case bytes.HasPrefix(data, gzipMagic):
+		return (&GzipComp{}).Decompress(data)
+	case bytes.HasPrefix(data, zstdMagic):
+		return (&ZstdComp{}).Decompress(data)
+	case bytes.HasPrefix(data, lz4Magic):
+		return (&Lz4Comp{}).Decompress(data)
+	case bytes.HasPrefix(data, snappyStreamMagic), bytes.HasPrefix(data, s2StreamMagic):
+		return ioutil.ReadAll(s2.NewReader(bytes.NewReader(data)))
+	}
+	return nil, ErrUnknownFormat
+}
+
+// decompressFrame decompresses the frame after the magic and checks the uncompressed length
+func decompressFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 1 {
+		return nil, errors.New("truncated frame header")
+	}
+	name, err := getCodecName(frame[0])
+	if err != nil {
+		return nil, err
+	}
+	length, n := binary.Uvarint(frame[1:])
+	if n <= 0 {
+		return nil, errors.New("invalid frame length")
+	}
+	compressor, err := New(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	data, err := compressor.Decompress(frame[1+n:])
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) != length {
+		return nil, fmt.Errorf("frame length mismatch (header: %d, data: %d)", length, len(data))
+	}
+	return data, nil
+}
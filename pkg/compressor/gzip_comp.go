@@ -4,34 +4,85 @@ import (
 	"bytes"
 	"compress/gzip"
 	"io/ioutil"
+	"sync"
+)
+
+var (
+	gzipWriters      = make(map[int]*sync.Pool)
+	gzipWritersMutex sync.Mutex
+	gzipReaders      sync.Pool
 )
 
 // GzipComp is a compressor which uses the gzip
+// Zero level uses the default compression level.
+// The writers and the readers are pooled, so it is safe for the concurrent use.
 type GzipComp struct {
+	Level int
+}
+
+// getGzipWriters returns the writer pool of the level
+func getGzipWriters(level int) (*sync.Pool, error) {
+	gzipWritersMutex.Lock()
+	defer gzipWritersMutex.Unlock()
+	if pool, ok := gzipWriters[level]; ok {
+		return pool, nil
+	}
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	pool := &sync.Pool{New: func() interface{} {
+		writer, _ := gzip.NewWriterLevel(ioutil.Discard, level)
+		return writer
+	}}
+	gzipWriters[level] = pool
+	return pool, nil
 }
 
 // Compress compresses the data based on the gzip
 func (l *GzipComp) Compress(data []byte) ([]byte, error) {
-	var buffer bytes.Buffer
-	writer := gzip.NewWriter(&buffer)
-	_, err := writer.Write(data)
-	writer.Close()
-	return buffer.Bytes(), err
+	level := l.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	pool, err := getGzipWriters(level)
+	if err != nil {
+		return nil, err
+	}
+	scratch := getScratch()
+	defer putScratch(scratch)
+	buffer := bytes.NewBuffer(*scratch)
+	writer := pool.Get().(*gzip.Writer)
+	writer.Reset(buffer)
+	_, err = writer.Write(data)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	pool.Put(writer)
+	*scratch = buffer.Bytes()
+	return detach(*scratch), err
 }
 
 // Decompress decompresses the data which was compressed by gzip
 func (l *GzipComp) Decompress(data []byte) ([]byte, error) {
-	var ret []byte
 	var err error
-	var reader *gzip.Reader
-
-	buffer := bytes.NewBuffer(data)
-	reader, err = gzip.NewReader(buffer)
+	reader, ok := gzipReaders.Get().(*gzip.Reader)
+	if ok {
+		err = reader.Reset(bytes.NewReader(data))
+	} else {
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	}
 	if err != nil {
-		goto out
+		return nil, err
 	}
-	ret, err = ioutil.ReadAll(reader)
+	scratch := getScratch()
+	defer putScratch(scratch)
+	buffer := bytes.NewBuffer(*scratch)
+	_, err = buffer.ReadFrom(reader)
 	reader.Close()
-out:
-	return ret, err
+	gzipReaders.Put(reader)
+	*scratch = buffer.Bytes()[:0]
+	if err != nil {
+		return nil, err
+	}
+	return detach(buffer.Bytes()), nil
 }
@@ -0,0 +1,38 @@
+package compressor
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// Lz4Comp is a compressor which uses the lz4 frame format
+// Zero level uses the fast compression.
+type Lz4Comp struct {
+	Level int
+}
+
+// Compress compresses the data based on the lz4
+func (l *Lz4Comp) Compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := lz4.NewWriter(&buffer)
+	level := lz4.Fast
+	if l.Level > 0 {
+		level = lz4.CompressionLevel(1 << (8 + l.Level))
+	}
+	if err := writer.Apply(lz4.CompressionLevelOption(level)); err != nil {
+		return nil, err
+	}
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	return buffer.Bytes(), err
+}
+
+// Decompress decompresses the data which was compressed by lz4
+func (l *Lz4Comp) Decompress(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+}
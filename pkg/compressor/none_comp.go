@@ -0,0 +1,15 @@
+package compressor
+
+// NoneComp is a compressor which doesn't compress the data
+type NoneComp struct {
+}
+
+// Compress returns the data as it is
+func (l *NoneComp) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// Decompress returns the data as it is
+func (l *NoneComp) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
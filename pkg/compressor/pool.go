@@ -0,0 +1,32 @@
+package compressor
+
+import (
+	"sync"
+)
+
+// maxPooledBuffer is the capacity limit of the scratch buffer which is returned to the pool
+// The larger buffer is released to the GC, so a huge payload doesn't pin the memory.
+const maxPooledBuffer = 64 * 1024 * 1024
+
+// scratchBuffers contains the reusable output buffers of the compressors
+var scratchBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// getScratch returns the empty scratch buffer from the pool
+func getScratch() *[]byte {
+	scratch := scratchBuffers.Get().(*[]byte)
+	*scratch = (*scratch)[:0]
+	return scratch
+}
+
+// putScratch returns the scratch buffer to the pool
+func putScratch(scratch *[]byte) {
+	if cap(*scratch) > maxPooledBuffer {
+		return
+	}
+	scratchBuffers.Put(scratch)
+}
+
+// detach copies the result out of the scratch buffer, so the caller owns it
+func detach(data []byte) []byte {
+	return append(make([]byte, 0, len(data)), data...)
+}
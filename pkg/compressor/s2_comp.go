@@ -0,0 +1,42 @@
+package compressor
+
+import (
+	"github.com/klauspost/compress/s2"
+)
+
+// S2Comp is a compressor which uses the s2 block format
+// The level 1 (default) is the fastest, 2 is better and 3 is the best compression.
+type S2Comp struct {
+	Level int
+}
+
+// SnappyComp is a compressor which uses the snappy block format
+type SnappyComp struct {
+}
+
+// Compress compresses the data based on the s2
+func (l *S2Comp) Compress(data []byte) ([]byte, error) {
+	switch l.Level {
+	case 2:
+		return s2.EncodeBetter(nil, data), nil
+	case 3:
+		return s2.EncodeBest(nil, data), nil
+	}
+	return s2.Encode(nil, data), nil
+}
+
+// Decompress decompresses the data which was compressed by s2
+func (l *S2Comp) Decompress(data []byte) ([]byte, error) {
+	return s2.Decode(nil, data)
+}
+
+// Compress compresses the data based on the snappy
+func (l *SnappyComp) Compress(data []byte) ([]byte, error) {
+	return s2.EncodeSnappy(nil, data), nil
+}
+
+// Decompress decompresses the data which was compressed by snappy
+// The s2 decoder reads the snappy block format as well.
+func (l *SnappyComp) Decompress(data []byte) ([]byte, error) {
+	return s2.Decode(nil, data)
+}
@@ -1,25 +1,116 @@
 package compressor
 
 import (
+	"sync"
+
 	"github.com/klauspost/compress/zstd"
 )
 
+// zstdEncoderKey identifies the shared encoder
+type zstdEncoderKey struct {
+	level  int
+	dictID uint32
+}
+
+var (
+	zstdEncoders      = make(map[zstdEncoderKey]*zstd.Encoder)
+	zstdEncodersMutex sync.Mutex
+	zstdDecoders      = make(map[uint32]*zstd.Decoder)
+	zstdDecodersMutex sync.Mutex
+)
+
 // ZstdComp is a compressor which uses the zstandard
+// Zero level uses the default compression level. If DictID is set, the data is
+// compressed by the registered dictionary (see RegisterZstdDict).
+// The encoders and the decoders are shared, so it is safe for the concurrent use.
 type ZstdComp struct {
+	Level  int
+	DictID uint32
+}
+
+// newZstdEncoder makes the encoder of the level and the dictionary
+func newZstdEncoder(level int, dict []byte) (*zstd.Encoder, error) {
+	options := []zstd.EOption{}
+	if level > 0 {
+		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	if dict != nil {
+		options = append(options, zstd.WithEncoderDict(dict))
+	}
+	return zstd.NewWriter(nil, options...)
+}
+
+// getZstdEncoder returns the shared encoder of the level and the dictionary
+// The encoder keeps its own pool of the encoding states for the concurrent EncodeAll.
+func getZstdEncoder(level int, dictID uint32) (*zstd.Encoder, error) {
+	var dict []byte
+	var err error
+	key := zstdEncoderKey{level: level, dictID: dictID}
+	zstdEncodersMutex.Lock()
+	defer zstdEncodersMutex.Unlock()
+	if encoder, ok := zstdEncoders[key]; ok {
+		return encoder, nil
+	}
+	if dictID != 0 {
+		if dict, err = ZstdDict(dictID); err != nil {
+			return nil, err
+		}
+	}
+	encoder, err := newZstdEncoder(level, dict)
+	if err != nil {
+		return nil, err
+	}
+	zstdEncoders[key] = encoder
+	return encoder, nil
+}
+
+// getZstdDecoder returns the shared decoder of the dictionary
+func getZstdDecoder(dictID uint32) (*zstd.Decoder, error) {
+	options := []zstd.DOption{}
+	zstdDecodersMutex.Lock()
+	defer zstdDecodersMutex.Unlock()
+	if decoder, ok := zstdDecoders[dictID]; ok {
+		return decoder, nil
+	}
+	if dictID != 0 {
+		dict, err := ZstdDict(dictID)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, zstd.WithDecoderDicts(dict))
+	}
+	decoder, err := zstd.NewReader(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoders[dictID] = decoder
+	return decoder, nil
 }
 
 // Compress compresses the data based on the zstandard
 func (l *ZstdComp) Compress(data []byte) ([]byte, error) {
-	encoder, err := zstd.NewWriter(nil)
-	buffer := encoder.EncodeAll(data, make([]byte, 0, len(data)))
-	encoder.Close()
-	return buffer, err
+	encoder, err := getZstdEncoder(l.Level, l.DictID)
+	if err != nil {
+		return nil, err
+	}
+	scratch := getScratch()
+	defer putScratch(scratch)
+	*scratch = encoder.EncodeAll(data, *scratch)
+	return detach(*scratch), nil
 }
 
 // Decompress decompresses the data which was compressed by zstandard
+// The dictionary is chosen by the id in the frame header.
 func (l *ZstdComp) Decompress(data []byte) ([]byte, error) {
-	decoder, err := zstd.NewReader(nil)
-	buffer, err := decoder.DecodeAll(data, nil)
-	decoder.Close()
-	return buffer, err
+	decoder, err := getZstdDecoder(frameDictID(data))
+	if err != nil {
+		return nil, err
+	}
+	scratch := getScratch()
+	defer putScratch(scratch)
+	*scratch, err = decoder.DecodeAll(data, *scratch)
+	if err != nil {
+		return nil, err
+	}
+	return detach(*scratch), nil
 }
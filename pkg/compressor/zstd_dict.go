@@ -0,0 +1,294 @@
+package compressor
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/huff0"
+)
+
+const (
+	// MinZstdDictSize is the minimum content size of the trained dictionary
+	MinZstdDictSize = 256
+	// dictDmerSize is the length of the substring which is counted over the samples
+	dictDmerSize = 8
+	// dictSegmentSize is the maximum length of the content segment which is picked at once
+	dictSegmentSize = 256
+	// dictLiteralSize is the maximum bytes of the samples used to build the literal table
+	dictLiteralSize = huff0.BlockSizeMax - 256
+)
+
+var (
+	zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec}
+	// predefined distributions of the zstd format, which are stored as the dictionary's tables
+	offsetNorm      = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+	matchLengthNorm = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1}
+	literalLengthNorm = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2,
+		1, 1, 1, 1, 1, -1, -1, -1, -1}
+)
+
+var (
+	zstdDicts      = make(map[uint32][]byte)
+	zstdDictsMutex sync.RWMutex
+)
+
+// segment is the candidate of the dictionary content
+type segment struct {
+	data  []byte
+	score int
+}
+
+// segmentHeap is the max heap of the segments by the score
+type segmentHeap []*segment
+
+func (h segmentHeap) Len() int            { return len(h) }
+func (h segmentHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x interface{}) { *h = append(*h, x.(*segment)) }
+func (h *segmentHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// TrainZstdDict builds the zstd dictionary which has the content of the size from the samples
+// The content consists of the segments which cover the most common substrings of the samples
+// (e.g. the log lines), and the most common one is placed at the end of the content.
+// The id identifies the dictionary in the zstd frames, so it must be changed for the new version.
+func TrainZstdDict(samples [][]byte, size int, id uint32) ([]byte, error) {
+	if id == 0 {
+		return nil, errors.New("zstd dictionary id must be over 0")
+	}
+	if size < MinZstdDictSize {
+		return nil, fmt.Errorf("zstd dictionary size must be over %d bytes", MinZstdDictSize)
+	}
+	content := selectDictContent(samples, size)
+	if len(content) < dictDmerSize {
+		return nil, errors.New("samples don't have the common content")
+	}
+	literals, err := buildLiteralTable(samples)
+	if err != nil {
+		return nil, err
+	}
+	dict := append([]byte{}, zstdDictMagic...)
+	dict = append(dict, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(dict[4:], id)
+	dict = append(dict, literals...)
+	dict = append(dict, writeNCount(offsetNorm, 5)...)
+	dict = append(dict, writeNCount(matchLengthNorm, 6)...)
+	dict = append(dict, writeNCount(literalLengthNorm, 6)...)
+	for _, offset := range []uint32{1, 4, 8} {
+		dict = append(dict, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(dict[len(dict)-4:], offset)
+	}
+	return append(dict, content...), nil
+}
+
+// countDmers counts the samples which contain each dmer
+func countDmers(samples [][]byte) map[uint64]int {
+	counts := make(map[uint64]int)
+	seen := make(map[uint64]bool)
+	for _, sample := range samples {
+		for dmer := range seen {
+			delete(seen, dmer)
+		}
+		for i := 0; i+dictDmerSize <= len(sample); i++ {
+			dmer := binary.LittleEndian.Uint64(sample[i:])
+			if !seen[dmer] {
+				seen[dmer] = true
+				counts[dmer]++
+			}
+		}
+	}
+	return counts
+}
+
+// scoreSegment sums the counts of the distinct dmers in the segment which are shared by the samples
+func scoreSegment(data []byte, counts map[uint64]int, seen map[uint64]bool) int {
+	for dmer := range seen {
+		delete(seen, dmer)
+	}
+	score := 0
+	for i := 0; i+dictDmerSize <= len(data); i++ {
+		dmer := binary.LittleEndian.Uint64(data[i:])
+		if !seen[dmer] && counts[dmer] > 1 {
+			score += counts[dmer]
+		}
+		seen[dmer] = true
+	}
+	return score
+}
+
+// selectDictContent picks the segments greedily until the content has the size
+// The score of the segment only decreases as the other segments are picked, so the
+// stale score of the heap is an upper bound and the top is rescored lazily.
+func selectDictContent(samples [][]byte, size int) []byte {
+	counts := countDmers(samples)
+	seen := make(map[uint64]bool)
+	candidates := &segmentHeap{}
+	for _, sample := range samples {
+		for start := 0; start+dictDmerSize <= len(sample); start += dictSegmentSize / 2 {
+			end := start + dictSegmentSize
+			if end > len(sample) {
+				end = len(sample)
+			}
+			data := sample[start:end]
+			heap.Push(candidates, &segment{data: data, score: scoreSegment(data, counts, seen)})
+		}
+	}
+	picked := [][]byte{}
+	total := 0
+	for candidates.Len() > 0 && total < size {
+		top := heap.Pop(candidates).(*segment)
+		top.score = scoreSegment(top.data, counts, seen)
+		if top.score == 0 {
+			continue
+		}
+		if candidates.Len() > 0 && top.score < (*candidates)[0].score {
+			heap.Push(candidates, top)
+			continue
+		}
+		for i := 0; i+dictDmerSize <= len(top.data); i++ {
+			delete(counts, binary.LittleEndian.Uint64(top.data[i:]))
+		}
+		picked = append(picked, top.data)
+		total += len(top.data)
+	}
+	content := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		content = append(content, picked[i]...)
+	}
+	if len(content) > size {
+		content = content[len(content)-size:]
+	}
+	return content
+}
+
+// buildLiteralTable builds the huffman table of the literals from the samples
+// Every byte value is added once, so the table can encode any literal.
+func buildLiteralTable(samples [][]byte) ([]byte, error) {
+	literals := make([]byte, 0, dictLiteralSize+256)
+	for _, sample := range samples {
+		if len(literals)+len(sample) > dictLiteralSize {
+			literals = append(literals, sample[:dictLiteralSize-len(literals)]...)
+			break
+		}
+		literals = append(literals, sample...)
+	}
+	for i := 0; i < 256; i++ {
+		literals = append(literals, byte(i))
+	}
+	scratch := &huff0.Scratch{}
+	if _, _, err := huff0.Compress1X(literals, scratch); err != nil {
+		return nil, fmt.Errorf("literal table of the samples can't be built: %v", err)
+	}
+	return append([]byte{}, scratch.OutTable...), nil
+}
+
+// writeNCount writes the normalized counts in the FSE table description format
+func writeNCount(norm []int16, tableLog uint) []byte {
+	out := []byte{}
+	bitStream := uint32(tableLog - 5)
+	bitCount := uint(4)
+	remaining := 1<<tableLog + 1
+	threshold := 1 << tableLog
+	nbBits := tableLog + 1
+	for symbol := 0; symbol < len(norm) && remaining > 1; symbol++ {
+		count := int(norm[symbol])
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		bitStream += uint32(count) << bitCount
+		bitCount += nbBits
+		if count < max {
+			bitCount--
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+		if bitCount > 16 {
+			out = append(out, byte(bitStream), byte(bitStream>>8))
+			bitStream >>= 16
+			bitCount -= 16
+		}
+	}
+	out = append(out, byte(bitStream), byte(bitStream>>8))
+	return out[:len(out)-2+int(bitCount+7)/8]
+}
+
+// ZstdDictID returns the id of the zstd dictionary
+func ZstdDictID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || !bytes.HasPrefix(dict, zstdDictMagic) {
+		return 0, errors.New("invalid zstd dictionary")
+	}
+	return binary.LittleEndian.Uint32(dict[4:8]), nil
+}
+
+// RegisterZstdDict registers the dictionary and returns its id
+// The frames compressed by the dictionary are decompressed by any ZstdComp
+// after it is registered. The other dictionary which has the same id is rejected.
+func RegisterZstdDict(dict []byte) (uint32, error) {
+	id, err := ZstdDictID(dict)
+	if err != nil {
+		return 0, err
+	}
+	zstdDictsMutex.Lock()
+	defer zstdDictsMutex.Unlock()
+	if registered, ok := zstdDicts[id]; ok {
+		if !bytes.Equal(registered, dict) {
+			return 0, fmt.Errorf("another zstd dictionary has the id %d", id)
+		}
+		return id, nil
+	}
+	if _, err = newZstdEncoder(0, dict); err != nil {
+		return 0, err
+	}
+	zstdDicts[id] = append([]byte{}, dict...)
+	return id, nil
+}
+
+// ZstdDict returns the registered dictionary of the id
+func ZstdDict(id uint32) ([]byte, error) {
+	zstdDictsMutex.RLock()
+	defer zstdDictsMutex.RUnlock()
+	dict, ok := zstdDicts[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown zstd dictionary id %d", id)
+	}
+	return dict, nil
+}
+
+// frameDictID returns the dictionary id in the zstd frame header (0 if it has no dictionary)
+func frameDictID(frame []byte) uint32 {
+	if len(frame) < 5 || !bytes.HasPrefix(frame, zstdMagic) {
+		return 0
+	}
+	descriptor := frame[4]
+	offset := 5
+	if descriptor&0x20 == 0 {
+		offset++
+	}
+	size := []int{0, 1, 2, 4}[descriptor&3]
+	if len(frame) < offset+size {
+		return 0
+	}
+	id := uint32(0)
+	for i := 0; i < size; i++ {
+		id |= uint32(frame[offset+i]) << (8 * i)
+	}
+	return id
+}
@@ -0,0 +1,104 @@
+package delivery
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MetaSession is the rpcx metadata key of the generator's session which scopes the sequences
+	MetaSession = "session"
+	// MetaSequence is the rpcx metadata key of the packet sequence number in the session
+	MetaSequence = "sequence"
+	// MetaLines is the rpcx metadata key of the line sequence numbers of the packet (see EncodeLines)
+	MetaLines = "lines"
+	// MetaAck is the rpcx response metadata key of the acknowledged packet sequence number
+	MetaAck = "ack"
+)
+
+// Window records the received sequence numbers to detect the duplicates
+// The sequences start from 1. The sequences up to the contiguous mark are forgotten,
+// so the memory is bounded by the packets received out of order.
+type Window struct {
+	contiguous uint64
+	received   map[uint64]bool
+}
+
+// Add records the sequence and returns false if it was already received
+func (w *Window) Add(seq uint64) bool {
+	if w.Contains(seq) {
+		return false
+	}
+	if w.received == nil {
+		w.received = make(map[uint64]bool)
+	}
+	w.received[seq] = true
+	for w.received[w.contiguous+1] {
+		delete(w.received, w.contiguous+1)
+		w.contiguous++
+	}
+	return true
+}
+
+// Contains checks the sequence was already received
+func (w *Window) Contains(seq uint64) bool {
+	return seq <= w.contiguous || w.received[seq]
+}
+
+// Contiguous returns the highest sequence which has no missing sequence below it
+func (w *Window) Contiguous() uint64 {
+	return w.contiguous
+}
+
+// EncodeLines encodes the file index and the line sequence of each line
+// The consecutive lines of the same file are encoded as a run "index:first:count",
+// and the runs are separated by the comma.
+func EncodeLines(indexes []uint8, lines []uint64) string {
+	runs := []string{}
+	for i := 0; i < len(indexes) && i < len(lines); {
+		j := i + 1
+		for j < len(indexes) && j < len(lines) && indexes[j] == indexes[i] && lines[j] == lines[j-1]+1 {
+			j++
+		}
+		runs = append(runs, fmt.Sprintf("%d:%d:%d", indexes[i], lines[i], j-i))
+		i = j
+	}
+	return strings.Join(runs, ",")
+}
+
+// DecodeLines decodes the file indexes and the line sequences encoded by EncodeLines
+// The runs can't have more lines than the packet (limit), so the forged count is rejected
+// before the lines are allocated.
+func DecodeLines(encoded string, limit int) ([]uint8, []uint64, error) {
+	indexes, lines := []uint8{}, []uint64{}
+	if len(encoded) == 0 {
+		return indexes, lines, nil
+	}
+	for _, run := range strings.Split(encoded, ",") {
+		fields := strings.Split(run, ":")
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("invalid line sequence run %q", run)
+		}
+		index, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil, nil, err
+		}
+		first, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, nil, err
+		}
+		if count > uint64(limit-len(lines)) {
+			return nil, nil, fmt.Errorf("line sequence run %q exceeds %d lines of the packet", run, limit)
+		}
+		for k := uint64(0); k < count; k++ {
+			indexes = append(indexes, uint8(index))
+			lines = append(lines, first+k)
+		}
+	}
+	return indexes, lines, nil
+}
@@ -0,0 +1,52 @@
+package delivery_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/soyoslab/soy_log_generator/pkg/delivery"
+)
+
+func TestWindow(t *testing.T) {
+	w := delivery.Window{}
+	for _, seq := range []uint64{1, 2, 4, 5} {
+		if !w.Add(seq) {
+			t.Errorf("new sequence %d is duplicated", seq)
+		}
+	}
+	if w.Contiguous() != 2 {
+		t.Errorf("invalid contiguous mark (expected: 2, result: %d)", w.Contiguous())
+	}
+	for _, seq := range []uint64{1, 2, 4} {
+		if w.Add(seq) {
+			t.Errorf("duplicated sequence %d is accepted", seq)
+		}
+	}
+	if !w.Add(3) || w.Contiguous() != 5 {
+		t.Errorf("missing sequence doesn't fill the gap (contiguous: %d)", w.Contiguous())
+	}
+	if w.Add(5) || !w.Contains(5) || w.Contains(6) {
+		t.Errorf("forgotten sequence is accepted")
+	}
+}
+
+func TestLines(t *testing.T) {
+	indexes := []uint8{0, 0, 0, 1, 1, 0, 2}
+	lines := []uint64{10, 11, 12, 3, 4, 14, 1}
+	encoded := delivery.EncodeLines(indexes, lines)
+	if encoded != "0:10:3,1:3:2,0:14:1,2:1:1" {
+		t.Errorf("invalid encoding %q", encoded)
+	}
+	decodedIndexes, decodedLines, err := delivery.DecodeLines(encoded, len(indexes))
+	if err != nil || !reflect.DeepEqual(decodedIndexes, indexes) || !reflect.DeepEqual(decodedLines, lines) {
+		t.Errorf("invalid decoding %v %v %v", decodedIndexes, decodedLines, err)
+	}
+	if indexes, lines, err := delivery.DecodeLines("", 0); err != nil || len(indexes) != 0 || len(lines) != 0 {
+		t.Errorf("empty encoding isn't decoded %v", err)
+	}
+	for _, invalid := range []string{"0:1", "256:1:1", "a:1:1", "0:b:1", "0:1:c", "0:1:2", "0:1:1,1:1:4294967295"} {
+		if _, _, err := delivery.DecodeLines(invalid, 1); err == nil {
+			t.Errorf("invalid encoding %q is decoded", invalid)
+		}
+	}
+}
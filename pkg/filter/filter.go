@@ -0,0 +1,146 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cloudflare/ahocorasick"
+)
+
+const (
+	// TypeKeyword matches the literal keyword (default)
+	TypeKeyword = "keyword"
+	// TypeRegex matches the regular expression
+	TypeRegex = "regex"
+)
+
+// Rule contains the condition of the hot line
+// The keyword rule is case-insensitive substring matching unless WholeWord or CaseSensitive is set.
+// The line which matches an Exclude rule is never hot.
+type Rule struct {
+	Name          string
+	Type          string
+	Pattern       string
+	WholeWord     bool
+	CaseSensitive bool
+	Exclude       bool
+	regexp        *regexp.Regexp
+}
+
+// NewRule validates the rule and compiles its pattern
+// Empty name is replaced by the pattern.
+func NewRule(name string, ruleType string, pattern string, wholeWord bool, caseSensitive bool, exclude bool) (Rule, error) {
+	var err error
+	rule := Rule{Name: name, Type: ruleType, Pattern: pattern, WholeWord: wholeWord, CaseSensitive: caseSensitive, Exclude: exclude}
+	if len(pattern) == 0 {
+		return rule, errors.New("filter rule must have the pattern")
+	}
+	if len(rule.Name) == 0 {
+		rule.Name = pattern
+	}
+	switch rule.Type {
+	case "", TypeKeyword:
+		rule.Type = TypeKeyword
+		if rule.WholeWord || rule.CaseSensitive {
+			rule.regexp, err = regexp.Compile(keywordExpression(rule))
+		}
+	case TypeRegex:
+		rule.regexp, err = regexp.Compile(pattern)
+	default:
+		err = fmt.Errorf("invalid filter rule type %q", ruleType)
+	}
+	return rule, err
+}
+
+// keywordExpression makes the regular expression which verifies the keyword candidate
+func keywordExpression(rule Rule) string {
+	expression := regexp.QuoteMeta(rule.Pattern)
+	if rule.WholeWord {
+		expression = `(^|\W)` + expression + `(\W|$)`
+	}
+	if !rule.CaseSensitive {
+		expression = "(?i)" + expression
+	}
+	return expression
+}
+
+// Matcher evaluates the rules of a file
+// Every keyword is searched at once by the aho-corasick algorithm with the lower-cased line,
+// and only the candidates which need the whole-word or case check are verified by the regular expression.
+type Matcher struct {
+	keywords     *ahocorasick.Matcher
+	keywordRules [][]Rule
+	includes     []Rule
+	excludes     []Rule
+}
+
+// NewMatcher makes a Matcher structure from the rules
+func NewMatcher(rules []Rule) *Matcher {
+	m := new(Matcher)
+	dictionary := []string{}
+	indexes := make(map[string]int)
+	for _, rule := range rules {
+		if rule.Type == TypeRegex && rule.Exclude {
+			m.excludes = append(m.excludes, rule)
+			continue
+		} else if rule.Type == TypeRegex {
+			m.includes = append(m.includes, rule)
+			continue
+		}
+		keyword := strings.ToLower(rule.Pattern)
+		idx, ok := indexes[keyword]
+		if !ok {
+			idx = len(dictionary)
+			indexes[keyword] = idx
+			dictionary = append(dictionary, keyword)
+			m.keywordRules = append(m.keywordRules, nil)
+		}
+		m.keywordRules[idx] = append(m.keywordRules[idx], rule)
+	}
+	m.keywords = ahocorasick.NewStringMatcher(dictionary)
+	return m
+}
+
+// matchRule checks the rule matches the line
+// The keyword rule is already found by the aho-corasick algorithm.
+func matchRule(rule Rule, str string) bool {
+	return rule.regexp == nil || rule.regexp.MatchString(str)
+}
+
+// Match checks the line is hot and returns the name of the first matched rule
+// It is safe to call concurrently.
+func (m *Matcher) Match(str string) (string, bool) {
+	name, matched := "", false
+	excluded := false
+	for _, idx := range m.keywords.MatchThreadSafe([]byte(strings.ToLower(str))) {
+		for _, rule := range m.keywordRules[idx] {
+			if !matchRule(rule, str) {
+				continue
+			}
+			if rule.Exclude {
+				excluded = true
+			} else if !matched {
+				name, matched = rule.Name, true
+			}
+		}
+	}
+	if excluded {
+		return "", false
+	}
+	for i := 0; !matched && i < len(m.includes); i++ {
+		if matchRule(m.includes[i], str) {
+			name, matched = m.includes[i].Name, true
+		}
+	}
+	if !matched {
+		return "", false
+	}
+	for _, rule := range m.excludes {
+		if matchRule(rule, str) {
+			return "", false
+		}
+	}
+	return name, true
+}
@@ -0,0 +1,96 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/soyoslab/soy_log_generator/pkg/filter"
+)
+
+func newRule(t *testing.T, name string, ruleType string, pattern string, wholeWord bool, caseSensitive bool, exclude bool) filter.Rule {
+	rule, err := filter.NewRule(name, ruleType, pattern, wholeWord, caseSensitive, exclude)
+	if err != nil {
+		t.Fatalf("rule creation failed %v", err)
+	}
+	return rule
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := filter.NewRule("", "", "", false, false, false); err == nil {
+		t.Errorf("empty pattern is accepted")
+	}
+	if _, err := filter.NewRule("", filter.TypeRegex, "(", false, false, false); err == nil {
+		t.Errorf("invalid regular expression is accepted")
+	}
+	if _, err := filter.NewRule("", "glob", "*", false, false, false); err == nil {
+		t.Errorf("invalid type is accepted")
+	}
+}
+
+func TestKeyword(t *testing.T) {
+	m := filter.NewMatcher([]filter.Rule{
+		newRule(t, "", "", "error", false, false, false),
+		newRule(t, "word", "", "fail", true, false, false),
+		newRule(t, "case", "", "WARN", false, true, false),
+	})
+	cases := map[string]string{
+		"Terror":         "error",
+		"ERROR occurred": "error",
+		"task fail.":     "word",
+		"[fail]":         "word",
+		"failed":         "",
+		"WARNING":        "case",
+		"warning":        "",
+	}
+	for line, expected := range cases {
+		name, ok := m.Match(line)
+		if name != expected || ok != (len(expected) != 0) {
+			t.Errorf("invalid match of %q (expected: %q, result: %q %v)", line, expected, name, ok)
+		}
+	}
+}
+
+func TestDuplicatedKeyword(t *testing.T) {
+	m := filter.NewMatcher([]filter.Rule{
+		newRule(t, "word", "", "error", true, false, false),
+		newRule(t, "substring", "", "ERROR", false, false, false),
+	})
+	if name, _ := m.Match("errors"); name != "substring" {
+		t.Errorf("duplicated keyword is ignored %q", name)
+	}
+}
+
+func TestRegexAndExclude(t *testing.T) {
+	m := filter.NewMatcher([]filter.Rule{
+		newRule(t, "5xx", filter.TypeRegex, `HTTP/1\.1" 5\d\d`, false, false, false),
+		newRule(t, "", "", "error", true, false, false),
+		newRule(t, "debug", "", "level=debug", false, false, true),
+		newRule(t, "health", filter.TypeRegex, `GET /healthz`, false, false, true),
+	})
+	cases := map[string]string{
+		`"GET / HTTP/1.1" 503 0`:        "5xx",
+		`"GET / HTTP/1.1" 404 0`:        "",
+		`"GET /healthz HTTP/1.1" 500 0`: "",
+		"level=error msg=failed":        "error",
+		"level=debug msg=error":         "",
+	}
+	for line, expected := range cases {
+		name, ok := m.Match(line)
+		if name != expected || ok != (len(expected) != 0) {
+			t.Errorf("invalid match of %q (expected: %q, result: %q %v)", line, expected, name, ok)
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	rules := []filter.Rule{}
+	for _, keyword := range []string{"error", "critical", "warn", "failed", "panic"} {
+		rule, _ := filter.NewRule("", "", keyword, false, false, false)
+		rules = append(rules, rule)
+	}
+	exclude, _ := filter.NewRule("", "", "level=debug", false, false, true)
+	m := filter.NewMatcher(append(rules, exclude))
+	line := "2021-07-01T00:00:00Z level=info msg=\"request is handled\" path=/api/v1/users status=200"
+	for i := 0; i < b.N; i++ {
+		m.Match(line)
+	}
+}
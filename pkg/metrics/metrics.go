@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// DefaultRegistry is the registry which contains the metrics of the whole pipeline
+var DefaultRegistry = NewRegistry()
+
+// DefaultLatencyBuckets are the histogram buckets of the latency in seconds
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// series contains the value of the metric with the label values
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// metric contains the series of the metric which have the same name
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+	mutex   sync.Mutex
+}
+
+// Registry contains the metrics and writes them in the Prometheus text format
+type Registry struct {
+	metrics []*metric
+	names   map[string]*metric
+	mutex   sync.Mutex
+}
+
+// NewRegistry makes a new Registry structure
+func NewRegistry() *Registry {
+	r := new(Registry)
+	r.names = make(map[string]*metric)
+	return r
+}
+
+// register adds the metric or returns the registered metric which has the same name
+// It panics when the registered metric has the different type or labels.
+func (r *Registry) register(m *metric) *metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if registered, ok := r.names[m.name]; ok {
+		if registered.kind != m.kind || strings.Join(registered.labels, ",") != strings.Join(m.labels, ",") {
+			panic(fmt.Sprintf("metric %s is registered with the different type or labels", m.name))
+		}
+		return registered
+	}
+	m.series = make(map[string]*series)
+	r.metrics = append(r.metrics, m)
+	r.names[m.name] = m
+	return m
+}
+
+// Counter is the metric which only increases
+type Counter struct {
+	m *metric
+}
+
+// Gauge is the metric which can go up and down
+type Gauge struct {
+	m *metric
+}
+
+// Histogram is the metric which counts the observations in the buckets
+type Histogram struct {
+	m *metric
+}
+
+// NewCounter registers the counter
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{r.register(&metric{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+// NewGauge registers the gauge
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&metric{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+// NewHistogram registers the histogram with the upper bounds of the buckets
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{r.register(&metric{name: name, help: help, kind: kindHistogram, labels: labels, buckets: sorted})}
+}
+
+// getSeries returns the series of the label values (m.mutex must be held)
+func (m *metric) getSeries(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values (given: %d)", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		s.counts = make([]uint64, len(m.buckets))
+		m.series[key] = s
+	}
+	return s
+}
+
+// deleteSeries removes the series of the label values
+func (m *metric) deleteSeries(labelValues []string) {
+	m.mutex.Lock()
+	delete(m.series, strings.Join(labelValues, "\xff"))
+	m.mutex.Unlock()
+}
+
+// Add increases the counter (negative value is ignored)
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	c.m.mutex.Lock()
+	c.m.getSeries(labelValues).value += value
+	c.m.mutex.Unlock()
+}
+
+// Inc increases the counter by 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Delete removes the series of the label values
+func (c *Counter) Delete(labelValues ...string) {
+	c.m.deleteSeries(labelValues)
+}
+
+// Set sets the gauge
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.m.mutex.Lock()
+	g.m.getSeries(labelValues).value = value
+	g.m.mutex.Unlock()
+}
+
+// SetMax sets the gauge if the value is greater than the current value
+func (g *Gauge) SetMax(value float64, labelValues ...string) {
+	g.m.mutex.Lock()
+	s := g.m.getSeries(labelValues)
+	s.value = math.Max(s.value, value)
+	g.m.mutex.Unlock()
+}
+
+// Delete removes the series of the label values
+func (g *Gauge) Delete(labelValues ...string) {
+	g.m.deleteSeries(labelValues)
+}
+
+// Observe adds the observation to the histogram
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.m.mutex.Lock()
+	s := h.m.getSeries(labelValues)
+	for i, bound := range h.m.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+	h.m.mutex.Unlock()
+}
+
+// escapeLabelValue escapes the backslash, the double quote and the line feed
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatLabels makes the label set string (e.g. {file="a.log",le="1"})
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats the value in the Prometheus manner
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// write writes the metric in the Prometheus text format
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.value))
+			continue
+		}
+		names := append(append([]string{}, m.labels...), "le")
+		for i, bound := range m.buckets {
+			values := append(append([]string{}, s.labelValues...), formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.counts[i])
+		}
+		values := append(append([]string{}, s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues), s.count)
+	}
+}
+
+// Write writes every metric in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.mutex.Unlock()
+	writer := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(writer)
+	}
+	return writer.Flush()
+}
+
+// ServeHTTP responds the metrics to the Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// Serve starts the HTTP listener which exposes the registry on /metrics
+// The listener is bound before this returns, so the address error is reported immediately.
+func Serve(addr string, r *Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
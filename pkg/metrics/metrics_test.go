@@ -0,0 +1,98 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	r := metrics.NewRegistry()
+	counter := r.NewCounter("test_lines_total", "Number of lines.", "file")
+	gauge := r.NewGauge("test_occupancy", "Occupancy.")
+	counter.Inc("a.log")
+	counter.Add(2, "a.log")
+	counter.Add(-1, "a.log")
+	counter.Inc("b\"\n.log")
+	gauge.Set(3)
+	gauge.SetMax(1)
+
+	buffer := &bytes.Buffer{}
+	r.Write(buffer)
+	expected := `# HELP test_lines_total Number of lines.
+# TYPE test_lines_total counter
+test_lines_total{file="a.log"} 3
+test_lines_total{file="b\"\n.log"} 1
+# HELP test_occupancy Occupancy.
+# TYPE test_occupancy gauge
+test_occupancy 3
+`
+	if buffer.String() != expected {
+		t.Errorf("invalid text format\n%s", buffer.String())
+	}
+
+	counter.Delete("a.log")
+	buffer.Reset()
+	r.Write(buffer)
+	if strings.Contains(buffer.String(), "a.log") {
+		t.Errorf("deleted series remains\n%s", buffer.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := metrics.NewRegistry()
+	histogram := r.NewHistogram("test_latency_seconds", "Latency.", []float64{1, 0.1}, "port")
+	histogram.Observe(0.05, "hot")
+	histogram.Observe(0.5, "hot")
+	histogram.Observe(5, "hot")
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{port="hot",le="0.1"} 1
+test_latency_seconds_bucket{port="hot",le="1"} 2
+test_latency_seconds_bucket{port="hot",le="+Inf"} 3
+test_latency_seconds_sum{port="hot"} 5.55
+test_latency_seconds_count{port="hot"} 3
+`
+	if recorder.Body.String() != expected {
+		t.Errorf("invalid histogram format\n%s", recorder.Body.String())
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("invalid content type %s", recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := metrics.NewRegistry()
+	first := r.NewCounter("test_total", "Test.", "file")
+	second := r.NewCounter("test_total", "Test.", "file")
+	first.Inc("a")
+	second.Inc("a")
+	buffer := &bytes.Buffer{}
+	r.Write(buffer)
+	if !strings.Contains(buffer.String(), `test_total{file="a"} 2`) {
+		t.Errorf("same metric isn't shared\n%s", buffer.String())
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("metric with the different type is registered")
+		}
+	}()
+	r.NewGauge("test_total", "Test.", "file")
+}
+
+func TestServe(t *testing.T) {
+	if _, err := metrics.Serve("invalid-address", metrics.NewRegistry()); err == nil {
+		t.Errorf("invalid address is accepted")
+	}
+	server, err := metrics.Serve("localhost:0", metrics.NewRegistry())
+	if err != nil {
+		t.Fatalf("serve failed %v", err)
+	}
+	server.Close()
+}
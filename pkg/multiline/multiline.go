@@ -0,0 +1,183 @@
+package multiline
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxLines is used when the rule doesn't specify the maximum lines
+	DefaultMaxLines = 500
+	// DefaultFlushTimeout is used when the rule doesn't specify the flush timeout
+	DefaultFlushTimeout = time.Duration(1000) * time.Millisecond
+)
+
+// FlushFunc is the function pointer which receives the aggregated event
+type FlushFunc func(event string, args interface{}) error
+
+// Rule contains the conditions to join the lines to a single event
+type Rule struct {
+	Start        *regexp.Regexp
+	Continuation *regexp.Regexp
+	Indentation  bool
+	MaxLines     uint64
+	FlushTimeout time.Duration
+}
+
+// NewRule compiles the patterns and makes a Rule structure
+// Empty pattern means the condition is not used.
+func NewRule(start string, continuation string, indentation bool, maxLines uint64, flushTimeout time.Duration) (Rule, error) {
+	var err error
+	rule := Rule{Indentation: indentation, MaxLines: maxLines, FlushTimeout: flushTimeout}
+	if len(start) != 0 {
+		if rule.Start, err = regexp.Compile(start); err != nil {
+			return rule, err
+		}
+	}
+	if len(continuation) != 0 {
+		if rule.Continuation, err = regexp.Compile(continuation); err != nil {
+			return rule, err
+		}
+	}
+	if rule.Start == nil && rule.Continuation == nil && !rule.Indentation {
+		return rule, errors.New("multiline rule must have at least one condition")
+	}
+	if rule.MaxLines == 0 {
+		rule.MaxLines = DefaultMaxLines
+	}
+	if rule.FlushTimeout == 0 {
+		rule.FlushTimeout = DefaultFlushTimeout
+	}
+	return rule, nil
+}
+
+// IsContinuation checks the line belongs to the previous event
+func (r Rule) IsContinuation(line string) bool {
+	if r.Start != nil && r.Start.MatchString(line) {
+		return false
+	}
+	if r.Continuation != nil && r.Continuation.MatchString(line) {
+		return true
+	}
+	if r.Indentation && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+		return true
+	}
+	return r.Start != nil
+}
+
+// Aggregator joins the lines of a file based on the rule
+type Aggregator struct {
+	rule    Rule
+	flush   FlushFunc
+	lines   []string
+	first   interface{}
+	args    interface{}
+	timer   *time.Timer
+	mutex   sync.Mutex
+	lastErr error
+}
+
+// NewAggregator makes a new Aggregator which passes the events to the flush function
+func NewAggregator(rule Rule, flush FlushFunc) (*Aggregator, error) {
+	if flush == nil {
+		return nil, errors.New("aggregator's flush function must be specified")
+	}
+	a := new(Aggregator)
+	a.rule = rule
+	a.flush = flush
+	return a, nil
+}
+
+// Push appends the line to the pending event
+// This has the same signature with the buffering's line processing function.
+// The event is flushed with the args of its last line, which has the end position of the event.
+func (a *Aggregator) Push(line string, args interface{}) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var err error
+	if len(a.lines) > 0 && !a.rule.IsContinuation(line) {
+		err = a.flushLocked()
+	}
+	if len(a.lines) == 0 {
+		a.first = args
+	}
+	a.args = args
+	a.lines = append(a.lines, line)
+	if uint64(len(a.lines)) >= a.rule.MaxLines {
+		if flushErr := a.flushLocked(); err == nil {
+			err = flushErr
+		}
+	} else {
+		a.resetTimer()
+	}
+	if err == nil {
+		err = a.lastErr
+		a.lastErr = nil
+	}
+	return err
+}
+
+// resetTimer restarts the flush timer of the pending event
+func (a *Aggregator) resetTimer() {
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.rule.FlushTimeout, a.expire)
+		return
+	}
+	a.timer.Stop()
+	a.timer.Reset(a.rule.FlushTimeout)
+}
+
+// expire flushes the pending event when there is no more line until the timeout
+// The error is reported on the next Push.
+func (a *Aggregator) expire() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err := a.flushLocked(); err != nil {
+		a.lastErr = err
+	}
+}
+
+// flushLocked passes the pending event to the flush function
+func (a *Aggregator) flushLocked() error {
+	if len(a.lines) == 0 {
+		return nil
+	}
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	event := strings.Join(a.lines, "")
+	args := a.args
+	a.lines = nil
+	a.first = nil
+	a.args = nil
+	return a.flush(event, args)
+}
+
+// Pending returns the args of the first line of the pending event
+// The line and the following ones are not flushed yet.
+func (a *Aggregator) Pending() (interface{}, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.first, len(a.lines) > 0
+}
+
+// Flush passes the pending event to the flush function immediately
+func (a *Aggregator) Flush() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.flushLocked()
+}
+
+// Close flushes the pending event and stops the timer
+func (a *Aggregator) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	err := a.flushLocked()
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	return err
+}
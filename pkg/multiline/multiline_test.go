@@ -0,0 +1,146 @@
+package multiline_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/multiline"
+)
+
+type collector struct {
+	events []string
+	mutex  sync.Mutex
+}
+
+func (c *collector) flush(event string, _ interface{}) error {
+	c.mutex.Lock()
+	c.events = append(c.events, event)
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *collector) get() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string{}, c.events...)
+}
+
+func pushLines(t *testing.T, a *multiline.Aggregator, lines []string) {
+	for _, line := range lines {
+		if err := a.Push(line, nil); err != nil {
+			t.Errorf("push failed %v", err)
+		}
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := multiline.NewRule("", "", false, 0, 0); err == nil {
+		t.Errorf("rule without condition is accepted")
+	}
+	if _, err := multiline.NewRule("(", "", false, 0, 0); err == nil {
+		t.Errorf("invalid start pattern is accepted")
+	}
+	if _, err := multiline.NewRule("", "(", false, 0, 0); err == nil {
+		t.Errorf("invalid continuation pattern is accepted")
+	}
+	rule, _ := multiline.NewRule("", "", true, 0, 0)
+	if _, err := multiline.NewAggregator(rule, nil); err == nil {
+		t.Errorf("nil flush function is accepted")
+	}
+}
+
+func TestStartPattern(t *testing.T) {
+	c := &collector{}
+	rule, _ := multiline.NewRule(`^\d{4}-`, "", false, 0, time.Hour)
+	a, _ := multiline.NewAggregator(rule, c.flush)
+	pushLines(t, a, []string{
+		"2021-07-01 panic: runtime error\n",
+		"goroutine 1 [running]:\n",
+		"main.main()\n",
+		"2021-07-01 next event\n",
+	})
+	a.Close()
+	events := c.get()
+	if len(events) != 2 {
+		t.Fatalf("invalid number of events %v", events)
+	}
+	if events[0] != "2021-07-01 panic: runtime error\ngoroutine 1 [running]:\nmain.main()\n" {
+		t.Errorf("stack trace isn't joined %q", events[0])
+	}
+}
+
+func TestIndentationAndContinuation(t *testing.T) {
+	c := &collector{}
+	rule, _ := multiline.NewRule("", `^Caused by:`, true, 0, time.Hour)
+	a, _ := multiline.NewAggregator(rule, c.flush)
+	pushLines(t, a, []string{
+		"Exception in thread \"main\" java.lang.Error\n",
+		"\tat Main.main(Main.java:3)\n",
+		"Caused by: java.lang.Error\n",
+		"\tat Main.run(Main.java:7)\n",
+		"normal line\n",
+	})
+	a.Flush()
+	events := c.get()
+	if len(events) != 2 || events[1] != "normal line\n" {
+		t.Errorf("invalid events %v", events)
+	}
+}
+
+func TestMaxLines(t *testing.T) {
+	c := &collector{}
+	rule, _ := multiline.NewRule("", "", true, 2, time.Hour)
+	a, _ := multiline.NewAggregator(rule, c.flush)
+	pushLines(t, a, []string{"first\n", " second\n", " third\n"})
+	if events := c.get(); len(events) != 1 || events[0] != "first\n second\n" {
+		t.Errorf("max lines doesn't flush the event %v", events)
+	}
+	a.Close()
+}
+
+func TestFlushTimeout(t *testing.T) {
+	c := &collector{}
+	rule, _ := multiline.NewRule("", "", true, 0, time.Duration(10)*time.Millisecond)
+	a, _ := multiline.NewAggregator(rule, c.flush)
+	defer a.Close()
+	pushLines(t, a, []string{"first\n", " second\n"})
+	start := time.Now()
+	for len(c.get()) == 0 && time.Since(start) < time.Second*5 {
+		time.Sleep(time.Millisecond)
+	}
+	if events := c.get(); len(events) != 1 {
+		t.Errorf("flush timeout doesn't flush the event %v", events)
+	}
+}
+
+func TestFlushError(t *testing.T) {
+	rule, _ := multiline.NewRule("", "", true, 0, time.Hour)
+	a, _ := multiline.NewAggregator(rule, func(_ string, _ interface{}) error {
+		return errors.New("sample error")
+	})
+	a.Push("first\n", nil)
+	if err := a.Push("second\n", nil); err == nil {
+		t.Errorf("flush error is ignored")
+	}
+}
+
+func TestPending(t *testing.T) {
+	c := &collector{}
+	rule, _ := multiline.NewRule(`^\d{4}-`, "", false, 0, time.Hour)
+	a, _ := multiline.NewAggregator(rule, c.flush)
+	if _, ok := a.Pending(); ok {
+		t.Errorf("empty aggregator has the pending event")
+	}
+	a.Push("2021-07-01 first\n", 1)
+	a.Push("2021-07-01 second\n", 2)
+	a.Push("\tat main\n", 3)
+	if args, ok := a.Pending(); !ok || args != 2 {
+		t.Errorf("invalid first line of the pending event %v", args)
+	}
+	a.Flush()
+	if _, ok := a.Pending(); ok {
+		t.Errorf("flushed event is pending")
+	}
+}
@@ -1,6 +1,7 @@
 package ring
 
 import (
+	"sync"
 	"time"
 
 	"github.com/Workiva/go-datastructures/queue"
@@ -11,6 +12,8 @@ type Ring struct {
 	BufferType string
 	buffer     *queue.RingBuffer
 	Kick       chan bool
+	popped     chan bool
+	mutex      sync.Mutex
 }
 
 // Init initializes the ring buffer
@@ -18,6 +21,7 @@ func (r *Ring) Init(ringCapacity uint64, bufferType string) {
 	r.buffer = queue.NewRingBuffer(ringCapacity)
 	r.BufferType = bufferType
 	r.Kick = make(chan bool, ringCapacity)
+	r.popped = make(chan bool)
 }
 
 // Offer inserts a value to the ring buffer (non-blocking)
@@ -46,9 +50,57 @@ func (r *Ring) Pop(threshold uint64) []interface{} {
 		buffer = append(buffer, v)
 		counter--
 	}
+	if len(buffer) > 0 {
+		r.notify()
+	}
 	return buffer
 }
 
+// Drop removes the oldest value in the ring (non-blocking)
+func (r *Ring) Drop() bool {
+	_, ok := r.Remove()
+	return ok
+}
+
+// Remove removes and returns the oldest value in the ring (non-blocking)
+func (r *Ring) Remove() (interface{}, bool) {
+	v, err := r.buffer.Poll(time.Nanosecond)
+	if err != nil {
+		return nil, false
+	}
+	r.notify()
+	return v, true
+}
+
+// Len returns the number of values in the ring
+func (r *Ring) Len() uint64 {
+	return r.buffer.Len()
+}
+
+// Signal wakes up the consumer which waits the Kick channel (non-blocking)
+func (r *Ring) Signal() {
+	select {
+	case r.Kick <- true:
+	default:
+	}
+}
+
+// Popped returns the channel which is closed when the values are popped or the ring is closed
+// Get the channel before the Offer to avoid missing the pop between them.
+func (r *Ring) Popped() <-chan bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.popped
+}
+
+// notify wakes up all the producers which wait the room of the ring
+func (r *Ring) notify() {
+	r.mutex.Lock()
+	close(r.popped)
+	r.popped = make(chan bool)
+	r.mutex.Unlock()
+}
+
 // Poll receives the number of values in ring until it is empty
 func (r *Ring) Poll() []interface{} {
 	return r.Pop(0)
@@ -58,5 +110,6 @@ func (r *Ring) Poll() []interface{} {
 func (r *Ring) Close() {
 	if r.buffer != nil {
 		r.buffer.Dispose()
+		r.notify()
 	}
 }
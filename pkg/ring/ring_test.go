@@ -40,3 +40,38 @@ func TestRing(t *testing.T) {
 		t.Errorf("ring buffer size must be zero")
 	}
 }
+
+func TestDropAndPopped(t *testing.T) {
+	r := setup(2)
+	r.Push(0)
+	r.Push(1)
+	popped := r.Popped()
+	if !r.Drop() || r.Len() != 1 {
+		t.Errorf("oldest value isn't dropped")
+	}
+	select {
+	case <-popped:
+	default:
+		t.Errorf("drop isn't notified")
+	}
+	if v := r.Poll(); len(v) != 1 || v[0] != 1 {
+		t.Errorf("invalid remaining values %v", v)
+	}
+	if r.Drop() {
+		t.Errorf("empty ring drops the value")
+	}
+	r.Push(2)
+	if v, ok := r.Remove(); !ok || v != 2 {
+		t.Errorf("oldest value isn't removed (%v, %v)", v, ok)
+	}
+	if _, ok := r.Remove(); ok {
+		t.Errorf("empty ring removes the value")
+	}
+	popped = r.Popped()
+	r.Close()
+	select {
+	case <-popped:
+	default:
+		t.Errorf("close isn't notified")
+	}
+}
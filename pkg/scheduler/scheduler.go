@@ -1,7 +1,11 @@
 package scheduler
 
 import (
-	"github.com/cloudflare/ahocorasick"
+	"sync"
+
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/filter"
+	"github.com/soyoslab/soy_log_generator/pkg/multiline"
 	"github.com/soyoslab/soy_log_generator/pkg/ring"
 	w "github.com/soyoslab/soy_log_generator/pkg/watcher"
 )
@@ -9,47 +13,170 @@ import (
 // SubmitFunc is the function pointer of the submit message
 type SubmitFunc func(messages []Message) error
 
+// InitFunc is the function pointer of the file map table submission
+type InitFunc func(files []File) error
+
 // CustomFilterFunc is the function pointer of the custom hot/cold filtering
 type CustomFilterFunc func(str string, isHot bool) bool
 
+// Multiline contains the rules to join the lines to a single event in json manner
+// The line which doesn't match the StartPattern, matches the ContinuationPattern
+// or begins with the whitespace (Indentation) is joined to the previous line.
+type Multiline struct {
+	StartPattern        string `json:"startPattern"`
+	ContinuationPattern string `json:"continuationPattern"`
+	Indentation         bool   `json:"indentation"`
+	MaxLines            uint64 `json:"maxLines"`
+	FlushTimeout        uint64 `json:"flushTimeoutMilli"`
+}
+
+// HotRule contains the typed hot filtering rule in json manner
+// Type is one of "keyword" and "regex" (default: keyword).
+// The line which matches an Exclude rule is cold even if the other rules match it.
+type HotRule struct {
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	Pattern       string `json:"pattern"`
+	WholeWord     bool   `json:"wholeWord"`
+	CaseSensitive bool   `json:"caseSensitive"`
+	Exclude       bool   `json:"exclude"`
+}
+
 // File contains the each file's information in json manner
+// StartPosition is one of "resume", "end" and "beginning" (default: resume)
+// WatcherBackend is one of "fsnotify" and "polling" (default: Config.WatcherBackend)
 type File struct {
-	Filename  string   `json:"filename"`
-	HotFilter []string `json:"hotFilter"`
+	Filename       string     `json:"filename"`
+	HotFilter      []string   `json:"hotFilter"`
+	HotRules       []HotRule  `json:"hotRules"`
+	StartPosition  string     `json:"startPosition"`
+	Multiline      *Multiline `json:"multiline"`
+	WatcherBackend string     `json:"watcherBackend"`
+}
+
+// Sink contains the output settings of the messages in json manner
+// Type is one of "collector", "file", "stdout", "http" and "loki", and Name defaults to Type.
+// Path, MaxBytes and MaxFiles are the settings of the file sink, and URL, Format,
+// Compression, Headers and Timeout are the settings of the http sink. The loki sink
+// uses URL, Format, Headers and Timeout. Both of them retry by MaxRetries and RetryBackoff,
+// and MaxRetries is a pointer because zero disables the retries (nil uses the default).
+type Sink struct {
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	Path         string            `json:"path"`
+	MaxBytes     uint64            `json:"maxBytes"`
+	MaxFiles     uint64            `json:"maxFiles"`
+	URL          string            `json:"url"`
+	Format       string            `json:"format"`
+	Compression  string            `json:"compression"`
+	Headers      map[string]string `json:"headers"`
+	Timeout      uint64            `json:"timeoutMilli"`
+	MaxRetries   *uint64           `json:"maxRetries"`
+	RetryBackoff uint64            `json:"retryBackoffMilli"`
+}
+
+// Route contains the rule which copies the matching messages to the sinks in json manner
+// Files are the glob patterns of the filenames, Classes are "hot" and "cold", Rules are
+// the names of the hot rules and Pattern is the regular expression of the line.
+// Each of them matches any of its values (empty matches every message), and all of them must match.
+// The messages are sent in the batches of BatchSize (default: 100) or every BatchTimeout
+// (default: 1000), and QueueSize (default: 1024) messages are queued before they are dropped.
+type Route struct {
+	Name         string   `json:"name"`
+	Files        []string `json:"files"`
+	Classes      []string `json:"classes"`
+	Rules        []string `json:"rules"`
+	Pattern      string   `json:"pattern"`
+	Sinks        []string `json:"sinks"`
+	BatchSize    uint64   `json:"batchSize"`
+	BatchTimeout uint64   `json:"batchTimeoutMilli"`
+	QueueSize    uint64   `json:"queueSize"`
 }
 
 // Config contains the application running configurations in json manner
+// HotOverflowPolicy and ColdOverflowPolicy are one of "block", "dropNewest",
+// "dropOldest", "sample" and "spill" (default: block).
 type Config struct {
-	Namespace         string `json:"namespace" default:"anonymous"`
-	TargetIP          string `json:"targetIp" default:"localhost"`
-	TargetPort        string `json:"targetPort" default:"8972"`
-	HotRingCapacity   uint64 `json:"hotRingCapacity" default:"32"`
-	ColdRingCapacity  uint64 `json:"coldRingCapacity" default:"32"`
-	ColdTimeout       uint64 `json:"coldTimeoutMilli" default:"5000"`
-	PollingInterval   uint64 `json:"pollingIntervalMilli" default:"1000"`
-	Files             []File `json:"files"`
-	HotRingThreshold  uint64 `json:"hotRingThreshold" default:"0"`
-	ColdRingThreshold uint64 `json:"coldRingThreshold" default:"0"`
-	ColdSendThreshold uint64 `json:"coldSendThresholdBytes" default:"4096"`
+	Namespace          string   `json:"namespace" default:"anonymous"`
+	TargetIP           string   `json:"targetIp" default:"localhost"`
+	TargetPort         string   `json:"targetPort" default:"8972"`
+	HotRingCapacity    uint64   `json:"hotRingCapacity" default:"32"`
+	ColdRingCapacity   uint64   `json:"coldRingCapacity" default:"32"`
+	ColdTimeout        uint64   `json:"coldTimeoutMilli" default:"5000"`
+	PollingInterval    uint64   `json:"pollingIntervalMilli" default:"1000"`
+	Files              []File   `json:"files"`
+	HotRingThreshold   uint64   `json:"hotRingThreshold" default:"0"`
+	ColdRingThreshold  uint64   `json:"coldRingThreshold" default:"0"`
+	ColdSendThreshold  uint64   `json:"coldSendThresholdBytes" default:"4096"`
+	CheckpointPath     string   `json:"checkpointPath"`
+	WatcherBackend     string   `json:"watcherBackend" default:"fsnotify"`
+	WatcherPolling     uint64   `json:"watcherPollingIntervalMilli" default:"1000"`
+	HotOverflowPolicy  string   `json:"hotOverflowPolicy" default:"block"`
+	ColdOverflowPolicy string   `json:"coldOverflowPolicy" default:"block"`
+	OverflowSampleRate uint64   `json:"overflowSampleRate" default:"10"`
+	SpillPath          string   `json:"spillPath"`
+	SpillMaxBytes      uint64   `json:"spillMaxBytes" default:"1073741824"`
+	SpoolPath          string   `json:"spoolPath"`
+	SpoolMaxBytes      uint64   `json:"spoolMaxBytes" default:"1073741824"`
+	SpoolMaxAge        uint64   `json:"spoolMaxAgeSec" default:"86400"`
+	SpillSync          uint64   `json:"spillSyncIntervalMilli" default:"1000"`
+	SpoolSync          uint64   `json:"spoolSyncIntervalMilli" default:"0"`
+	MetricsAddress     string   `json:"metricsAddress"`
+	RetryInitial       uint64   `json:"retryInitialBackoffMilli" default:"100"`
+	RetryMax           uint64   `json:"retryMaxBackoffMilli" default:"10000"`
+	RetryJitter        uint64   `json:"retryJitterPercent" default:"20"`
+	RetryMaxAttempts   uint64   `json:"retryMaxAttempts" default:"5"`
+	CallTimeout        uint64   `json:"callTimeoutMilli" default:"5000"`
+	BreakerThreshold   uint64   `json:"breakerFailureThreshold" default:"5"`
+	BreakerOpen        uint64   `json:"breakerOpenMilli" default:"10000"`
+	Compression        string   `json:"compression" default:"gzip"`
+	CompressionLevel   uint64   `json:"compressionLevel"`
+	CompressionFraming bool     `json:"compressionFraming"`
+	CompressionDict    string   `json:"compressionDictionary"`
+	TLS                bool     `json:"tls"`
+	TLSCAFile          string   `json:"tlsCaFile"`
+	TLSCertFile        string   `json:"tlsCertFile"`
+	TLSKeyFile         string   `json:"tlsKeyFile"`
+	TLSServerName      string   `json:"tlsServerName"`
+	TLSMinVersion      string   `json:"tlsMinVersion" default:"1.2"`
+	AuthMode           string   `json:"authMode" default:"none"`
+	AuthSecretFile     string   `json:"authSecretFile"`
+	AuthSecretEnv      string   `json:"authSecretEnv"`
+	Targets            []string `json:"targets"`
+	TargetStrategy     string   `json:"targetStrategy" default:"failover"`
+	HealthCheck        uint64   `json:"healthCheckMilli" default:"5000"`
+	DeliveryAck        bool     `json:"deliveryAck"`
+	CheckpointOnAck    bool     `json:"checkpointOnAck"`
+	Sinks              []Sink   `json:"sinks"`
+	Routes             []Route  `json:"routes"`
+	CheckpointInterval uint64   `json:"checkpointSaveIntervalMilli" default:"1000"`
 }
 
 // FileInfo contains the file data block metadata
+// Rule is the name of the hot filtering rule which matched the data.
+// Sequence is the line sequence number of the file, which is assigned when the line is read.
 type FileInfo struct {
 	Timestamp int64
 	Filename  string
 	Length    uint64
+	Rule      string
+	Sequence  uint64
 }
 
 // Message structure is used to transport with log-collector
+// Ticket is done when the collector accepts the message (nil if the checkpoint doesn't wait for it).
 type Message struct {
-	Info FileInfo
-	Data []byte
+	Info   FileInfo
+	Data   []byte
+	Ticket *checkpoint.Ticket `json:"-"`
 }
 
 // SubmitOperations contains functions which contain the transport logic
+// Init is optional and it is called when the files are changed at runtime.
 type SubmitOperations struct {
 	Hot  SubmitFunc
 	Cold SubmitFunc
+	Init InitFunc
 }
 
 // Scheduler contains the scheduling information
@@ -58,13 +185,29 @@ type Scheduler struct {
 	config       Config
 	hot          ring.Ring
 	cold         ring.Ring
-	matcher      map[string]*ahocorasick.Matcher
+	hotLane      *lane
+	coldLane     *lane
+	matcher      map[string]*filter.Matcher
 	submit       SubmitOperations
 	customFilter CustomFilterFunc
+	checkpoint   *checkpoint.Registry
+	aggregators  map[string]*multiline.Aggregator
+	patterns     []File
+	patternDirs  map[string]bool
+	createdFiles map[string]bool
+	sequences    map[string]uint64
+	patternMutex sync.Mutex
+	seqMutex     sync.Mutex
+	mutex        sync.RWMutex
+	stopping     chan bool
+	stopped      chan bool
+	stopOnce     sync.Once
 	IsRun        int32
 }
 
 // GetConfig returns Config structure in Scheduler
 func (s *Scheduler) GetConfig() Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.config
 }
@@ -0,0 +1,357 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+	"github.com/soyoslab/soy_log_generator/pkg/ring"
+	"github.com/soyoslab/soy_log_generator/pkg/spool"
+)
+
+const (
+	// OverflowBlock blocks the reader until the ring has room (default)
+	OverflowBlock = "block"
+	// OverflowDropNewest drops the new line when the ring is full
+	OverflowDropNewest = "dropNewest"
+	// OverflowDropOldest drops the oldest line in the ring to make room for the new line
+	OverflowDropOldest = "dropOldest"
+	// OverflowSample keeps one of every overflowSampleRate lines by blocking and drops the others
+	OverflowSample = "sample"
+	// OverflowSpill writes the lines to the disk and moves them back to the ring when it has room
+	OverflowSpill = "spill"
+)
+
+// errUnspillable is returned when the spool fails to store the message
+var errUnspillable = errors.New("message cannot be spilled")
+
+var (
+	droppedLines  = metrics.DefaultRegistry.NewCounter("generator_dropped_lines_total", "Number of the lines dropped by the overflow policy.", "ring")
+	spilledLines  = metrics.DefaultRegistry.NewCounter("generator_spilled_lines_total", "Number of the lines spilled to the disk.", "ring")
+	ringOccupancy = metrics.DefaultRegistry.NewGauge("generator_ring_occupancy", "Number of the lines in the ring.", "ring")
+	ringHighWater = metrics.DefaultRegistry.NewGauge("generator_ring_high_water", "Maximum number of the lines in the ring.", "ring")
+)
+
+// OverflowStats contains the counters of the lines which overflow the rings
+type OverflowStats struct {
+	HotDropped  uint64
+	ColdDropped uint64
+	HotSpilled  uint64
+	ColdSpilled uint64
+}
+
+// lane applies the overflow policy to a ring
+// If eager is set, the consumer is kicked on every line. The checkpoint tickets
+// of the spilled messages are kept in order, and the messages spilled by the
+// previous run (untracked) have no tickets.
+type lane struct {
+	ring       *ring.Ring
+	policy     string
+	sampleRate uint64
+	eager      bool
+	spool      *spool.Queue
+	tickets    []*checkpoint.Ticket
+	untracked  int64
+	overflowed uint64
+	dropped    uint64
+	spilled    uint64
+	mutex      sync.Mutex
+}
+
+// isValidOverflowPolicy checks the policy is supported
+func isValidOverflowPolicy(policy string) bool {
+	switch policy {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest, OverflowSample, OverflowSpill:
+		return true
+	}
+	return false
+}
+
+// validateOverflow checks the overflow settings of the configuration
+func validateOverflow(config Config) error {
+	for _, policy := range []string{config.HotOverflowPolicy, config.ColdOverflowPolicy} {
+		if !isValidOverflowPolicy(policy) {
+			return fmt.Errorf("invalid overflow policy %q", policy)
+		}
+		if policy == OverflowSpill && len(config.SpillPath) == 0 {
+			return fmt.Errorf("spill path must be specified for the %q overflow policy", policy)
+		}
+	}
+	if config.OverflowSampleRate < 1 {
+		return fmt.Errorf("overflow sample rate must be over 0")
+	}
+	return nil
+}
+
+// newLane makes the lane of the ring
+// The spilled lines are stored in the directory named by the ring's type.
+func newLane(r *ring.Ring, policy string, config Config) (*lane, error) {
+	var err error
+	l := &lane{ring: r, policy: policy, sampleRate: config.OverflowSampleRate}
+	if policy != OverflowSpill {
+		return l, nil
+	}
+	dir := filepath.Join(config.SpillPath, r.BufferType)
+	l.spool, err = spool.Open(dir, 0, int64(config.SpillMaxBytes))
+	if err == nil {
+		l.spool.SetSyncInterval(time.Duration(config.SpillSync) * time.Millisecond)
+		l.untracked = l.spool.Len()
+	}
+	return l, err
+}
+
+// initOverflow initializes the lanes of the hot and cold rings
+func (s *Scheduler) initOverflow() error {
+	var err error
+	if err = validateOverflow(s.config); err != nil {
+		return err
+	}
+	if s.hotLane, err = newLane(&s.hot, s.config.HotOverflowPolicy, s.config); err != nil {
+		return err
+	}
+	s.hotLane.eager = true
+	s.coldLane, err = newLane(&s.cold, s.config.ColdOverflowPolicy, s.config)
+	return err
+}
+
+// insert inserts the message into the ring and applies the overflow policy if it is full
+func (l *lane) insert(message Message, wait time.Duration) error {
+	if l.spool != nil {
+		return l.spill(message, wait)
+	}
+	ok, err := l.ring.Offer(message)
+	if ok || err != nil {
+		l.kick()
+		return err
+	}
+	switch l.policy {
+	case OverflowDropNewest:
+		l.drop(message)
+		return nil
+	case OverflowDropOldest:
+		return l.dropOldest(message)
+	case OverflowSample:
+		if atomic.AddUint64(&l.overflowed, 1)%l.sampleRate != 0 {
+			l.drop(message)
+			return nil
+		}
+	}
+	return l.block(message, wait)
+}
+
+// drop counts the dropped line
+func (l *lane) drop(message Message) {
+	atomic.AddUint64(&l.dropped, 1)
+	droppedLines.Inc(l.ring.BufferType)
+	release(message)
+}
+
+// release acknowledges the message which is dropped by the overflow policy
+// The dropped message is never read again.
+func release(message Message) {
+	if err := message.Ticket.Done(); err != nil {
+		log.Println("checkpoint update failed:", err)
+	}
+}
+
+// observe updates the occupancy metrics of the ring
+func (l *lane) observe() {
+	occupancy := float64(l.ring.Len())
+	ringOccupancy.Set(occupancy, l.ring.BufferType)
+	ringHighWater.SetMax(occupancy, l.ring.BufferType)
+}
+
+// kick wakes up the consumer if the lane is eager
+// It is called after the line is inserted, so the occupancy is updated together.
+func (l *lane) kick() {
+	l.observe()
+	if l.eager {
+		l.ring.Signal()
+	}
+}
+
+// block waits until the ring has room
+// The consumer is kicked to drain the ring, and the wait is bounded
+// by the timeout in case the pop notification is missed.
+func (l *lane) block(message Message, wait time.Duration) error {
+	for {
+		popped := l.ring.Popped()
+		ok, err := l.ring.Offer(message)
+		if ok || err != nil {
+			l.kick()
+			return err
+		}
+		l.ring.Signal()
+		select {
+		case <-popped:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// dropOldest removes the oldest messages until the new message is inserted
+func (l *lane) dropOldest(message Message) error {
+	for {
+		if v, ok := l.ring.Remove(); ok {
+			l.drop(v.(Message))
+		}
+		ok, err := l.ring.Offer(message)
+		if ok || err != nil {
+			l.kick()
+			return err
+		}
+	}
+}
+
+// spill writes the message to the spool while the spool has the older messages or the ring is full
+// The reader waits until the spool has room like the block policy. The message which cannot
+// be spilled (e.g. the line larger than the segment) waits for the ring after the spilled messages.
+func (l *lane) spill(message Message, wait time.Duration) error {
+	for {
+		popped := l.ring.Popped()
+		err := l.trySpill(message)
+		if err == errUnspillable {
+			return l.await(message, wait)
+		} else if err != spool.ErrFull {
+			return err
+		}
+		l.ring.Signal()
+		select {
+		case <-popped:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// trySpill inserts the message into the ring or the spool
+// It returns errUnspillable if the spool fails to store the message.
+func (l *lane) trySpill(message Message) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.spool.Len() == 0 {
+		ok, err := l.ring.Offer(message)
+		if ok || err != nil {
+			l.kick()
+			return err
+		}
+	}
+	b, err := json.Marshal(message)
+	if err == nil {
+		err = l.spool.Push(b)
+	}
+	if err == spool.ErrFull {
+		return err
+	} else if err != nil {
+		log.Printf("%s line isn't spilled, wait for the ring: %v\n", l.ring.BufferType, err)
+		return errUnspillable
+	}
+	l.tickets = append(l.tickets, message.Ticket)
+	atomic.AddUint64(&l.spilled, 1)
+	spilledLines.Inc(l.ring.BufferType)
+	l.ring.Signal()
+	return nil
+}
+
+// await waits until the spilled messages are moved back and the ring has room
+func (l *lane) await(message Message, wait time.Duration) error {
+	for {
+		popped := l.ring.Popped()
+		var (
+			ok  bool
+			err error
+		)
+		l.mutex.Lock()
+		if l.spool.Len() == 0 {
+			ok, err = l.ring.Offer(message)
+		}
+		l.mutex.Unlock()
+		if ok || err != nil {
+			l.kick()
+			return err
+		}
+		l.ring.Signal()
+		select {
+		case <-popped:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// refill moves the spilled messages back to the ring while it has room
+// The message gets its checkpoint ticket back, and the broken message is discarded.
+func (l *lane) refill() error {
+	if l.spool == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.spool.Len() > 0 {
+		b, err := l.spool.Peek()
+		if err != nil {
+			return err
+		}
+		ok, message := true, Message{}
+		if json.Unmarshal(b, &message) == nil {
+			message.Ticket = l.frontTicket()
+			ok, err = l.ring.Offer(message)
+		}
+		if !ok || err != nil {
+			l.ring.Signal()
+			return err
+		}
+		if _, err = l.spool.Pop(); err != nil {
+			return err
+		}
+		l.popTicket()
+	}
+	return nil
+}
+
+// frontTicket returns the checkpoint ticket of the first spilled message (l.mutex must be held)
+func (l *lane) frontTicket() *checkpoint.Ticket {
+	if l.untracked > 0 || len(l.tickets) == 0 {
+		return nil
+	}
+	return l.tickets[0]
+}
+
+// popTicket removes the checkpoint ticket of the first spilled message (l.mutex must be held)
+func (l *lane) popTicket() {
+	if l.untracked > 0 {
+		l.untracked--
+	} else if len(l.tickets) > 0 {
+		l.tickets[0] = nil
+		l.tickets = l.tickets[1:]
+	}
+}
+
+// close closes the spool of the lane
+func (l *lane) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.spool.Close()
+}
+
+// GetOverflowStats returns the counters of the lines which overflow the rings
+func (s *Scheduler) GetOverflowStats() OverflowStats {
+	stats := OverflowStats{}
+	if s.hotLane != nil {
+		stats.HotDropped = atomic.LoadUint64(&s.hotLane.dropped)
+		stats.HotSpilled = atomic.LoadUint64(&s.hotLane.spilled)
+	}
+	if s.coldLane != nil {
+		stats.ColdDropped = atomic.LoadUint64(&s.coldLane.dropped)
+		stats.ColdSpilled = atomic.LoadUint64(&s.coldLane.spilled)
+	}
+	return stats
+}
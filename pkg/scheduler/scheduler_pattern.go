@@ -0,0 +1,266 @@
+package scheduler
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"reflect"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/soyoslab/soy_log_generator/pkg/buffering"
+)
+
+// maxFiles is the number of files which the file map table can contain
+const maxFiles = 255
+
+// watchPatterns watches the parent directories of the patterns to find the new files
+func (s *Scheduler) watchPatterns() error {
+	s.watcher.SetDirectoryEventFunction(s.directoryEvent)
+	return s.updatePatternDirs()
+}
+
+// updatePatternDirs watches the directories which can contain the matched files
+// The directory part of the pattern can also be a pattern, so it is expanded every time.
+// The directory is watched by the pattern's watcher backend (e.g. polling on NFS).
+func (s *Scheduler) updatePatternDirs() error {
+	for _, pattern := range s.patterns {
+		dirs, err := filepath.Glob(filepath.Dir(pattern.Filename))
+		if err != nil {
+			return err
+		}
+		for _, dir := range dirs {
+			key := pattern.WatcherBackend + ":" + dir
+			if s.patternDirs[key] {
+				continue
+			}
+			if err = s.watcher.WatchDirWithBackend(dir, pattern.WatcherBackend); err != nil {
+				return err
+			}
+			s.patternDirs[key] = true
+		}
+	}
+	return nil
+}
+
+// directoryEvent evaluates the patterns again when a file is created, renamed or removed
+// The created file is remembered until the evaluation because it is read from the beginning.
+// The failure is logged and the watcher keeps running.
+func (s *Scheduler) directoryEvent(event fsnotify.Event) error {
+	if event.Op&fsnotify.Create != 0 {
+		s.patternMutex.Lock()
+		s.createdFiles[event.Name] = true
+		s.patternMutex.Unlock()
+	}
+	if err := s.rescanPatterns(); err != nil {
+		log.Printf("pattern re-evaluation failed (event: %v): %v\n", event, err)
+	}
+	return nil
+}
+
+// uniqueFiles removes the files which are matched by the previous patterns
+func uniqueFiles(files []File) []File {
+	unique := []File{}
+	dupMap := make(map[string]bool)
+	for _, file := range files {
+		if dupMap[file.Filename] {
+			continue
+		}
+		dupMap[file.Filename] = true
+		unique = append(unique, file)
+	}
+	return unique
+}
+
+// diffFiles returns the files which are only in the next and only in the current
+func diffFiles(current []File, next []File) ([]File, []File) {
+	added, removed := []File{}, []File{}
+	currentMap := make(map[string]bool)
+	nextMap := make(map[string]bool)
+	for _, file := range current {
+		currentMap[file.Filename] = true
+	}
+	for _, file := range next {
+		nextMap[file.Filename] = true
+		if !currentMap[file.Filename] {
+			added = append(added, file)
+		}
+	}
+	for _, file := range current {
+		if !nextMap[file.Filename] {
+			removed = append(removed, file)
+		}
+	}
+	return added, removed
+}
+
+// rescanPatterns applies the files which are newly matched or disappeared
+func (s *Scheduler) rescanPatterns() error {
+	return s.applyPatterns(false)
+}
+
+// applyPatterns applies the files which are newly matched, disappeared or changed
+// The updated file map table is sent by the Init submit function when the files
+// are added or removed, or always if the force is set.
+func (s *Scheduler) applyPatterns(force bool) error {
+	s.patternMutex.Lock()
+	defer s.patternMutex.Unlock()
+	s.mutex.RLock()
+	patterns := s.patterns
+	s.mutex.RUnlock()
+	files, err := configPatternTranslation(patterns)
+	if err != nil {
+		return err
+	}
+	current, next := s.GetConfig().Files, uniqueFiles(files)
+	added, removed := diffFiles(current, next)
+	created := s.createdFiles
+	s.createdFiles = make(map[string]bool)
+	for _, file := range removed {
+		s.removeFile(file.Filename)
+		log.Println("file is removed from the watcher:", file.Filename)
+	}
+	for _, file := range added {
+		if err = s.addFile(file, created[file.Filename]); err != nil {
+			log.Printf("file cannot be added to the watcher (filename: %s): %v\n", file.Filename, err)
+			continue
+		}
+		log.Println("file is added to the watcher:", file.Filename)
+	}
+	for _, file := range changedFiles(current, next) {
+		if err = s.updateFile(file); err != nil {
+			log.Printf("file settings cannot be changed (filename: %s): %v\n", file.Filename, err)
+			continue
+		}
+		log.Println("file settings are changed:", file.Filename)
+	}
+	if err = s.updatePatternDirs(); err != nil {
+		return err
+	}
+	if (!force && len(added) == 0 && len(removed) == 0) || s.submit.Init == nil {
+		return nil
+	}
+	return s.submit.Init(s.GetConfig().Files)
+}
+
+// changedFiles returns the files in the next whose settings are different from the current
+func changedFiles(current []File, next []File) []File {
+	changed := []File{}
+	currentMap := make(map[string]File)
+	for _, file := range current {
+		currentMap[file.Filename] = file
+	}
+	for _, file := range next {
+		if prev, ok := currentMap[file.Filename]; ok && !reflect.DeepEqual(prev, file) {
+			changed = append(changed, file)
+		}
+	}
+	return changed
+}
+
+// addFile adds the file which is found at runtime
+// The file starts at the pattern's start position, but the file created after the watcher
+// started is read from the beginning and the rotated file which is already read until EOF
+// is read from the end.
+func (s *Scheduler) addFile(file File, created bool) error {
+	s.mutex.Lock()
+	if len(s.config.Files) >= maxFiles {
+		s.mutex.Unlock()
+		return errors.New("number of files is under 256")
+	}
+	err := s.addHotFilter(file)
+	if err == nil {
+		err = s.addMultiline(file)
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		s.removeFilter(file.Filename)
+		return err
+	}
+
+	options := s.newBufferingOptions(file.Filename, file.StartPosition)
+	if created {
+		options.Start = buffering.StartAtBeginning
+	}
+	if s.watcher.IsDrained(file.Filename) {
+		options.Start = buffering.StartAtEnd
+	}
+	err = s.watcher.AddFileWithBackend(file.Filename, s.processLine, options, file.WatcherBackend)
+	if err != nil {
+		s.removeFilter(file.Filename)
+		return err
+	}
+
+	s.mutex.Lock()
+	files := make([]File, 0, len(s.config.Files)+1)
+	s.config.Files = append(append(files, s.config.Files...), file)
+	s.mutex.Unlock()
+	return nil
+}
+
+// updateFile replaces the filters of the file whose settings are changed
+// The pending multiline event is flushed by the previous aggregator.
+// The start position and the watcher backend are used only when the file is opened again.
+func (s *Scheduler) updateFile(file File) error {
+	matcher, err := newHotFilter(file)
+	if err != nil {
+		return err
+	}
+	aggregator, err := s.newAggregator(file)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	previous := s.aggregators[file.Filename]
+	delete(s.aggregators, file.Filename)
+	if aggregator != nil {
+		s.aggregators[file.Filename] = aggregator
+	}
+	s.matcher[file.Filename] = matcher
+	files := make([]File, 0, len(s.config.Files))
+	for _, f := range s.config.Files {
+		if f.Filename == file.Filename {
+			f = file
+		}
+		files = append(files, f)
+	}
+	s.config.Files = files
+	s.mutex.Unlock()
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// removeFile removes the file which disappeared at runtime
+func (s *Scheduler) removeFile(filename string) {
+	s.watcher.Remove(filename)
+	s.removeFilter(filename)
+	if s.checkpoint != nil {
+		s.checkpoint.Delete(filename)
+	}
+
+	s.mutex.Lock()
+	files := make([]File, 0, len(s.config.Files))
+	for _, file := range s.config.Files {
+		if file.Filename != filename {
+			files = append(files, file)
+		}
+	}
+	s.config.Files = files
+	s.mutex.Unlock()
+}
+
+// removeFilter flushes the pending event and removes the filters of the file
+// The aggregator is closed before the matcher is removed because its last event needs the matcher.
+func (s *Scheduler) removeFilter(filename string) {
+	s.mutex.RLock()
+	aggregator, ok := s.aggregators[filename]
+	s.mutex.RUnlock()
+	if ok {
+		aggregator.Close()
+	}
+	s.mutex.Lock()
+	delete(s.aggregators, filename)
+	delete(s.matcher, filename)
+	s.mutex.Unlock()
+}
@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// restartFields are the json names of the Config fields which are applied after the restart
+var restartFields = map[string]bool{
+	"namespace":                   true,
+	"targetIp":                    true,
+	"targetPort":                  true,
+	"hotRingCapacity":             true,
+	"coldRingCapacity":            true,
+	"checkpointPath":              true,
+	"checkpointSaveIntervalMilli": true,
+	"hotOverflowPolicy":           true,
+	"coldOverflowPolicy":          true,
+	"overflowSampleRate":          true,
+	"spillPath":                   true,
+	"spillMaxBytes":               true,
+	"spoolPath":                   true,
+	"spoolMaxBytes":               true,
+	"spoolMaxAgeSec":              true,
+	"spillSyncIntervalMilli":      true,
+	"spoolSyncIntervalMilli":      true,
+	"metricsAddress":              true,
+	"callTimeoutMilli":            true,
+	"compression":                 true,
+	"compressionLevel":            true,
+	"compressionFraming":          true,
+	"compressionDictionary":       true,
+	"tls":                         true,
+	"tlsCaFile":                   true,
+	"tlsCertFile":                 true,
+	"tlsKeyFile":                  true,
+	"tlsServerName":               true,
+	"tlsMinVersion":               true,
+	"authMode":                    true,
+	"authSecretFile":              true,
+	"authSecretEnv":               true,
+	"targets":                     true,
+	"targetStrategy":              true,
+	"healthCheckMilli":            true,
+	"deliveryAck":                 true,
+	"checkpointOnAck":             true,
+	"sinks":                       true,
+	"routes":                      true,
+}
+
+// redactedFields are the json names of the Config fields whose values aren't logged
+// The sinks carry the credentials in their headers and URLs.
+var redactedFields = map[string]bool{
+	"sinks": true,
+}
+
+// Reload applies the configuration file to the running scheduler
+// The new configuration is validated before it is applied, so the current
+// configuration is kept when the validation fails.
+// The files are added, removed or rebuilt and the file map table is sent again.
+func (s *Scheduler) Reload(configFilepath string) error {
+	next := new(Scheduler)
+	err := next.initConfig(configFilepath)
+	if err == nil {
+		err = validateReload(next.config)
+	}
+	if err != nil {
+		log.Println("config reload failed, the current config is kept:", err)
+		return err
+	}
+
+	s.mutex.Lock()
+	config := mergeConfig(s.config, next.config)
+	config.Files = s.config.Files
+	s.config = config
+	s.patterns = next.patterns
+	s.mutex.Unlock()
+
+	interval := time.Duration(config.WatcherPolling) * time.Millisecond
+	if err = s.watcher.SetBackend(config.WatcherBackend, interval); err != nil {
+		return err
+	}
+	return s.applyPatterns(true)
+}
+
+// validateReload checks the settings which are validated by InitScheduler
+func validateReload(config Config) error {
+	if config.PollingInterval > 1000 {
+		return fmt.Errorf("polling interval must be below than 1000ms (current: %dms)", config.PollingInterval)
+	}
+	if !isValidWatcherBackend(config.WatcherBackend) {
+		return fmt.Errorf("invalid watcher backend %q", config.WatcherBackend)
+	}
+	if err := validateRetry(config); err != nil {
+		return err
+	}
+	return validateOverflow(config)
+}
+
+// mergeConfig returns the next configuration except the fields which need the restart
+// The changed fields are logged, and only the names of the redacted fields are logged.
+func mergeConfig(current Config, next Config) Config {
+	currentValue := reflect.ValueOf(current)
+	nextValue := reflect.ValueOf(&next).Elem()
+	for i := 0; i < currentValue.NumField(); i++ {
+		name := strings.Split(currentValue.Type().Field(i).Tag.Get("json"), ",")[0]
+		before, after := currentValue.Field(i), nextValue.Field(i)
+		if name == "files" || reflect.DeepEqual(before.Interface(), after.Interface()) {
+			continue
+		}
+		change := fmt.Sprintf("%v -> %v", before, after)
+		if redactedFields[name] {
+			change = "redacted"
+		}
+		if restartFields[name] {
+			log.Printf("config %s is changed (%s) but it is applied after the restart\n", name, change)
+			after.Set(before)
+			continue
+		}
+		log.Printf("config %s is changed (%s)\n", name, change)
+	}
+	return next
+}
@@ -2,70 +2,117 @@ package scheduler
 
 import (
 	"log"
-	"runtime"
 	"strings"
 	"sync/atomic"
 	"time"
-)
 
-// insertHotString inserts the string in the hot classifier manner
-func (s *Scheduler) insertHotString(message Message) error {
-	defer func() {
-		recover()
-	}()
-	err := s.hot.Push(message)
-	s.hot.Kick <- true
-	return err
-}
+	"github.com/soyoslab/soy_log_generator/pkg/buffering"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+)
 
-// insertColdString inserts the string in the cold classifier mannner
-func (s *Scheduler) insertColdString(message Message) error {
-	defer func() {
-		recover()
-	}()
-	start := time.Now()
-	timeout := time.Duration(s.config.ColdTimeout) * time.Millisecond
-	for {
-		ok, _ := s.cold.Offer(message)
-		if ok {
-			break
-		}
+// closeTimeout bounds the wait for the consumer of the rings on close
+const closeTimeout = time.Duration(5000) * time.Millisecond
 
-		if timeout > 0 && time.Since(start) >= timeout {
-			s.cold.Kick <- true
-			start = time.Now()
-		} else {
-			runtime.Gosched()
-		}
-		if atomic.LoadInt32(&s.IsRun) == 0 {
-			break
-		}
-	}
-	return nil
-}
+var classifiedLines = metrics.DefaultRegistry.NewCounter("generator_classified_lines_total", "Number of the lines classified as hot or cold.", "class")
 
 // insertString classifies the string state and place to the valid method
+// The string is inserted by the reader's goroutine, so the overflow policy
+// decides whether the reader waits or the string is dropped when the ring is full.
 func (s *Scheduler) insertString(str string, args interface{}) error {
+	var isHot bool
 	filename := args.([]interface{})[0].(string)
 	message := Message{}
 	message.Info.Timestamp = time.Now().UnixNano()
 	message.Info.Filename = filename
+	message.Info.Sequence = s.nextSequence(filename)
 	str = strings.Trim(str, "\n")
 	message.Info.Length = uint64(len([]byte(str)))
 	message.Data = []byte(str)
-	if s.isHotString(filename, str) {
-		go s.insertHotString(message)
-	} else {
-		go s.insertColdString(message)
+	message.Info.Rule, isHot = s.classify(filename, str)
+	message.Ticket = getTicket(args)
+	wait := time.Duration(s.GetConfig().PollingInterval) * time.Millisecond
+	if isHot {
+		classifiedLines.Inc("hot")
+		return s.hotLane.insert(message, wait)
+	}
+	classifiedLines.Inc("cold")
+	return s.coldLane.insert(message, wait)
+}
+
+// nextSequence returns the next line sequence number of the file
+// The lines of a file are read by one goroutine, so the sequences follow the order in the file.
+func (s *Scheduler) nextSequence(filename string) uint64 {
+	s.seqMutex.Lock()
+	defer s.seqMutex.Unlock()
+	if s.sequences == nil {
+		s.sequences = make(map[string]uint64)
+	}
+	s.sequences[filename]++
+	return s.sequences[filename]
+}
+
+// getTicket takes the ticket of the line if its position is tracked
+func getTicket(args interface{}) *checkpoint.Ticket {
+	for _, arg := range args.([]interface{}) {
+		if position, ok := arg.(checkpoint.Position); ok {
+			return position.Track()
+		}
 	}
 	return nil
 }
 
+// processLine receives the lines of the file
+// If the file has the multiline rule, the lines are joined before the classification.
+// The aggregator is looked up on every line because Reload can replace it.
+func (s *Scheduler) processLine(str string, args interface{}) error {
+	filename := args.([]interface{})[0].(string)
+	s.mutex.RLock()
+	aggregator, ok := s.aggregators[filename]
+	s.mutex.RUnlock()
+	if ok {
+		return aggregator.Push(str, args)
+	}
+	return s.insertString(str, args)
+}
+
+// newBufferingOptions returns the buffering options of the file which starts at the position
+func (s *Scheduler) newBufferingOptions(filename string, start string) buffering.Options {
+	options := buffering.Options{Start: start, Checkpoint: s.checkpoint, Acknowledge: s.GetConfig().CheckpointOnAck}
+	if !options.Acknowledge {
+		options.Pending = s.pendingStart(filename)
+	}
+	return options
+}
+
+// pendingStart returns the function which finds the start of the pending multiline event of the file
+// The offset of the file isn't committed beyond the event, so a crash reads it again.
+func (s *Scheduler) pendingStart(filename string) func() (buffering.LineStart, bool) {
+	return func() (buffering.LineStart, bool) {
+		s.mutex.RLock()
+		aggregator, ok := s.aggregators[filename]
+		s.mutex.RUnlock()
+		if !ok {
+			return buffering.LineStart{}, false
+		}
+		args, ok := aggregator.Pending()
+		if !ok {
+			return buffering.LineStart{}, false
+		}
+		for _, arg := range args.([]interface{}) {
+			if start, ok := arg.(buffering.LineStart); ok {
+				return start, true
+			}
+		}
+		return buffering.LineStart{}, false
+	}
+}
+
 // registFilesToWatcher regists the files to watcher package in the Scheduler structure
 func (s *Scheduler) registFilesToWatcher() error {
 	var err error
-	for _, file := range s.config.Files {
-		err = s.watcher.AddFile(file.Filename, s.insertString)
+	for _, file := range s.GetConfig().Files {
+		err = s.watcher.AddFileWithBackend(file.Filename, s.processLine, s.newBufferingOptions(file.Filename, file.StartPosition), file.WatcherBackend)
 		if err != nil {
 			goto exception
 		}
@@ -84,49 +131,130 @@ func (s *Scheduler) process(f SubmitFunc, arr []interface{}) error {
 	return f(messages)
 }
 
+// saveCheckpoint saves the offsets acknowledged by the submission
+func (s *Scheduler) saveCheckpoint() {
+	if s.checkpoint == nil {
+		return
+	}
+	if err := s.checkpoint.Save(); err != nil {
+		log.Println("checkpoint save failed:", err)
+	}
+}
+
+// processHot submits the hot messages and moves the spilled messages to the ring
+func (s *Scheduler) processHot(config Config) {
+	s.process(s.submit.Hot, s.hot.Pop(config.HotRingThreshold))
+	s.saveCheckpoint()
+	if err := s.hotLane.refill(); err != nil {
+		log.Println("hot spool refill failed:", err)
+	}
+	s.hotLane.observe()
+}
+
+// processCold submits the cold messages and moves the spilled messages to the ring
+func (s *Scheduler) processCold(config Config) {
+	s.process(s.submit.Cold, s.cold.Pop(config.ColdRingThreshold))
+	s.saveCheckpoint()
+	if err := s.coldLane.refill(); err != nil {
+		log.Println("cold spool refill failed:", err)
+	}
+	s.coldLane.observe()
+}
+
 // processString prcesses the string based on the scheduling policy
 func (s *Scheduler) processString() {
+	defer close(s.stopped)
 	for {
 		if atomic.LoadInt32(&s.IsRun) == 0 {
 			break
 		}
+		config := s.GetConfig()
 		select {
+		case <-s.stopping:
+			continue
 		case <-s.hot.Kick:
-			s.process(s.submit.Hot, s.hot.Pop(s.config.HotRingThreshold))
+			s.processHot(config)
 			continue
 		case <-s.cold.Kick:
-			s.process(s.submit.Cold, s.cold.Pop(s.config.ColdRingThreshold))
+			s.processCold(config)
 			continue
-		case <-time.After(time.Duration(s.config.PollingInterval) * time.Millisecond):
-			s.process(s.submit.Hot, s.hot.Pop(s.config.HotRingThreshold))
-			s.process(s.submit.Cold, s.cold.Pop(s.config.ColdRingThreshold))
+		case <-time.After(time.Duration(config.PollingInterval) * time.Millisecond):
+			s.processHot(config)
+			s.processCold(config)
 		}
 	}
 }
 
+// stop stops the consumer of the rings and waits for it if it is running
+// It returns false if the consumer doesn't stop in closeTimeout.
+func (s *Scheduler) stop(running bool) bool {
+	atomic.StoreInt32(&s.IsRun, 0)
+	s.stopOnce.Do(func() { close(s.stopping) })
+	if !running {
+		return true
+	}
+	select {
+	case <-s.stopped:
+		return true
+	case <-time.After(closeTimeout):
+		log.Println("consumer doesn't stop, the lines in the rings aren't submitted")
+		return false
+	}
+}
+
+// drain submits the lines left in the rings after the consumer is stopped
+// The spilled lines stay in the spill and they are moved back on the next run.
+func (s *Scheduler) drain() {
+	if s.submit.Hot == nil || s.submit.Cold == nil {
+		return
+	}
+	config := s.GetConfig()
+	for messages := s.hot.Pop(config.HotRingThreshold); len(messages) > 0; messages = s.hot.Pop(config.HotRingThreshold) {
+		s.process(s.submit.Hot, messages)
+	}
+	for messages := s.cold.Pop(config.ColdRingThreshold); len(messages) > 0; messages = s.cold.Pop(config.ColdRingThreshold) {
+		s.process(s.submit.Cold, messages)
+	}
+	s.saveCheckpoint()
+}
+
 // Run executes the scheduler
 func (s *Scheduler) Run() error {
 	err := s.registFilesToWatcher()
 	if err != nil {
 		return err
 	}
-	go s.processString()
+	err = s.watchPatterns()
+	if err != nil {
+		return err
+	}
 	atomic.StoreInt32(&s.IsRun, 1)
+	go s.processString()
 	s.watcher.Wait()
 	return nil
 }
 
 // isHotString classifies string is hot or not
-// Note that if you set the s.customFilter then it will work after keywords check.
 func (s *Scheduler) isHotString(filename string, str string) bool {
-	str = strings.ToLower(str)
+	_, isHot := s.classify(filename, str)
+	return isHot
+}
+
+// classify returns the name of the matched hot rule and whether the string is hot or not
+// Note that if you set the s.customFilter then it will work after the rules check.
+func (s *Scheduler) classify(filename string, str string) (string, bool) {
+	s.mutex.RLock()
 	matcher, ok := s.matcher[filename]
+	s.mutex.RUnlock()
 	if !ok {
 		log.Panicf("invalid filename detected %v", filename)
 	}
-	isHot := len(matcher.MatchThreadSafe([]byte(str))) > 0
+	rule, isHot := matcher.Match(str)
 	if s.customFilter != nil {
-		return s.customFilter(str, isHot)
+		isHot = s.customFilter(strings.ToLower(str), isHot)
 	}
-	return isHot
+	if !isHot {
+		rule = ""
+	}
+	return rule, isHot
 }
@@ -10,9 +10,13 @@ import (
 	"path/filepath"
 	"strings"
 	"sync/atomic"
+	"time"
 
-	"github.com/cloudflare/ahocorasick"
 	defaults "github.com/mcuadros/go-defaults"
+	"github.com/soyoslab/soy_log_generator/pkg/buffering"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/filter"
+	"github.com/soyoslab/soy_log_generator/pkg/multiline"
 	w "github.com/soyoslab/soy_log_generator/pkg/watcher"
 )
 
@@ -20,18 +24,33 @@ import (
 func InitScheduler(configFilepath string, submitOperations SubmitOperations, customFilter CustomFilterFunc) (*Scheduler, error) {
 	var err error
 	s := new(Scheduler)
+	s.stopping = make(chan bool)
+	s.stopped = make(chan bool)
 	if err = s.initConfig(configFilepath); err != nil {
 		goto exception
 	}
 	if s.config.PollingInterval > 1000 {
 		log.Fatalf("Please set the polling interval to below than 1000ms (current: %dms)\n", s.config.PollingInterval)
 	}
+	if err = validateRetry(s.config); err != nil {
+		goto exception
+	}
 	if err = s.initWatcher(); err != nil {
 		goto exception
 	}
+	if err = s.initCheckpoint(); err != nil {
+		goto exception
+	}
 	atomic.StoreInt32(&s.IsRun, 0)
+	s.patternDirs = make(map[string]bool)
+	s.createdFiles = make(map[string]bool)
 	s.customFilter = customFilter
-	s.initHotFilter(s.config.Files)
+	if err = s.initHotFilter(s.config.Files); err != nil {
+		goto exception
+	}
+	if err = s.initMultiline(s.config.Files); err != nil {
+		goto exception
+	}
 	if s.config.HotRingCapacity < 1 {
 		err = errors.New("hot ring capacity must be over 1")
 		goto exception
@@ -42,6 +61,9 @@ func InitScheduler(configFilepath string, submitOperations SubmitOperations, cus
 		goto exception
 	}
 	s.cold.Init(s.config.ColdRingCapacity, "cold")
+	if err = s.initOverflow(); err != nil {
+		goto exception
+	}
 	s.submit = submitOperations
 	if s.submit.Hot == nil || s.submit.Cold == nil {
 		err = errors.New("invalid submit function")
@@ -63,29 +85,101 @@ func (s *Scheduler) toLowerStrings(arr []string) []string {
 }
 
 // initHotFilter initializes the hot filtering in a Scheduler structure
-// matcher uses the aho-corasick algorithm
-func (s *Scheduler) initHotFilter(files []File) {
-	s.matcher = make(map[string]*ahocorasick.Matcher)
+// matcher uses the aho-corasick algorithm for the keywords
+func (s *Scheduler) initHotFilter(files []File) error {
+	s.matcher = make(map[string]*filter.Matcher)
 	for _, file := range files {
-		file.HotFilter = s.toLowerStrings(file.HotFilter)
-		s.matcher[file.Filename] = ahocorasick.NewStringMatcher(file.HotFilter)
+		if err := s.addHotFilter(file); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// addHotFilter adds the matcher of the file
+func (s *Scheduler) addHotFilter(file File) error {
+	matcher, err := newHotFilter(file)
+	if err == nil {
+		s.matcher[file.Filename] = matcher
+	}
+	return err
+}
+
+// newHotFilter makes the matcher of the file
+// The hotFilter keywords are the case-insensitive keyword rules named by themselves.
+func newHotFilter(file File) (*filter.Matcher, error) {
+	rules := []filter.Rule{}
+	for _, keyword := range file.HotFilter {
+		rule, err := filter.NewRule("", filter.TypeKeyword, keyword, false, false, false)
+		if err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	for _, r := range file.HotRules {
+		rule, err := filter.NewRule(r.Name, r.Type, r.Pattern, r.WholeWord, r.CaseSensitive, r.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hot rule (filename: %s): %v", file.Filename, err)
+		}
+		rules = append(rules, rule)
+	}
+	return filter.NewMatcher(rules), nil
+}
+
+// newMultilineRule converts the multiline configuration to the multiline.Rule
+func newMultilineRule(m *Multiline) (multiline.Rule, error) {
+	timeout := time.Duration(m.FlushTimeout) * time.Millisecond
+	return multiline.NewRule(m.StartPattern, m.ContinuationPattern, m.Indentation, m.MaxLines, timeout)
+}
+
+// initMultiline initializes the line aggregators of the files which have the multiline rules
+func (s *Scheduler) initMultiline(files []File) error {
+	s.aggregators = make(map[string]*multiline.Aggregator)
+	for _, file := range files {
+		if err := s.addMultiline(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMultiline adds the line aggregator of the file if it has the multiline rule
+func (s *Scheduler) addMultiline(file File) error {
+	aggregator, err := s.newAggregator(file)
+	if aggregator != nil {
+		s.aggregators[file.Filename] = aggregator
+	}
+	return err
+}
+
+// newAggregator makes the line aggregator of the file (nil if it doesn't have the multiline rule)
+func (s *Scheduler) newAggregator(file File) (*multiline.Aggregator, error) {
+	if file.Multiline == nil {
+		return nil, nil
+	}
+	rule, err := newMultilineRule(file.Multiline)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multiline rule (filename: %s): %v", file.Filename, err)
+	}
+	return multiline.NewAggregator(rule, s.insertString)
 }
 
 func getConfigFiles(filenames []string, meta File) []File {
 	files := []File{}
 	for _, filename := range filenames {
-		file := File{filename, meta.HotFilter}
+		file := meta
+		file.Filename = filename
 		files = append(files, file)
 	}
 	return files
 }
 
+// configPatternTranslation expands the patterns to the files
+// The pattern which matches nothing is valid because the files can be created later.
 func configPatternTranslation(metaList []File) ([]File, error) {
 	files := []File{}
 	for _, meta := range metaList {
 		matches, err := filepath.Glob(meta.Filename)
-		if len(matches) == 0 || err != nil {
+		if err != nil {
 			return nil, fmt.Errorf("matches error detected (str:%s;err:%v;matches:%v)", meta.Filename, err, matches)
 		}
 		files = append(files, getConfigFiles(matches, meta)...)
@@ -112,13 +206,20 @@ func (s *Scheduler) initConfig(configFilepath string) error {
 		goto out
 	}
 
-	s.config.Files, err = configPatternTranslation(s.config.Files)
+	for i := range s.config.Files {
+		s.config.Files[i].HotFilter = s.toLowerStrings(s.config.Files[i].HotFilter)
+	}
+	s.patterns = s.config.Files
+	if err = validatePatterns(s.patterns); err != nil {
+		goto out
+	}
+	s.config.Files, err = configPatternTranslation(s.patterns)
 	if err != nil {
 		goto out
 	}
 
-	if len(s.config.Files) == 0 || len(s.config.Files) >= 256 {
-		err = errors.New("number of files is over 0 and under 256")
+	if len(s.config.Files) >= 256 {
+		err = errors.New("number of files is under 256")
 		goto out
 	}
 
@@ -143,20 +244,109 @@ out:
 	return err
 }
 
+// validatePatterns checks the settings of the patterns
+// The settings are checked before the expansion because the files can be created later.
+func validatePatterns(patterns []File) error {
+	if len(patterns) == 0 {
+		return errors.New("number of files is over 0")
+	}
+	for _, pattern := range patterns {
+		if !isValidStartPosition(pattern.StartPosition) {
+			return fmt.Errorf("invalid start position %q (filename: %s)", pattern.StartPosition, pattern.Filename)
+		}
+		if !isValidWatcherBackend(pattern.WatcherBackend) {
+			return fmt.Errorf("invalid watcher backend %q (filename: %s)", pattern.WatcherBackend, pattern.Filename)
+		}
+		if _, err := newHotFilter(pattern); err != nil {
+			return err
+		}
+		if pattern.Multiline == nil {
+			continue
+		}
+		if _, err := newMultilineRule(pattern.Multiline); err != nil {
+			return fmt.Errorf("invalid multiline rule (filename: %s): %v", pattern.Filename, err)
+		}
+	}
+	return nil
+}
+
+// validateRetry checks the retry and circuit breaker settings of the transport
+func validateRetry(config Config) error {
+	if config.RetryMaxAttempts < 1 {
+		return errors.New("retry max attempts must be over 0")
+	}
+	if config.RetryInitial > config.RetryMax {
+		return fmt.Errorf("retry initial backoff must be below the max backoff (initial: %dms, max: %dms)", config.RetryInitial, config.RetryMax)
+	}
+	if config.RetryJitter > 100 {
+		return fmt.Errorf("retry jitter must be below 100%% (current: %d%%)", config.RetryJitter)
+	}
+	return nil
+}
+
+// isValidStartPosition checks the start position is supported by the buffering package
+func isValidStartPosition(start string) bool {
+	switch start {
+	case "", buffering.StartAtResume, buffering.StartAtEnd, buffering.StartAtBeginning:
+		return true
+	}
+	return false
+}
+
+// isValidWatcherBackend checks the backend is supported by the watcher package
+func isValidWatcherBackend(backend string) bool {
+	switch backend {
+	case "", w.BackendFsnotify, w.BackendPolling:
+		return true
+	}
+	return false
+}
+
+// initCheckpoint loads the checkpoint registry if the path is specified
+func (s *Scheduler) initCheckpoint() error {
+	var err error
+	if len(s.config.CheckpointPath) == 0 {
+		return nil
+	}
+	s.checkpoint, err = checkpoint.Open(s.config.CheckpointPath)
+	if err != nil {
+		return err
+	}
+	s.checkpoint.SetSaveInterval(time.Duration(s.config.CheckpointInterval) * time.Millisecond)
+	return nil
+}
+
 // initWatcher initializes the watcher package in a Scheduler structure
 func (s *Scheduler) initWatcher() error {
 	watcher, err := w.NewWatcher()
 	s.watcher = watcher
-	return err
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(s.config.WatcherPolling) * time.Millisecond
+	return s.watcher.SetBackend(s.config.WatcherBackend, interval)
 }
 
 // Close returns the resource related on the scheduling
+// The readers are stopped while the rings are still consumed, and the lines left
+// in the rings are submitted before the rings are disposed.
 func (s *Scheduler) Close() {
+	s.close(true)
+}
+
+// Abort returns the resource without submitting the lines left in the rings
+// It is called by the failed submit function, so it doesn't wait for the consumer.
+func (s *Scheduler) Abort() {
+	s.close(false)
+}
+
+// close returns the resource and submits the lines left in the rings if drain is set
+func (s *Scheduler) close(drain bool) {
 	if s == nil {
 		return
 	}
-	atomic.StoreInt32(&s.IsRun, 0)
 	if s.watcher == nil {
+		atomic.StoreInt32(&s.IsRun, 0)
 		return
 	}
 	select {
@@ -167,9 +357,27 @@ func (s *Scheduler) Close() {
 	default:
 		break
 	}
-	s.hot.Close()
-	s.cold.Close()
-	s.watcher.Close()
+	if drain {
+		running := atomic.LoadInt32(&s.IsRun) == 1
+		s.watcher.Close()
+		s.closeAggregators()
+		if s.stop(running) {
+			s.drain()
+		}
+		s.hot.Close()
+		s.cold.Close()
+	} else {
+		s.stop(false)
+		s.hot.Close()
+		s.cold.Close()
+		s.watcher.Close()
+		s.closeAggregators()
+	}
+	s.hotLane.close()
+	s.coldLane.close()
+	if err := s.checkpoint.Close(); err != nil {
+		log.Println("checkpoint save failed:", err)
+	}
 	defer func() {
 		recover()
 	}()
@@ -185,3 +393,10 @@ func (s *Scheduler) Close() {
 	default:
 	}
 }
+
+// closeAggregators flushes the pending multiline events into the rings
+func (s *Scheduler) closeAggregators() {
+	for _, aggregator := range s.aggregators {
+		aggregator.Close()
+	}
+}
@@ -2,8 +2,10 @@ package scheduler
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,6 +15,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/ring"
+	"github.com/soyoslab/soy_log_generator/pkg/spool"
 	w "github.com/soyoslab/soy_log_generator/pkg/watcher"
 )
 
@@ -112,7 +118,7 @@ func getSubmit() SubmitOperations {
 	cold := func(message []Message) error {
 		return nil
 	}
-	submit := SubmitOperations{hot, cold}
+	submit := SubmitOperations{Hot: hot, Cold: cold}
 	return submit
 }
 
@@ -172,11 +178,107 @@ func TestPatternFilesInvalid(t *testing.T) {
 		}
 		return false
 	}
-	filenames, config := getPatternConfig(os.TempDir() + string(os.PathSeparator) + "*pattern-test.txt")
+	filenames, config := getPatternConfig(os.TempDir() + string(os.PathSeparator) + "[pattern-test.txt")
 	defer teardown(filenames)
 	fileContentsTest(t, getSubmit(), "pattern-invalid-test", config, evalFunc)
 }
 
+func TestPatternFilesEmpty(t *testing.T) {
+	evalFunc := func(s *Scheduler, err error) bool {
+		return err != nil || len(s.GetConfig().Files) != 0
+	}
+	filenames, config := getPatternConfig(os.TempDir() + string(os.PathSeparator) + "*pattern-test.txt")
+	defer teardown(filenames)
+	fileContentsTest(t, getSubmit(), "pattern-empty-test", config, evalFunc)
+}
+
+func TestPatternRescan(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pattern-rescan")
+	if err != nil {
+		log.Fatalf("temporary directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	config := fmt.Sprintf(ConfigText, 1, 2, filepath.Join(dir, "*.log"))
+	testFilename, filename := setup("pattern-rescan-test", config)
+	defer teardown([]string{testFilename, filename})
+
+	initialized := make(chan []File, 4)
+	submit := getSubmit()
+	submit.Init = func(files []File) error {
+		initialized <- files
+		return nil
+	}
+	s, err := InitScheduler(filename, submit, nil)
+	if err != nil {
+		t.Fatalf("scheduler generation failed %v", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	logFile := filepath.Join(dir, "app.log")
+	for start := time.Now(); atomic.LoadInt32(&s.IsRun) == 0 && time.Since(start) < time.Second*5; {
+		time.Sleep(time.Millisecond)
+	}
+	os.WriteFile(filepath.Join(dir, "app.txt"), []byte{}, 0644)
+	os.WriteFile(logFile, []byte("error\n"), 0644)
+	select {
+	case files := <-initialized:
+		if len(files) != 1 || files[0].Filename != logFile {
+			t.Errorf("new file isn't added %v", files)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("new file isn't detected")
+	}
+
+	os.Remove(logFile)
+	select {
+	case files := <-initialized:
+		if len(files) != 0 {
+			t.Errorf("removed file isn't removed %v", files)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("removed file isn't detected")
+	}
+}
+
+func TestPatternStartPosition(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pattern-start")
+	if err != nil {
+		log.Fatalf("temporary directory creation failed")
+	}
+	defer os.RemoveAll(dir)
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","startPosition":"end"}]}`, filepath.Join(dir, "*.log"))
+	testFilename, filename := setup("pattern-start-test", config)
+	defer teardown([]string{testFilename, filename})
+	s, err := InitScheduler(filename, getSubmit(), nil)
+	if err != nil {
+		t.Fatalf("scheduler generation failed %v", err)
+	}
+	defer s.Close()
+
+	offset := func(name string) int64 {
+		info, err := s.getWatcher().GetFileInfo(name)
+		if err != nil {
+			t.Fatalf("file isn't added %s", name)
+		}
+		offset, _ := info.GetBuffer().GetFile().Seek(0, io.SeekCurrent)
+		return offset
+	}
+	existing, created := filepath.Join(dir, "existing.log"), filepath.Join(dir, "created.log")
+	os.WriteFile(existing, []byte("old\n"), 0644)
+	if err = s.rescanPatterns(); err != nil {
+		t.Fatalf("rescan failed %v", err)
+	}
+	if offset(existing) != 4 {
+		t.Errorf("existing file doesn't start at the pattern's start position")
+	}
+	os.WriteFile(created, []byte("new\n"), 0644)
+	s.directoryEvent(fsnotify.Event{Name: created, Op: fsnotify.Create})
+	if offset(created) != 0 {
+		t.Errorf("created file doesn't start at the beginning")
+	}
+}
+
 func TestInitScheduler(t *testing.T) {
 	evalFunc := func(s *Scheduler, err error) bool {
 		return s == nil || err != nil
@@ -307,7 +409,7 @@ func TestRun(t *testing.T) {
 		}
 		return nil
 	}
-	submit := SubmitOperations{hot, cold}
+	submit := SubmitOperations{Hot: hot, Cold: cold}
 	s, _ := InitScheduler(filename, submit, nil)
 	go background(s)
 	go counter(t, &hotCounter, &coldCounter, s)
@@ -321,3 +423,514 @@ func TestMain(m *testing.M) {
 	}
 	os.Exit(m.Run())
 }
+
+func TestInvalidStartPosition(t *testing.T) {
+	evalFunc := func(_ *Scheduler, err error) bool { return err == nil }
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotFilter":["error"],"startPosition":"middle"}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-start-position", config, evalFunc)
+}
+
+func TestCheckpointPath(t *testing.T) {
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	checkpointPath := testFile.Name() + ".checkpoint"
+	defer teardown([]string{testFile.Name(), checkpointPath})
+	config := fmt.Sprintf(`{"checkpointPath":"%v","files":[{"filename":"%v","hotFilter":["error"]}]}`, checkpointPath, testFile.Name())
+	testFilename, filename := setup("watcher-test-checkpoint-path", config)
+	defer teardown([]string{testFilename, filename})
+	s, err := InitScheduler(filename, getSubmit(), nil)
+	if err != nil {
+		t.Fatalf("checkpoint scheduler generation failed %v", err)
+	}
+	s.registFilesToWatcher()
+	s.getWatcher().ProcessFile(testFile.Name())
+	s.Close()
+	if _, err = os.Stat(checkpointPath); err != nil {
+		t.Errorf("checkpoint file isn't saved %v", err)
+	}
+}
+
+func TestInvalidMultiline(t *testing.T) {
+	evalFunc := func(_ *Scheduler, err error) bool { return err == nil }
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotFilter":["error"],"multiline":{"startPattern":"("}}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-multiline", config, evalFunc)
+}
+
+func TestMultiline(t *testing.T) {
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotFilter":["panic"],"multiline":{"indentation":true}}]}`, testFile.Name())
+	testFilename, filename := setup("watcher-test-multiline", config)
+	defer teardown([]string{testFilename, filename})
+	s, err := InitScheduler(filename, getSubmit(), nil)
+	if err != nil {
+		t.Fatalf("multiline scheduler generation failed %v", err)
+	}
+	defer s.Close()
+	aggregate := s.processLine
+	aggregate("panic: runtime error\n", []interface{}{testFile.Name()})
+	aggregate("\tmain.main()\n", []interface{}{testFile.Name()})
+	aggregate("next\n", []interface{}{testFile.Name()})
+	messages := s.hot.Poll()
+	for start := time.Now(); len(messages) == 0 && time.Since(start) < time.Second*5; {
+		messages = s.hot.Poll()
+	}
+	if len(messages) != 1 || string(messages[0].(Message).Data) != "panic: runtime error\n\tmain.main()" {
+		t.Errorf("stack trace isn't classified as a single hot event %v", messages)
+	}
+}
+
+func TestCloseMultiline(t *testing.T) {
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotFilter":["panic"],"multiline":{"indentation":true}}]}`, testFile.Name())
+	testFilename, filename := setup("watcher-test-close-multiline", config)
+	defer teardown([]string{testFilename, filename})
+	events := []string{}
+	submit := getSubmit()
+	submit.Hot = func(messages []Message) error {
+		for _, message := range messages {
+			events = append(events, string(message.Data))
+		}
+		return nil
+	}
+	s, err := InitScheduler(filename, submit, nil)
+	if err != nil {
+		t.Fatalf("multiline scheduler generation failed %v", err)
+	}
+	s.processLine("panic: runtime error\n", []interface{}{testFile.Name()})
+	s.processLine("\tmain.main()\n", []interface{}{testFile.Name()})
+	s.Close()
+	if len(events) != 1 || events[0] != "panic: runtime error\n\tmain.main()" {
+		t.Errorf("pending multiline event is lost on close %v", events)
+	}
+}
+
+func TestInvalidWatcherBackend(t *testing.T) {
+	evalFunc := func(_ *Scheduler, err error) bool { return err == nil }
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotFilter":["error"],"watcherBackend":"nfs"}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-file-backend", config, evalFunc)
+	config = fmt.Sprintf(`{"watcherBackend":"nfs","files":[{"filename":"%v","hotFilter":["error"]}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-backend", config, evalFunc)
+}
+
+func writeConfig(filename string, configText string) {
+	configText = strings.Replace(configText, "\\", "\\\\", -1)
+	if err := os.WriteFile(filename, []byte(configText), 0644); err != nil {
+		log.Fatalf("config file write failed => %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	testFile1, _ := os.CreateTemp("", "test1.txt")
+	testFile2, _ := os.CreateTemp("", "test2.txt")
+	defer teardown([]string{testFile1.Name(), testFile2.Name()})
+	config := fmt.Sprintf(`{"coldTimeoutMilli":1000,"files":[{"filename":"%v","hotFilter":["error"]}]}`, testFile1.Name())
+	testFilename, filename := setup("watcher-test-reload", config)
+	defer teardown([]string{testFilename, filename})
+
+	initialized := make(chan []File, 4)
+	submit := getSubmit()
+	submit.Init = func(files []File) error {
+		initialized <- files
+		return nil
+	}
+	s, err := InitScheduler(filename, submit, nil)
+	if err != nil {
+		t.Fatalf("scheduler generation failed %v", err)
+	}
+	defer s.Close()
+	s.registFilesToWatcher()
+	s.watchPatterns()
+
+	config = fmt.Sprintf(`{"coldTimeoutMilli":2000,"hotRingCapacity":64,"files":[{"filename":"%v","hotFilter":["WARN"]},{"filename":"%v","hotFilter":["error"]}]}`,
+		testFile1.Name(), testFile2.Name())
+	writeConfig(filename, config)
+	if err = s.Reload(filename); err != nil {
+		t.Fatalf("reload failed %v", err)
+	}
+	if s.GetConfig().ColdTimeout != 2000 {
+		t.Errorf("cold timeout isn't changed %v", s.GetConfig().ColdTimeout)
+	}
+	if s.GetConfig().HotRingCapacity != 32 {
+		t.Errorf("hot ring capacity is changed without the restart %v", s.GetConfig().HotRingCapacity)
+	}
+	if !s.isHotString(testFile1.Name(), "warn") || s.isHotString(testFile1.Name(), "error") {
+		t.Errorf("hot filter isn't rebuilt")
+	}
+	select {
+	case files := <-initialized:
+		if len(files) != 2 {
+			t.Errorf("new file isn't added %v", files)
+		}
+	default:
+		t.Errorf("file map isn't sent")
+	}
+}
+
+func TestReloadRedaction(t *testing.T) {
+	output := strings.Builder{}
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	current := Config{ColdTimeout: 1000}
+	next := Config{ColdTimeout: 2000, Sinks: []Sink{{Name: "loki", Type: "loki", Headers: map[string]string{"Authorization": "Bearer secret-token"}}}}
+	if config := mergeConfig(current, next); len(config.Sinks) != 0 {
+		t.Errorf("sinks are changed without the restart %v", config.Sinks)
+	}
+	if strings.Contains(output.String(), "secret-token") {
+		t.Errorf("sink headers are logged %q", output.String())
+	}
+	if !strings.Contains(output.String(), "config sinks is changed") || !strings.Contains(output.String(), "1000 -> 2000") {
+		t.Errorf("changed fields aren't logged %q", output.String())
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	testFile, _ := os.CreateTemp("", "test1.txt")
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotFilter":["error"]}]}`, testFile.Name())
+	testFilename, filename := setup("watcher-test-reload-invalid", config)
+	defer teardown([]string{testFilename, filename})
+	s, err := InitScheduler(filename, getSubmit(), nil)
+	if err != nil {
+		t.Fatalf("scheduler generation failed %v", err)
+	}
+	defer s.Close()
+
+	invalids := []string{
+		fmt.Sprintf(`{"pollingIntervalMilli":2000,"files":[{"filename":"%v"}]}`, testFile.Name()),
+		fmt.Sprintf(`{"files":[{"filename":"%v","multiline":{"startPattern":"("}}]}`, testFile.Name()),
+		`{"files":[]}`,
+		`{"files":`,
+	}
+	for _, invalid := range invalids {
+		writeConfig(filename, invalid)
+		if err = s.Reload(filename); err == nil {
+			t.Errorf("invalid config is applied %v", invalid)
+		}
+		if len(s.GetConfig().Files) != 1 || !s.isHotString(testFile.Name(), "error") {
+			t.Errorf("current config isn't kept %v", s.GetConfig())
+		}
+	}
+}
+
+func TestHotRules(t *testing.T) {
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotFilter":["critical"],"hotRules":[`+
+		`{"name":"error","pattern":"error","wholeWord":true},{"pattern":"level=debug","exclude":true}]}]}`, testFile.Name())
+	testFilename, filename := setup("watcher-test-hot-rules", config)
+	defer teardown([]string{testFilename, filename})
+	s, err := InitScheduler(filename, getSubmit(), nil)
+	if err != nil {
+		t.Fatalf("hot rules scheduler generation failed %v", err)
+	}
+	defer s.Close()
+	if rule, ok := s.classify(testFile.Name(), "level=info msg=error"); !ok || rule != "error" {
+		t.Errorf("hot rule isn't matched %q", rule)
+	}
+	if s.isHotString(testFile.Name(), "level=info msg=terror") {
+		t.Errorf("whole word rule matches the substring")
+	}
+	if s.isHotString(testFile.Name(), "level=debug msg=critical") {
+		t.Errorf("exclude rule isn't applied")
+	}
+
+	s.insertString("level=info critical\n", []interface{}{testFile.Name()})
+	messages := s.hot.Poll()
+	for start := time.Now(); len(messages) == 0 && time.Since(start) < time.Second*5; {
+		messages = s.hot.Poll()
+	}
+	if len(messages) != 1 || messages[0].(Message).Info.Rule != "critical" {
+		t.Errorf("rule name isn't attached to the message %v", messages)
+	}
+}
+
+func TestInvalidHotRule(t *testing.T) {
+	evalFunc := func(_ *Scheduler, err error) bool { return err == nil }
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"files":[{"filename":"%v","hotRules":[{"type":"regex","pattern":"("}]}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-hot-rule", config, evalFunc)
+}
+
+func getOverflowScheduler(t *testing.T, policy string, submit SubmitOperations) (*Scheduler, string, func()) {
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	spillPath := testFile.Name() + ".spill"
+	config := fmt.Sprintf(`{"coldRingCapacity":2,"coldOverflowPolicy":"%s","spillPath":"%v","pollingIntervalMilli":10,`+
+		`"files":[{"filename":"%v","hotFilter":["error"]}]}`, policy, spillPath, testFile.Name())
+	testFilename, filename := setup("watcher-test-overflow", config)
+	s, err := InitScheduler(filename, submit, nil)
+	if err != nil {
+		t.Fatalf("overflow scheduler generation failed %v", err)
+	}
+	return s, testFile.Name(), func() {
+		s.Close()
+		os.RemoveAll(spillPath)
+		teardown([]string{testFile.Name(), testFilename, filename})
+	}
+}
+
+func insertLines(s *Scheduler, filename string, count int) {
+	for i := 0; i < count; i++ {
+		s.insertString(fmt.Sprintf("line-%d", i), []interface{}{filename})
+	}
+}
+
+func getLines(values []interface{}) []string {
+	lines := []string{}
+	for _, v := range values {
+		lines = append(lines, string(v.(Message).Data))
+	}
+	return lines
+}
+
+func TestOverflowDrop(t *testing.T) {
+	s, filename, cleanup := getOverflowScheduler(t, OverflowDropNewest, getSubmit())
+	insertLines(s, filename, 5)
+	if lines := getLines(s.cold.Poll()); fmt.Sprint(lines) != "[line-0 line-1]" {
+		t.Errorf("newest lines aren't dropped %v", lines)
+	}
+	if s.GetOverflowStats().ColdDropped != 3 {
+		t.Errorf("invalid dropped count %v", s.GetOverflowStats())
+	}
+	cleanup()
+
+	s, filename, cleanup = getOverflowScheduler(t, OverflowDropOldest, getSubmit())
+	defer cleanup()
+	insertLines(s, filename, 5)
+	if lines := getLines(s.cold.Poll()); fmt.Sprint(lines) != "[line-3 line-4]" {
+		t.Errorf("oldest lines aren't dropped %v", lines)
+	}
+	if s.GetOverflowStats().ColdDropped != 3 {
+		t.Errorf("invalid dropped count %v", s.GetOverflowStats())
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	s, filename, cleanup := getOverflowScheduler(t, OverflowBlock, getSubmit())
+	defer cleanup()
+	done := make(chan bool)
+	go func() {
+		insertLines(s, filename, 3)
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Fatalf("reader isn't blocked")
+	case <-time.After(time.Millisecond * 50):
+	}
+	lines := getLines(s.cold.Pop(1))
+	<-done
+	lines = append(lines, getLines(s.cold.Poll())...)
+	if fmt.Sprint(lines) != "[line-0 line-1 line-2]" {
+		t.Errorf("blocked line is lost %v", lines)
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	lines, sequences := []string{}, []uint64{}
+	submit := getSubmit()
+	submit.Cold = func(messages []Message) error {
+		for _, message := range messages {
+			lines = append(lines, string(message.Data))
+			sequences = append(sequences, message.Info.Sequence)
+		}
+		return nil
+	}
+	s, filename, cleanup := getOverflowScheduler(t, OverflowSpill, submit)
+	defer cleanup()
+	insertLines(s, filename, 5)
+	if s.GetOverflowStats().ColdSpilled != 3 {
+		t.Errorf("invalid spilled count %v", s.GetOverflowStats())
+	}
+	for i := 0; i < 3; i++ {
+		s.processCold(s.GetConfig())
+	}
+	if fmt.Sprint(lines) != "[line-0 line-1 line-2 line-3 line-4]" {
+		t.Errorf("spilled lines aren't submitted in order %v", lines)
+	}
+	if fmt.Sprint(sequences) != "[1 2 3 4 5]" {
+		t.Errorf("line sequences of the read order are lost %v", sequences)
+	}
+}
+
+func TestSpillTickets(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-spill-tickets")
+	if err != nil {
+		log.Fatalf("spill directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file, _ := os.Create(filepath.Join(dir, "test1.txt"))
+	defer file.Close()
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	tracker := checkpoint.NewTracker(registry, file.Name(), file)
+	messages := make([]Message, 4)
+	for i := range messages {
+		messages[i] = Message{Data: []byte(fmt.Sprintf("line-%d", i)), Ticket: tracker.At(int64(i+1) * 7).Track()}
+	}
+	b, _ := json.Marshal(messages[0])
+
+	r := ring.Ring{}
+	r.Init(2, "cold")
+	l, err := newLane(&r, OverflowSpill, Config{SpillPath: dir, SpillMaxBytes: uint64(len(b)) * 3 / 2, OverflowSampleRate: 1})
+	if err != nil {
+		t.Fatalf("spill lane generation failed %v", err)
+	}
+	defer l.close()
+	for _, message := range messages[:3] {
+		if err = l.insert(message, time.Millisecond*10); err != nil {
+			t.Fatalf("line isn't spilled %v", err)
+		}
+	}
+	if tracker.Pending() != 4 {
+		t.Errorf("spilled line is done before it is submitted (pending: %d)", tracker.Pending())
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- l.insert(messages[3], time.Millisecond*10)
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("reader isn't blocked by the full spill %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	r.Pop(1)
+	if err = l.refill(); err != nil {
+		t.Fatalf("spilled line refill failed %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("blocked line isn't spilled %v", err)
+	}
+	values := r.Poll()
+	if len(values) != 2 || values[1].(Message).Ticket != messages[2].Ticket {
+		t.Errorf("refilled line loses its ticket %v", values)
+	}
+	if atomic.LoadUint64(&l.dropped) != 0 {
+		t.Errorf("line is dropped by the full spill (dropped: %d)", l.dropped)
+	}
+}
+
+func TestSpillLargeLine(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-spill-large-line")
+	if err != nil {
+		log.Fatalf("spill directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := ring.Ring{}
+	r.Init(2, "cold")
+	l, err := newLane(&r, OverflowSpill, Config{SpillPath: dir, OverflowSampleRate: 1})
+	if err != nil {
+		t.Fatalf("spill lane generation failed %v", err)
+	}
+	defer l.close()
+	for i := 0; i < 3; i++ {
+		if err = l.insert(Message{Data: []byte(fmt.Sprintf("line-%d", i))}, time.Millisecond*10); err != nil {
+			t.Fatalf("line isn't spilled %v", err)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- l.insert(Message{Data: make([]byte, spool.DefaultSegmentSize)}, time.Millisecond*10)
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("large line doesn't wait for the spilled lines %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	lines := getLines(r.Pop(2))
+	if err = l.refill(); err != nil {
+		t.Fatalf("spilled line refill failed %v", err)
+	}
+	lines = append(lines, getLines(r.Pop(1))...)
+	if err = <-done; err != nil {
+		t.Fatalf("large line stops the reader %v", err)
+	}
+	values := r.Poll()
+	if fmt.Sprint(lines) != "[line-0 line-1 line-2]" || len(values) != 1 || len(values[0].(Message).Data) != spool.DefaultSegmentSize {
+		t.Errorf("large line isn't inserted after the spilled lines %v (%d)", lines, len(values))
+	}
+	if atomic.LoadUint64(&l.dropped) != 0 {
+		t.Errorf("large line is dropped (dropped: %d)", l.dropped)
+	}
+}
+
+func TestCloseDrain(t *testing.T) {
+	lines := []string{}
+	submit := getSubmit()
+	submit.Cold = func(messages []Message) error {
+		for _, message := range messages {
+			lines = append(lines, string(message.Data))
+		}
+		return nil
+	}
+	s, filename, cleanup := getOverflowScheduler(t, OverflowBlock, submit)
+	defer cleanup()
+	insertLines(s, filename, 2)
+	s.Close()
+	if fmt.Sprint(lines) != "[line-0 line-1]" {
+		t.Errorf("lines in the ring are lost on close %v", lines)
+	}
+}
+
+func TestInvalidOverflowPolicy(t *testing.T) {
+	evalFunc := func(_ *Scheduler, err error) bool { return err == nil }
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"hotOverflowPolicy":"ignore","files":[{"filename":"%v"}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-overflow", config, evalFunc)
+	config = fmt.Sprintf(`{"coldOverflowPolicy":"spill","files":[{"filename":"%v"}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-spill-without-path", config, evalFunc)
+}
+
+func TestInvalidRetry(t *testing.T) {
+	evalFunc := func(_ *Scheduler, err error) bool { return err == nil }
+	testFile, err := os.CreateTemp("", "test1.txt")
+	if err != nil {
+		log.Fatalf("temproary file-1 creation failed")
+	}
+	defer teardown([]string{testFile.Name()})
+	config := fmt.Sprintf(`{"retryMaxAttempts":0,"files":[{"filename":"%v"}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-zero-attempts", config, evalFunc)
+	config = fmt.Sprintf(`{"retryInitialBackoffMilli":2000,"retryMaxBackoffMilli":1000,"files":[{"filename":"%v"}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-backoff", config, evalFunc)
+	config = fmt.Sprintf(`{"retryJitterPercent":101,"files":[{"filename":"%v"}]}`, testFile.Name())
+	fileContentsTest(t, getSubmit(), "watcher-test-invalid-jitter", config, evalFunc)
+}
@@ -0,0 +1,133 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+// DefaultMaxFiles is the number of the rotated files kept by the file sink
+const DefaultMaxFiles = 5
+
+// File writes the NDJSON records to the file and rotates it by the size
+// The rotated files are named path.1 (the latest) to path.maxFiles.
+type File struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	source   Source
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+// NewFile makes the file sink and opens the file in the append mode
+// MaxBytes zero(0) means the file isn't rotated.
+func NewFile(config s.Sink, source Source) (*File, error) {
+	var err error
+	if len(config.Path) == 0 {
+		return nil, errors.New("path of the file sink must be specified")
+	}
+	f := &File{path: config.Path, maxBytes: int64(config.MaxBytes), maxFiles: int(config.MaxFiles), source: source}
+	if f.maxFiles == 0 {
+		f.maxFiles = DefaultMaxFiles
+	}
+	if err = f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file and records its size
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, stat.Size()
+	return nil
+}
+
+// rotate renames the file to path.1 after shifting the rotated files and opens the new file
+// The oldest file is removed.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	err := os.Rename(f.path, f.path+".1")
+	if openErr := f.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// Init does nothing because the records have the filenames
+func (f *File) Init(files []s.File) error {
+	return nil
+}
+
+// Send appends the records of the messages to the file
+// The file is rotated before the records make it exceed the maximum size.
+func (f *File) Send(class string, messages []s.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	b, err := EncodeNDJSON(class, messages, f.source)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return os.ErrClosed
+	}
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxBytes {
+		if err = f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	Acknowledge(messages)
+	return nil
+}
+
+// Flush commits the written records to the disk
+func (f *File) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// Close flushes and closes the file
+func (f *File) Close() error {
+	err := f.Flush()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return err
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	return err
+}
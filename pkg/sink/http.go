@@ -0,0 +1,246 @@
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	c "github.com/soyoslab/soy_log_generator/pkg/compressor"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+const (
+	// FormatNDJSON posts the records separated by the newline
+	FormatNDJSON = "ndjson"
+	// FormatJSON posts the array of the records
+	FormatJSON = "json"
+)
+
+const (
+	// DefaultHTTPTimeout is the timeout of the HTTP request
+	DefaultHTTPTimeout = time.Duration(5000) * time.Millisecond
+	// defaultHTTPCompression is the codec of the NDJSON body
+	defaultHTTPCompression = "gzip"
+	// DefaultRetries is the number of the retries of the post which fails by 429 or 5xx
+	DefaultRetries = 5
+	// DefaultRetryBackoff is the first delay of the retries, which is doubled on every retry
+	DefaultRetryBackoff = time.Duration(500) * time.Millisecond
+	// maxRetryBackoff bounds the delay of the retries
+	maxRetryBackoff = time.Duration(30) * time.Second
+)
+
+// retrier posts the body again when it fails by the connection error, 429 or 5xx
+// The wait for the retry is interrupted when the sink is closed.
+type retrier struct {
+	retries   int
+	backoff   time.Duration
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+// HTTP posts the records of the messages to the HTTP endpoint
+// The NDJSON body is compressed by the codec and the codec's name is sent as the Content-Encoding.
+type HTTP struct {
+	url        string
+	format     string
+	headers    map[string]string
+	encoding   string
+	retry      *retrier
+	compressor c.Compressor
+	client     *http.Client
+	source     Source
+}
+
+// NewHTTP makes the HTTP sink
+// Format is one of "ndjson" and "json" (default: ndjson), and Compression applies to ndjson
+// (default: gzip, "none" disables it). The post is retried by MaxRetries and RetryBackoff.
+func NewHTTP(config s.Sink, source Source) (*HTTP, error) {
+	var err error
+	h := &HTTP{url: config.URL, format: config.Format, headers: config.Headers, retry: newRetrier(config), source: source}
+	if len(h.url) == 0 {
+		return nil, errors.New("url of the http sink must be specified")
+	}
+	if len(h.format) == 0 {
+		h.format = FormatNDJSON
+	}
+	switch h.format {
+	case FormatNDJSON:
+		h.encoding = config.Compression
+		if len(h.encoding) == 0 {
+			h.encoding = defaultHTTPCompression
+		}
+		if h.encoding == "none" {
+			h.encoding = ""
+			break
+		}
+		h.compressor, err = c.New(h.encoding, 0)
+		if err != nil {
+			return nil, err
+		}
+	case FormatJSON:
+		if len(config.Compression) != 0 && config.Compression != "none" {
+			return nil, fmt.Errorf("json format of the http sink can't be compressed (compression: %s)", config.Compression)
+		}
+	default:
+		return nil, fmt.Errorf("invalid http sink format %q", h.format)
+	}
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	h.client = &http.Client{Timeout: timeout}
+	return h, nil
+}
+
+// Init does nothing because the records have the filenames
+func (h *HTTP) Init(files []s.File) error {
+	return nil
+}
+
+// encode returns the body of the messages and its content type
+func (h *HTTP) encode(class string, messages []s.Message) ([]byte, string, error) {
+	if h.format == FormatJSON {
+		b, err := EncodeJSON(class, messages, h.source)
+		return b, "application/json", err
+	}
+	b, err := EncodeNDJSON(class, messages, h.source)
+	if err != nil || h.compressor == nil {
+		return b, "application/x-ndjson", err
+	}
+	b, err = h.compressor.Compress(b)
+	return b, "application/x-ndjson", err
+}
+
+// Send posts the records of the messages
+// The post which fails by the connection error, 429 or 5xx is retried, and the other
+// responses except 2xx are the errors.
+func (h *HTTP) Send(class string, messages []s.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	body, contentType, err := h.encode(class, messages)
+	if err != nil {
+		return err
+	}
+	if err = h.retry.post(TypeHTTP, h.client, h.url, body, contentType, h.encoding, h.headers); err != nil {
+		return err
+	}
+	Acknowledge(messages)
+	return nil
+}
+
+// newRetrier returns the retrier of the sink config
+// Nil MaxRetries uses DefaultRetries, and zero disables the retries.
+func newRetrier(config s.Sink) *retrier {
+	r := &retrier{retries: DefaultRetries, backoff: time.Duration(config.RetryBackoff) * time.Millisecond, closed: make(chan bool)}
+	if config.MaxRetries != nil {
+		r.retries = int(*config.MaxRetries)
+	}
+	if r.backoff == 0 {
+		r.backoff = DefaultRetryBackoff
+	}
+	return r
+}
+
+// isRetryable checks the status code is temporary (429 or 5xx)
+func isRetryable(code int) bool {
+	return code == http.StatusTooManyRequests || code/100 == 5
+}
+
+// retryAfter returns the delay of the Retry-After header in seconds (the backoff if there is none)
+// The delay is bounded by maxRetryBackoff.
+func retryAfter(response *http.Response, backoff time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return backoff
+	}
+	if seconds > int(maxRetryBackoff/time.Second) {
+		return maxRetryBackoff
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// post posts the body with the exponential backoff (or by Retry-After) until the response is 2xx
+// The sink type names the sink in the errors.
+func (r *retrier) post(sinkType string, client *http.Client, url string, body []byte, contentType string, encoding string, headers map[string]string) error {
+	backoff := r.backoff
+	for retry := 0; ; retry++ {
+		response, err := post(client, url, body, contentType, encoding, headers)
+		delay := backoff
+		if err == nil && response.StatusCode/100 == 2 {
+			return nil
+		} else if err == nil {
+			err = fmt.Errorf("%s sink %s replied %s", sinkType, url, response.Status)
+			if !isRetryable(response.StatusCode) {
+				return err
+			}
+			delay = retryAfter(response, backoff)
+		}
+		if retry >= r.retries {
+			return fmt.Errorf("%v (%d retries)", err, retry)
+		}
+		if !r.wait(delay) {
+			return fmt.Errorf("%v (closed after %d retries)", err, retry)
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// post posts the body and returns the response whose body is already read and closed
+func post(client *http.Client, url string, body []byte, contentType string, encoding string, headers map[string]string) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", contentType)
+	if len(encoding) != 0 {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	return response, nil
+}
+
+// wait waits for the delay of the retry and returns false if the sink is closed meanwhile
+func (r *retrier) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-r.closed:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// close interrupts the waits of the retries
+func (r *retrier) close() {
+	r.closeOnce.Do(func() { close(r.closed) })
+}
+
+// Flush does nothing because the records are posted by Send
+func (h *HTTP) Flush() error {
+	return nil
+}
+
+// Close interrupts the retry and closes the idle connections
+func (h *HTTP) Close() error {
+	h.retry.close()
+	h.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,194 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	c "github.com/soyoslab/soy_log_generator/pkg/compressor"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// FormatProtobuf pushes the snappy-compressed protobuf PushRequest of Loki
+const FormatProtobuf = "protobuf"
+
+// lokiStream contains the entries of the messages which have the same labels
+type lokiStream struct {
+	labels  map[string]string
+	entries []s.Message
+}
+
+// Loki pushes the messages to the Grafana Loki push API (/loki/api/v1/push)
+// The stream labels are namespace, hostname, filename and class.
+type Loki struct {
+	url        string
+	format     string
+	headers    map[string]string
+	retry      *retrier
+	compressor c.Compressor
+	client     *http.Client
+	source     Source
+}
+
+// NewLoki makes the Loki sink
+// Format is one of "protobuf" and "json" (default: protobuf).
+func NewLoki(config s.Sink, source Source) (*Loki, error) {
+	l := &Loki{url: config.URL, format: config.Format, headers: config.Headers, source: source}
+	if len(l.url) == 0 {
+		return nil, errors.New("url of the loki sink must be specified")
+	}
+	if len(l.format) == 0 {
+		l.format = FormatProtobuf
+	}
+	switch l.format {
+	case FormatProtobuf:
+		l.compressor = &c.SnappyComp{}
+	case FormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid loki sink format %q", l.format)
+	}
+	l.retry = newRetrier(config)
+	timeout := time.Duration(config.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	l.client = &http.Client{Timeout: timeout}
+	return l, nil
+}
+
+// Init does nothing because the streams have the filenames
+func (l *Loki) Init(files []s.File) error {
+	return nil
+}
+
+// getStreams groups the messages by their labels in the order of their first messages
+func (l *Loki) getStreams(class string, messages []s.Message) []*lokiStream {
+	streams := []*lokiStream{}
+	index := make(map[string]*lokiStream)
+	for _, message := range messages {
+		stream, ok := index[message.Info.Filename]
+		if !ok {
+			stream = &lokiStream{labels: map[string]string{
+				"namespace": l.source.Namespace,
+				"hostname":  l.source.Hostname,
+				"filename":  message.Info.Filename,
+				"class":     class,
+			}}
+			index[message.Info.Filename] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, message)
+	}
+	return streams
+}
+
+// formatLabels returns the labels in the LogQL selector syntax (e.g. {class="hot", filename="a.log"})
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// encodeProtobuf encodes the streams to the PushRequest message of Loki
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream { string labels = 1; repeated Entry entries = 2; }
+//	Entry { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeProtobuf(streams []*lokiStream) []byte {
+	var request []byte
+	for _, stream := range streams {
+		var b []byte
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, formatLabels(stream.labels))
+		for _, message := range stream.entries {
+			var timestamp, entry []byte
+			timestamp = protowire.AppendTag(timestamp, 1, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(message.Info.Timestamp/int64(time.Second)))
+			timestamp = protowire.AppendTag(timestamp, 2, protowire.VarintType)
+			timestamp = protowire.AppendVarint(timestamp, uint64(message.Info.Timestamp%int64(time.Second)))
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, timestamp)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, message.Data)
+			b = protowire.AppendTag(b, 2, protowire.BytesType)
+			b = protowire.AppendBytes(b, entry)
+		}
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, b)
+	}
+	return request
+}
+
+// encodeJSON encodes the streams to the JSON body of the push API
+// The value of the entry is the pair of the unix nanoseconds in string and the line.
+func encodeJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	request := struct {
+		Streams []jsonStream `json:"streams"`
+	}{Streams: make([]jsonStream, len(streams))}
+	for i, stream := range streams {
+		request.Streams[i].Stream = stream.labels
+		for _, message := range stream.entries {
+			request.Streams[i].Values = append(request.Streams[i].Values, [2]string{strconv.FormatInt(message.Info.Timestamp, 10), string(message.Data)})
+		}
+	}
+	return json.Marshal(request)
+}
+
+// encode returns the push request body of the messages and its content type
+// The protobuf body is compressed by the snappy block format as the push API requires.
+func (l *Loki) encode(class string, messages []s.Message) ([]byte, string, error) {
+	streams := l.getStreams(class, messages)
+	if l.format == FormatJSON {
+		b, err := encodeJSON(streams)
+		return b, "application/json", err
+	}
+	b, err := l.compressor.Compress(encodeProtobuf(streams))
+	return b, "application/x-protobuf", err
+}
+
+// Send pushes the messages in the streams of their labels
+// The push which fails by the connection error, 429 or 5xx is retried with the exponential
+// backoff (or by Retry-After), and the other responses except 2xx are the errors.
+func (l *Loki) Send(class string, messages []s.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	body, contentType, err := l.encode(class, messages)
+	if err != nil {
+		return err
+	}
+	if err = l.retry.post(TypeLoki, l.client, l.url, body, contentType, "", l.headers); err != nil {
+		return err
+	}
+	Acknowledge(messages)
+	return nil
+}
+
+// Flush does nothing because the streams are pushed by Send
+func (l *Loki) Flush() error {
+	return nil
+}
+
+// Close interrupts the retry and closes the idle connections
+func (l *Loki) Close() error {
+	l.retry.close()
+	l.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,136 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+const (
+	// Hot is the class of the hot messages
+	Hot = "hot"
+	// Cold is the class of the cold messages
+	Cold = "cold"
+)
+
+const (
+	// TypeCollector submits the packets to the rpcx collector (implemented by the transport)
+	TypeCollector = "collector"
+	// TypeFile writes the NDJSON records to the file which is rotated by its size
+	TypeFile = "file"
+	// TypeStdout writes the NDJSON records to the standard output
+	TypeStdout = "stdout"
+	// TypeHTTP posts the records to the HTTP endpoint
+	TypeHTTP = "http"
+	// TypeLoki pushes the streams to the Grafana Loki push API
+	TypeLoki = "loki"
+)
+
+// Sink delivers the messages of the scheduler to a destination
+// Init is called with the watched files before the first message and whenever they change.
+// Send is called with the messages of a class (Hot or Cold) in the order of the scheduler,
+// and it acknowledges the checkpoint tickets of the messages after they are delivered.
+// Flush writes the buffered messages, and Close flushes and releases the sink.
+type Sink interface {
+	Init(files []s.File) error
+	Send(class string, messages []s.Message) error
+	Flush() error
+	Close() error
+}
+
+// Source contains the origin of the messages written in the records
+type Source struct {
+	Namespace string
+	Hostname  string
+}
+
+// Record is the JSON representation of a message
+// Rule is the name of the hot filtering rule which matched the line.
+type Record struct {
+	Timestamp int64  `json:"timestamp"`
+	Namespace string `json:"namespace"`
+	Hostname  string `json:"hostname"`
+	Filename  string `json:"filename"`
+	Class     string `json:"class"`
+	Rule      string `json:"rule,omitempty"`
+	Line      string `json:"line"`
+}
+
+// New makes the sink of the config except the collector
+// The name of the sink defaults to its type.
+func New(config s.Sink, source Source) (Sink, error) {
+	switch config.Type {
+	case TypeFile:
+		return NewFile(config, source)
+	case TypeStdout:
+		return NewStdout(source), nil
+	case TypeHTTP:
+		return NewHTTP(config, source)
+	case TypeLoki:
+		return NewLoki(config, source)
+	}
+	return nil, fmt.Errorf("invalid sink type %q", config.Type)
+}
+
+// IsValidType checks the sink type is supported
+func IsValidType(sinkType string) bool {
+	switch sinkType {
+	case TypeCollector, TypeFile, TypeStdout, TypeHTTP, TypeLoki:
+		return true
+	}
+	return false
+}
+
+// GetName returns the name of the sink config
+func GetName(config s.Sink) string {
+	if len(config.Name) == 0 {
+		return config.Type
+	}
+	return config.Name
+}
+
+// NewRecord converts the message to the record
+func NewRecord(message s.Message, class string, source Source) Record {
+	return Record{
+		Timestamp: message.Info.Timestamp,
+		Namespace: source.Namespace,
+		Hostname:  source.Hostname,
+		Filename:  message.Info.Filename,
+		Class:     class,
+		Rule:      message.Info.Rule,
+		Line:      string(message.Data),
+	}
+}
+
+// EncodeNDJSON encodes the messages to the records separated by the newline
+func EncodeNDJSON(class string, messages []s.Message, source Source) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := json.NewEncoder(&buffer)
+	for _, message := range messages {
+		if err := encoder.Encode(NewRecord(message, class, source)); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// EncodeJSON encodes the messages to the array of the records
+func EncodeJSON(class string, messages []s.Message, source Source) ([]byte, error) {
+	records := make([]Record, len(messages))
+	for i, message := range messages {
+		records[i] = NewRecord(message, class, source)
+	}
+	return json.Marshal(records)
+}
+
+// Acknowledge makes the checkpoint tickets of the delivered messages done
+func Acknowledge(messages []s.Message) {
+	for _, message := range messages {
+		if err := message.Ticket.Done(); err != nil {
+			log.Println("checkpoint update failed:", err)
+		}
+	}
+}
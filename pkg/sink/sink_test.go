@@ -0,0 +1,407 @@
+package sink_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	c "github.com/soyoslab/soy_log_generator/pkg/compressor"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+	"github.com/soyoslab/soy_log_generator/pkg/sink"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var source = sink.Source{Namespace: "test", Hostname: "host"}
+
+func maxRetries(n uint64) *uint64 {
+	return &n
+}
+
+func messageGeneration(lines ...string) []s.Message {
+	messages := make([]s.Message, len(lines))
+	for i, line := range lines {
+		messages[i].Info = s.FileInfo{Timestamp: int64(i), Filename: "test1.txt", Length: uint64(len(line))}
+		messages[i].Data = []byte(line)
+	}
+	return messages
+}
+
+func decodeNDJSON(t *testing.T, b []byte) []sink.Record {
+	records := []sink.Record{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		record := sink.Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewInvalid(t *testing.T) {
+	configs := []s.Sink{
+		{Type: "kafka"},
+		{Type: sink.TypeCollector},
+		{Type: sink.TypeFile},
+		{Type: sink.TypeHTTP},
+		{Type: sink.TypeHTTP, URL: "http://localhost", Format: "xml"},
+		{Type: sink.TypeHTTP, URL: "http://localhost", Compression: "rar"},
+		{Type: sink.TypeHTTP, URL: "http://localhost", Format: sink.FormatJSON, Compression: "gzip"},
+		{Type: sink.TypeLoki},
+		{Type: sink.TypeLoki, URL: "http://localhost", Format: sink.FormatNDJSON},
+	}
+	for _, config := range configs {
+		if _, err := sink.New(config, source); err == nil {
+			t.Errorf("invalid sink config is accepted %+v", config)
+		}
+	}
+	if sink.GetName(s.Sink{Type: sink.TypeStdout}) != sink.TypeStdout {
+		t.Errorf("sink name doesn't default to the type")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	buffer := bytes.Buffer{}
+	w := sink.NewWriter(&buffer, source)
+	messages := messageGeneration("first", "second")
+	messages[1].Info.Rule = "error"
+	if err := w.Send(sink.Hot, messages); err != nil {
+		t.Fatalf("send failed %v", err)
+	}
+	records := decodeNDJSON(t, buffer.Bytes())
+	expected := sink.Record{Timestamp: 1, Namespace: "test", Hostname: "host", Filename: "test1.txt", Class: sink.Hot, Rule: "error", Line: "second"}
+	if len(records) != 2 || records[0].Line != "first" || records[1] != expected {
+		t.Errorf("invalid records %+v", records)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	dir, err := os.MkdirTemp("", "sink-file-test")
+	if err != nil {
+		t.Fatalf("directory creation failed %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.ndjson")
+	config := s.Sink{Type: sink.TypeFile, Path: path, MaxBytes: 150, MaxFiles: 2}
+	f, err := sink.New(config, source)
+	if err != nil {
+		t.Fatalf("file sink creation failed %v", err)
+	}
+
+	file, _ := os.Open(path)
+	defer file.Close()
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	tracker := checkpoint.NewTracker(registry, path, file)
+	for i := 0; i < 4; i++ {
+		messages := messageGeneration("line")
+		messages[0].Ticket = tracker.At(int64(i)).Track()
+		if err = f.Send(sink.Cold, messages); err != nil {
+			t.Fatalf("send failed %v", err)
+		}
+	}
+	if err = f.Close(); err != nil {
+		t.Errorf("close failed %v", err)
+	}
+	if err = f.Send(sink.Cold, messageGeneration("line")); err == nil {
+		t.Errorf("closed file sink accepts the messages")
+	}
+	if tracker.Pending() != 0 {
+		t.Errorf("written messages aren't acknowledged (pending: %d)", tracker.Pending())
+	}
+
+	total := 0
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("rotated file %s doesn't exist %v", name, err)
+		}
+		if len(b) > 150 {
+			t.Errorf("file %s exceeds the maximum size (%d bytes)", name, len(b))
+		}
+		total += len(decodeNDJSON(t, b))
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("oldest file isn't removed")
+	}
+	if total != 3 {
+		t.Errorf("invalid number of the kept records %d", total)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 4)
+	status := int32(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	config := s.Sink{Type: sink.TypeHTTP, URL: server.URL, Headers: map[string]string{"Authorization": "Bearer token"}}
+	h, err := sink.New(config, source)
+	if err != nil {
+		t.Fatalf("http sink creation failed %v", err)
+	}
+	defer h.Close()
+	if err = h.Send(sink.Hot, messageGeneration("first", "second")); err != nil {
+		t.Fatalf("send failed %v", err)
+	}
+	r := <-requests
+	if r.header.Get("Content-Type") != "application/x-ndjson" || r.header.Get("Content-Encoding") != "gzip" || r.header.Get("Authorization") != "Bearer token" {
+		t.Errorf("invalid headers %v", r.header)
+	}
+	gzip, _ := c.New("gzip", 0)
+	body, err := gzip.Decompress(r.body)
+	if err != nil {
+		t.Fatalf("body isn't compressed %v", err)
+	}
+	if records := decodeNDJSON(t, body); len(records) != 2 || records[1].Line != "second" || records[1].Class != sink.Hot {
+		t.Errorf("invalid records %+v", records)
+	}
+
+	config.Format = sink.FormatJSON
+	h, err = sink.New(config, source)
+	if err != nil {
+		t.Fatalf("http sink creation failed %v", err)
+	}
+	if err = h.Send(sink.Cold, messageGeneration("first")); err != nil {
+		t.Fatalf("send failed %v", err)
+	}
+	r = <-requests
+	records := []sink.Record{}
+	if err = json.Unmarshal(r.body, &records); err != nil || r.header.Get("Content-Encoding") != "" || len(records) != 1 || records[0].Class != sink.Cold {
+		t.Errorf("invalid json body %s (%v)", r.body, err)
+	}
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	config.MaxRetries, config.RetryBackoff = maxRetries(2), 1
+	h, err = sink.New(config, source)
+	if err != nil {
+		t.Fatalf("http sink creation failed %v", err)
+	}
+	if err = h.Send(sink.Cold, messageGeneration("first")); err == nil {
+		t.Errorf("error response is accepted")
+	}
+	if len(requests) != 3 {
+		t.Errorf("temporary error isn't retried (requests: %d)", len(requests))
+	}
+	for len(requests) > 0 {
+		<-requests
+	}
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	if err = h.Send(sink.Cold, messageGeneration("first")); err == nil || len(requests) != 1 {
+		t.Errorf("rejected post is retried (requests: %d, err: %v)", len(requests), err)
+	}
+}
+
+type lokiStream struct {
+	labels     string
+	timestamps []int64
+	lines      []string
+}
+
+// consumeFields calls the function with the numbers and the values of the fields of the protobuf message
+func consumeFields(t *testing.T, b []byte, f func(num protowire.Number, v []byte)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("invalid protobuf tag %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var v []byte
+		if typ == protowire.BytesType {
+			v, n = protowire.ConsumeBytes(b)
+		} else {
+			var x uint64
+			x, n = protowire.ConsumeVarint(b)
+			v = protowire.AppendVarint(nil, x)
+		}
+		if n < 0 {
+			t.Fatalf("invalid protobuf field %v", protowire.ParseError(n))
+		}
+		f(num, v)
+		b = b[n:]
+	}
+}
+
+// decodePushRequest decodes the PushRequest of Loki
+func decodePushRequest(t *testing.T, b []byte) []lokiStream {
+	streams := []lokiStream{}
+	consumeFields(t, b, func(_ protowire.Number, v []byte) {
+		stream := lokiStream{}
+		consumeFields(t, v, func(num protowire.Number, v []byte) {
+			if num == 1 {
+				stream.labels = string(v)
+				return
+			}
+			var timestamp int64
+			consumeFields(t, v, func(num protowire.Number, v []byte) {
+				if num == 2 {
+					stream.lines = append(stream.lines, string(v))
+					return
+				}
+				consumeFields(t, v, func(num protowire.Number, v []byte) {
+					x, _ := protowire.ConsumeVarint(v)
+					if num == 1 {
+						timestamp += int64(x) * 1e9
+					} else {
+						timestamp += int64(x)
+					}
+				})
+			})
+			stream.timestamps = append(stream.timestamps, timestamp)
+		})
+		streams = append(streams, stream)
+	})
+	return streams
+}
+
+func TestLoki(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 16)
+	status := int32(http.StatusNoContent)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+		w.WriteHeader(int(atomic.SwapInt32(&status, http.StatusNoContent)))
+	}))
+	defer server.Close()
+
+	config := s.Sink{Type: sink.TypeLoki, URL: server.URL + "/loki/api/v1/push", Headers: map[string]string{"X-Scope-OrgID": "tenant"}, MaxRetries: maxRetries(2), RetryBackoff: 1}
+	l, err := sink.New(config, source)
+	if err != nil {
+		t.Fatalf("loki sink creation failed %v", err)
+	}
+	defer l.Close()
+	messages := messageGeneration("first", "second", "third")
+	messages[0].Info.Timestamp = 1500000000123456789
+	messages[1].Info.Filename = "test2.txt"
+	if err = l.Send(sink.Hot, messages); err != nil {
+		t.Fatalf("send failed %v", err)
+	}
+	r := <-requests
+	if r.header.Get("Content-Type") != "application/x-protobuf" || r.header.Get("Content-Encoding") != "" || r.header.Get("X-Scope-OrgID") != "tenant" {
+		t.Errorf("invalid headers %v", r.header)
+	}
+	body, err := (&c.SnappyComp{}).Decompress(r.body)
+	if err != nil {
+		t.Fatalf("body isn't compressed by snappy %v", err)
+	}
+	streams := decodePushRequest(t, body)
+	if len(streams) != 2 || streams[0].labels != `{class="hot", filename="test1.txt", hostname="host", namespace="test"}` || streams[1].labels != `{class="hot", filename="test2.txt", hostname="host", namespace="test"}` {
+		t.Fatalf("invalid streams %+v", streams)
+	}
+	if len(streams[0].lines) != 2 || streams[0].lines[0] != "first" || streams[0].lines[1] != "third" || streams[0].timestamps[0] != 1500000000123456789 || streams[0].timestamps[1] != 2 {
+		t.Errorf("invalid entries %+v", streams[0])
+	}
+
+	config.Format = sink.FormatJSON
+	l, err = sink.New(config, source)
+	if err != nil {
+		t.Fatalf("loki sink creation failed %v", err)
+	}
+	if err = l.Send(sink.Cold, messageGeneration("first")); err != nil {
+		t.Fatalf("send failed %v", err)
+	}
+	r = <-requests
+	push := struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]string        `json:"values"`
+		} `json:"streams"`
+	}{}
+	if err = json.Unmarshal(r.body, &push); err != nil || r.header.Get("Content-Type") != "application/json" || len(push.Streams) != 1 {
+		t.Fatalf("invalid json body %s (%v)", r.body, err)
+	}
+	if push.Streams[0].Stream["class"] != sink.Cold || len(push.Streams[0].Values) != 1 || push.Streams[0].Values[0][0] != "0" || push.Streams[0].Values[0][1] != "first" {
+		t.Errorf("invalid json stream %+v", push.Streams[0])
+	}
+
+	atomic.StoreInt32(&status, http.StatusTooManyRequests)
+	if err = l.Send(sink.Cold, messageGeneration("first")); err != nil {
+		t.Errorf("rate limited push isn't retried %v", err)
+	}
+	if len(requests) != 2 {
+		t.Errorf("invalid number of the requests %d", len(requests))
+	}
+	for len(requests) > 0 {
+		<-requests
+	}
+
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	if err = l.Send(sink.Cold, messageGeneration("first")); err == nil {
+		t.Errorf("bad request is accepted")
+	}
+	if len(requests) != 1 {
+		t.Errorf("bad request is retried (requests: %d)", len(requests))
+	}
+	for len(requests) > 0 {
+		<-requests
+	}
+
+	config.MaxRetries = maxRetries(0)
+	l, err = sink.New(config, source)
+	if err != nil {
+		t.Fatalf("loki sink creation failed %v", err)
+	}
+	atomic.StoreInt32(&status, http.StatusTooManyRequests)
+	if err = l.Send(sink.Cold, messageGeneration("first")); err == nil || len(requests) != 1 {
+		t.Errorf("push is retried without the retries (requests: %d, err: %v)", len(requests), err)
+	}
+	for len(requests) > 0 {
+		<-requests
+	}
+
+	server.Close()
+	if err = l.Send(sink.Cold, messageGeneration("first")); err == nil {
+		t.Errorf("push to the closed server is accepted")
+	}
+}
+
+func TestRetryClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	for _, sinkType := range []string{sink.TypeHTTP, sink.TypeLoki} {
+		output, err := sink.New(s.Sink{Type: sinkType, URL: server.URL}, source)
+		if err != nil {
+			t.Fatalf("%s sink creation failed %v", sinkType, err)
+		}
+		done := make(chan error)
+		go func() {
+			done <- output.Send(sink.Hot, messageGeneration("first"))
+		}()
+		time.Sleep(time.Millisecond * 50)
+		output.Close()
+		select {
+		case err = <-done:
+			if err == nil {
+				t.Errorf("%s sink accepts the push interrupted by the close", sinkType)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("close doesn't interrupt the retry of the %s sink", sinkType)
+		}
+	}
+}
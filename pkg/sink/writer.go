@@ -0,0 +1,60 @@
+package sink
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+// Writer writes the NDJSON records to the io.Writer
+type Writer struct {
+	writer io.Writer
+	source Source
+	mutex  sync.Mutex
+}
+
+// NewWriter makes the sink which writes the records to the writer
+func NewWriter(writer io.Writer, source Source) *Writer {
+	return &Writer{writer: writer, source: source}
+}
+
+// NewStdout makes the sink which writes the records to the standard output
+func NewStdout(source Source) *Writer {
+	return NewWriter(os.Stdout, source)
+}
+
+// Init does nothing because the records have the filenames
+func (w *Writer) Init(files []s.File) error {
+	return nil
+}
+
+// Send writes the records of the messages
+func (w *Writer) Send(class string, messages []s.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	b, err := EncodeNDJSON(class, messages, w.source)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	_, err = w.writer.Write(b)
+	w.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	Acknowledge(messages)
+	return nil
+}
+
+// Flush does nothing because the records are written by Send
+func (w *Writer) Flush() error {
+	return nil
+}
+
+// Close does nothing because the writer is owned by the caller
+func (w *Writer) Close() error {
+	return nil
+}
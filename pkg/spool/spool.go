@@ -0,0 +1,445 @@
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSegmentSize is used when the segment size is not specified
+	DefaultSegmentSize = 16 * 1024 * 1024
+	// headerSize is the size of the record's length and checksum
+	headerSize   = 8
+	segmentExt   = ".seg"
+	segmentDigit = 20
+)
+
+var (
+	// ErrEmpty is returned when the queue has no record
+	ErrEmpty = errors.New("spool is empty")
+	// ErrFull is returned when the record exceeds the maximum size of the queue
+	ErrFull = errors.New("spool is full")
+	// ErrTooLarge is returned when the record exceeds the segment size
+	ErrTooLarge = errors.New("spool record is too large")
+)
+
+// segment contains the remaining records of a segment file
+type segment struct {
+	id       uint64
+	count    int64
+	size     int64
+	modified time.Time
+}
+
+// Queue is the FIFO queue of the records on the disk
+// The records are appended to the segment files in the directory,
+// and the segment file is removed when all of its records are popped.
+// Each record has the length and the crc32 checksum, so the torn record
+// after a crash is detected and ignored.
+// The position counts the records removed from the queue, so it identifies the first record.
+type Queue struct {
+	dir          string
+	segmentSize  int64
+	maxSize      int64
+	segments     []segment
+	writer       *os.File
+	writeOffset  int64
+	reader       *os.File
+	readOffset   int64
+	count        int64
+	size         int64
+	position     uint64
+	syncInterval time.Duration
+	synced       time.Time
+	maxAge       time.Duration
+	evicted      func([]byte)
+	mutex        sync.Mutex
+}
+
+// Open opens the queue in the directory and loads the remaining records
+// Zero segmentSize uses the DefaultSegmentSize and zero maxSize means unlimited.
+func Open(dir string, segmentSize int64, maxSize int64) (*Queue, error) {
+	if len(dir) == 0 {
+		return nil, errors.New("spool directory must be specified")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := new(Queue)
+	q.dir = dir
+	q.segmentSize = segmentSize
+	if q.segmentSize <= 0 {
+		q.segmentSize = DefaultSegmentSize
+	}
+	q.maxSize = maxSize
+	q.synced = time.Now()
+	if err := q.load(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// segmentPath returns the path of the segment file
+func (q *Queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%0*d%s", segmentDigit, id, segmentExt))
+}
+
+// load scans the existing segments and creates a new segment to write
+// The new records are always written to a new segment, so the torn tail of
+// the previous segment is never followed by the valid records.
+func (q *Queue) load() error {
+	matches, err := filepath.Glob(filepath.Join(q.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	ids := []uint64{}
+	for _, match := range matches {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(match), segmentExt), 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	next := uint64(1)
+	for _, id := range ids {
+		seg, err := q.scan(id)
+		if err != nil {
+			return err
+		}
+		next = id + 1
+		if seg.count == 0 {
+			os.Remove(q.segmentPath(id))
+			continue
+		}
+		q.segments = append(q.segments, seg)
+		q.count += seg.count
+		q.size += seg.size
+	}
+	if err = q.createSegment(next); err != nil {
+		return err
+	}
+	return q.openReader()
+}
+
+// scan counts the valid records of the segment file
+func (q *Queue) scan(id uint64) (segment, error) {
+	seg := segment{id: id}
+	fp, err := os.Open(q.segmentPath(id))
+	if err != nil {
+		return seg, err
+	}
+	defer fp.Close()
+	if stat, err := fp.Stat(); err == nil {
+		seg.modified = stat.ModTime()
+	}
+	for {
+		_, n, err := readRecord(fp, seg.size, q.segmentSize)
+		if err != nil {
+			break
+		}
+		seg.count++
+		seg.size += n
+	}
+	return seg, nil
+}
+
+// createSegment creates the segment file and makes it the writing segment
+func (q *Queue) createSegment(id uint64) error {
+	fp, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if q.writer != nil {
+		q.writer.Sync()
+		q.writer.Close()
+	}
+	q.writer = fp
+	q.writeOffset = 0
+	q.segments = append(q.segments, segment{id: id, modified: time.Now()})
+	return nil
+}
+
+// openReader opens the first segment to read
+func (q *Queue) openReader() error {
+	fp, err := os.Open(q.segmentPath(q.segments[0].id))
+	if err != nil {
+		return err
+	}
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	q.reader = fp
+	q.readOffset = 0
+	return nil
+}
+
+// readRecord reads the record at the offset and returns it with its size on the disk
+// The length over the limit is the broken header, so it is rejected before the allocation.
+func readRecord(fp *os.File, offset int64, limit int64) ([]byte, int64, error) {
+	header := make([]byte, headerSize)
+	if _, err := fp.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if int64(length)+headerSize > limit {
+		return nil, 0, fmt.Errorf("spool record length %d exceeds the segment size", length)
+	}
+	record := make([]byte, length)
+	if _, err := fp.ReadAt(record, offset+headerSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("spool record checksum mismatch")
+	}
+	return record, int64(length) + headerSize, nil
+}
+
+// SetSyncInterval sets the interval to flush the pushed records to the disk
+// Zero interval flushes every record.
+func (q *Queue) SetSyncInterval(interval time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.syncInterval = interval
+}
+
+// SetEviction makes Push evict the old records instead of returning ErrFull
+// The segment whose last record is older than maxAge is expired, and the oldest
+// records are evicted until the new record fits. The evicted function is called
+// with each evicted record while the queue is locked. Zero maxAge never expires.
+func (q *Queue) SetEviction(maxAge time.Duration, evicted func([]byte)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.maxAge = maxAge
+	q.evicted = evicted
+}
+
+// Push appends the record to the queue
+// The record is flushed to the disk by the sync interval.
+func (q *Queue) Push(record []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.writer == nil {
+		return os.ErrClosed
+	}
+	n := int64(len(record)) + headerSize
+	if n > q.segmentSize {
+		return ErrTooLarge
+	}
+	if q.evicted != nil {
+		if err := q.evict(n); err != nil {
+			return err
+		}
+	}
+	if q.maxSize > 0 && q.size+n > q.maxSize {
+		return ErrFull
+	}
+	if q.writeOffset > 0 && q.writeOffset+n > q.segmentSize {
+		if err := q.createSegment(q.segments[len(q.segments)-1].id + 1); err != nil {
+			return err
+		}
+	}
+	buffer := make([]byte, n)
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buffer[4:8], crc32.ChecksumIEEE(record))
+	copy(buffer[headerSize:], record)
+	if _, err := q.writer.WriteAt(buffer, q.writeOffset); err != nil {
+		return err
+	}
+	q.writeOffset += n
+	last := &q.segments[len(q.segments)-1]
+	last.count++
+	last.size += n
+	last.modified = time.Now()
+	q.count++
+	q.size += n
+	if q.syncInterval == 0 || time.Since(q.synced) >= q.syncInterval {
+		return q.sync()
+	}
+	return nil
+}
+
+// evict removes the expired records and the oldest records until the new record fits
+func (q *Queue) evict(n int64) error {
+	for {
+		record, size, err := q.peek()
+		if err == ErrEmpty {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		expired := q.maxAge > 0 && time.Since(q.segments[0].modified) > q.maxAge
+		if !expired && (q.maxSize <= 0 || q.size+n <= q.maxSize) {
+			return nil
+		}
+		if err = q.remove(size); err != nil {
+			return err
+		}
+		q.evicted(record)
+	}
+}
+
+// Peek returns the first record without removing it
+func (q *Queue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.reader == nil {
+		return nil, os.ErrClosed
+	}
+	record, _, err := q.peek()
+	return record, err
+}
+
+// Front returns the first record with its position without removing it
+func (q *Queue) Front() ([]byte, uint64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.reader == nil {
+		return nil, 0, os.ErrClosed
+	}
+	record, _, err := q.peek()
+	return record, q.position, err
+}
+
+// Remove removes the first record if it is still at the position
+// The record which is evicted after Front is not removed again.
+func (q *Queue) Remove(position uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.reader == nil {
+		return os.ErrClosed
+	}
+	_, n, err := q.peek()
+	if err != nil || position != q.position {
+		return err
+	}
+	return q.remove(n)
+}
+
+// Pop removes the first record and returns it
+func (q *Queue) Pop() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.reader == nil {
+		return nil, os.ErrClosed
+	}
+	record, n, err := q.peek()
+	if err != nil {
+		return nil, err
+	}
+	return record, q.remove(n)
+}
+
+// remove removes the first record whose size is n
+func (q *Queue) remove(n int64) error {
+	q.readOffset += n
+	q.segments[0].count--
+	q.segments[0].size -= n
+	q.count--
+	q.size -= n
+	q.position++
+	if q.segments[0].count == 0 {
+		return q.release()
+	}
+	return nil
+}
+
+// peek reads the first record
+// The broken record drops the rest of its segment.
+func (q *Queue) peek() ([]byte, int64, error) {
+	for q.count > 0 {
+		record, n, err := readRecord(q.reader, q.readOffset, q.segmentSize)
+		if err == nil {
+			return record, n, nil
+		}
+		if len(q.segments) == 1 {
+			return nil, 0, err
+		}
+		q.count -= q.segments[0].count
+		q.size -= q.segments[0].size
+		q.position += uint64(q.segments[0].count)
+		q.segments[0].count = 0
+		if err = q.release(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return nil, 0, ErrEmpty
+}
+
+// release removes the first segment which has no record
+// The writing segment is truncated instead of being removed.
+func (q *Queue) release() error {
+	if len(q.segments) == 1 {
+		q.readOffset = 0
+		q.writeOffset = 0
+		q.segments[0].size = 0
+		return q.writer.Truncate(0)
+	}
+	q.reader.Close()
+	q.reader = nil
+	os.Remove(q.segmentPath(q.segments[0].id))
+	q.segments = q.segments[1:]
+	return q.openReader()
+}
+
+// Len returns the number of the records in the queue
+func (q *Queue) Len() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.count
+}
+
+// Size returns the bytes of the records in the queue
+func (q *Queue) Size() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
+
+// Sync flushes the written records to the disk
+func (q *Queue) Sync() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.writer == nil {
+		return os.ErrClosed
+	}
+	return q.sync()
+}
+
+// sync flushes the writing segment and records the time
+func (q *Queue) sync() error {
+	q.synced = time.Now()
+	return q.writer.Sync()
+}
+
+// Close closes the segment files
+// The remaining records are loaded when the queue is opened again.
+func (q *Queue) Close() error {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var err error
+	if q.writer != nil {
+		err = q.writer.Sync()
+		if cerr := q.writer.Close(); err == nil {
+			err = cerr
+		}
+		q.writer = nil
+	}
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+package spool_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/spool"
+)
+
+func setup(t *testing.T, prefix string) string {
+	dir, err := os.MkdirTemp("", prefix)
+	if err != nil {
+		t.Fatalf("test directory creation failed: %v", err)
+	}
+	return dir
+}
+
+func pushRecords(t *testing.T, q *spool.Queue, start int, end int) {
+	for i := start; i < end; i++ {
+		if err := q.Push([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("push failed %v", err)
+		}
+	}
+}
+
+func popRecords(t *testing.T, q *spool.Queue, start int, end int) {
+	for i := start; i < end; i++ {
+		record, err := q.Pop()
+		if err != nil {
+			t.Fatalf("pop failed %v", err)
+		}
+		if string(record) != fmt.Sprintf("record-%d", i) {
+			t.Fatalf("invalid order (expected: %d, result: %s)", i, record)
+		}
+	}
+}
+
+func TestInvalidDirectory(t *testing.T) {
+	if _, err := spool.Open("", 0, 0); err == nil {
+		t.Errorf("empty directory is accepted")
+	}
+}
+
+func TestPushAndPop(t *testing.T) {
+	dir := setup(t, "test-spool-push")
+	defer os.RemoveAll(dir)
+	q, err := spool.Open(dir, 64, 0)
+	if err != nil {
+		t.Fatalf("open failed %v", err)
+	}
+	defer q.Close()
+	pushRecords(t, q, 0, 10)
+	if record, _ := q.Peek(); string(record) != "record-0" || q.Len() != 10 {
+		t.Errorf("peek removes the record %s", record)
+	}
+	popRecords(t, q, 0, 5)
+	pushRecords(t, q, 10, 20)
+	popRecords(t, q, 5, 20)
+	if _, err = q.Pop(); err != spool.ErrEmpty {
+		t.Errorf("empty spool returns %v", err)
+	}
+	if q.Size() != 0 {
+		t.Errorf("size of empty spool is %d", q.Size())
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(matches) != 1 {
+		t.Errorf("popped segments remain %v", matches)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := setup(t, "test-spool-reopen")
+	defer os.RemoveAll(dir)
+	q, _ := spool.Open(dir, 64, 0)
+	pushRecords(t, q, 0, 10)
+	popRecords(t, q, 0, 3)
+	q.Close()
+
+	q, err := spool.Open(dir, 64, 0)
+	if err != nil {
+		t.Fatalf("reopen failed %v", err)
+	}
+	defer q.Close()
+	pushRecords(t, q, 10, 12)
+	// The popped records of the partially read segment are delivered again.
+	popRecords(t, q, 0, 12)
+}
+
+func TestTornRecord(t *testing.T) {
+	dir := setup(t, "test-spool-torn")
+	defer os.RemoveAll(dir)
+	q, _ := spool.Open(dir, 0, 0)
+	pushRecords(t, q, 0, 2)
+	q.Close()
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	stat, _ := os.Stat(matches[0])
+	os.Truncate(matches[0], stat.Size()-1)
+
+	q, _ = spool.Open(dir, 0, 0)
+	defer q.Close()
+	if q.Len() != 1 {
+		t.Errorf("torn record is loaded (length: %d)", q.Len())
+	}
+	popRecords(t, q, 0, 1)
+}
+
+func TestFull(t *testing.T) {
+	dir := setup(t, "test-spool-full")
+	defer os.RemoveAll(dir)
+	q, _ := spool.Open(dir, 0, 20)
+	defer q.Close()
+	pushRecords(t, q, 0, 1)
+	if err := q.Push([]byte("record-1")); err != spool.ErrFull {
+		t.Errorf("record over the maximum size is accepted %v", err)
+	}
+}
+
+func TestBrokenLength(t *testing.T) {
+	dir := setup(t, "test-spool-length")
+	defer os.RemoveAll(dir)
+	q, _ := spool.Open(dir, 64, 0)
+	pushRecords(t, q, 0, 2)
+	q.Close()
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	fp, _ := os.OpenFile(matches[0], os.O_WRONLY, 0644)
+	fp.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 16)
+	fp.Close()
+
+	q, _ = spool.Open(dir, 64, 0)
+	defer q.Close()
+	if q.Len() != 1 {
+		t.Errorf("record of the broken length is loaded (length: %d)", q.Len())
+	}
+	if err := q.Push(make([]byte, 64)); err != spool.ErrTooLarge {
+		t.Errorf("record over the segment size is accepted %v", err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	dir := setup(t, "test-spool-eviction")
+	defer os.RemoveAll(dir)
+	q, _ := spool.Open(dir, 32, 48)
+	defer q.Close()
+	evicted := []string{}
+	q.SetEviction(0, func(record []byte) {
+		evicted = append(evicted, string(record))
+	})
+	pushRecords(t, q, 0, 3)
+	record, position, _ := q.Front()
+	pushRecords(t, q, 3, 5)
+	if len(evicted) != 2 || evicted[0] != "record-0" || evicted[1] != "record-1" {
+		t.Errorf("oldest records aren't evicted %v", evicted)
+	}
+	if err := q.Remove(position); err != nil || q.Len() != 3 {
+		t.Errorf("evicted %s is removed again (length: %d)", record, q.Len())
+	}
+	popRecords(t, q, 2, 5)
+}
+
+func TestExpiry(t *testing.T) {
+	dir := setup(t, "test-spool-expiry")
+	defer os.RemoveAll(dir)
+	q, _ := spool.Open(dir, 32, 0)
+	defer q.Close()
+	count := 0
+	q.SetEviction(time.Millisecond*50, func(record []byte) {
+		count++
+	})
+	pushRecords(t, q, 0, 2)
+	time.Sleep(time.Millisecond * 100)
+	pushRecords(t, q, 2, 3)
+	if count != 2 || q.Len() != 1 {
+		t.Errorf("expired records aren't evicted (evicted: %d, length: %d)", count, q.Len())
+	}
+	popRecords(t, q, 2, 3)
+}
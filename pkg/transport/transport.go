@@ -2,26 +2,55 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
 	"os"
-	"runtime"
-	"strings"
+	"sync"
 	"time"
 
 	rpcx "github.com/smallnest/rpcx/client"
 	"github.com/soyoslab/soy_log_collector/pkg/rpc"
+	"github.com/soyoslab/soy_log_generator/pkg/auth"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
 	c "github.com/soyoslab/soy_log_generator/pkg/compressor"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
 	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+	"github.com/soyoslab/soy_log_generator/pkg/sink"
+)
+
+var (
+	submittedPackets  = metrics.DefaultRegistry.NewCounter("generator_submitted_packets_total", "Number of the packets submitted to the port.", "port")
+	submittedBytes    = metrics.DefaultRegistry.NewCounter("generator_submitted_bytes_total", "Bytes of the packet buffers submitted to the port.", "port")
+	submitErrors      = metrics.DefaultRegistry.NewCounter("generator_submit_errors_total", "Number of the failed submissions to the port.", "port")
+	submitLatency     = metrics.DefaultRegistry.NewHistogram("generator_submit_latency_seconds", "Latency of the submission to the port.", metrics.DefaultLatencyBuckets, "port")
+	uncompressedBytes = metrics.DefaultRegistry.NewCounter("generator_uncompressed_bytes_total", "Bytes of the cold buffers before the compression.")
+	compressedBytes   = metrics.DefaultRegistry.NewCounter("generator_compressed_bytes_total", "Bytes of the cold buffers after the compression.")
+	compressionRatio  = metrics.DefaultRegistry.NewGauge("generator_compression_ratio", "Uncompressed size divided by compressed size of the last cold packet.")
+)
+
+const (
+	// MetaCompression is the rpcx metadata key of the cold packets' codec sent with the Init packet
+	MetaCompression = "compression"
+	// MetaFraming is the rpcx metadata key which tells the cold packets are framed ("true" or "false")
+	MetaFraming = "framing"
+	// MetaDictionary is the rpcx metadata key of the zstd dictionary id (decimal) of the cold packets
+	MetaDictionary = "dictionary"
 )
 
 // SubmitFunc is a type for submission the packet to rpcx
-type SubmitFunc func(*rpc.LogMessage, rpcx.XClient) error
+// The context has the deadline of the call timeout.
+type SubmitFunc func(context.Context, *rpc.LogMessage, rpcx.XClient) error
 
 // BufferingMetadata contains the cold data's buffering information
 type BufferingMetadata struct {
 	packet    rpc.LogMessage
+	lines     []uint64
+	tickets   []*checkpoint.Ticket
 	start     time.Time
 	threshold uint64
 	timeout   time.Duration
@@ -42,16 +71,40 @@ func (p *Port) Close() {
 
 // Transport contains the rpcx and communcation information
 type Transport struct {
-	scheduler  *s.Scheduler
-	hot        Port
-	cold       Port
-	addr       string
-	compressor c.Compressor
-	err        error
-	submit     SubmitFunc
-	fileMap    map[string]uint8
-	packetMap  []string
-	namespace  string
+	scheduler     *s.Scheduler
+	sinks         []namedSink
+	routes        []*route
+	cold          Port
+	endpoints     []*endpoint
+	hashOrder     []*endpoint
+	strategy      string
+	roundRobin    int
+	mapVersion    uint64
+	session       string
+	sequence      uint64
+	tickets       map[string][]*checkpoint.Ticket
+	requireAck    bool
+	compressor    c.Compressor
+	codec         string
+	framing       bool
+	signer        *auth.Signer
+	dictID        uint32
+	err           error
+	submit        SubmitFunc
+	fileMap       map[string]uint8
+	packetMap     []string
+	namespace     string
+	spool         packetQueue
+	spoolMaxAge   time.Duration
+	drainKick     chan bool
+	drainDone     chan bool
+	drainWait     sync.WaitGroup
+	metricsServer *http.Server
+	flushMutex    sync.Mutex
+	retry         retryPolicy
+	closed        chan bool
+	closeOnce     sync.Once
+	mutex         sync.Mutex
 }
 
 // getAddr returns the address of the rpcx server
@@ -62,37 +115,96 @@ func getAddr(ip string, port string) string {
 // getXClient returns the rpcx client instance
 // NewPeer2PeerDiscovery function always returns nil to err
 // For this reason, second return parameter doesn't have any meaning
-func getXClient(addr string, funcName string) (rpcx.XClient, error) {
+// The client fails fast because the transport retries by its own policy.
+// The connection is encrypted if the TLS configuration is given.
+func getXClient(addr string, funcName string, timeout time.Duration, tlsConfig *tls.Config) (rpcx.XClient, error) {
 	discovery, _ := rpcx.NewPeer2PeerDiscovery("tcp@"+addr, "")
-	xclient := rpcx.NewXClient(funcName, rpcx.Failtry, rpcx.RandomSelect, discovery, rpcx.DefaultOption)
+	option := rpcx.DefaultOption
+	if timeout > 0 {
+		option.ConnectTimeout = timeout
+	}
+	option.TLSConfig = tlsConfig
+	xclient := rpcx.NewXClient(funcName, rpcx.Failfast, rpcx.RandomSelect, discovery, option)
 	return xclient, nil
 }
 
 // exceptionHandler does mapping the error code to the Transport structure's error member
+// The transport is closed without draining the rings because the error is returned to their consumer.
 func exceptionHandler(transport *Transport, err error) error {
 	if transport != nil && err != nil {
 		transport.err = err
-		transport.Close()
+		transport.close(false)
 	}
 	return err
 }
 
+// newCompressor returns the compressor of the cold packets and the id of its zstd dictionary
+// The framed compressor prefixes the codec, so the payload is decoded without the Init packet.
+func newCompressor(config s.Config) (c.Compressor, uint32, error) {
+	compressor, err := c.New(config.Compression, int(config.CompressionLevel))
+	if err != nil {
+		return nil, 0, err
+	}
+	dictID, err := loadDictionary(config)
+	if err != nil {
+		return nil, 0, err
+	}
+	if zstd, ok := compressor.(*c.ZstdComp); ok {
+		zstd.DictID = dictID
+	}
+	if config.CompressionFraming {
+		compressor = &c.FramedComp{Codec: config.Compression, Compressor: compressor}
+	}
+	return compressor, dictID, nil
+}
+
+// newSigner returns the signer of the authentication settings
+// The secret is read from the file or the environment variable once at the start.
+func newSigner(config s.Config) (*auth.Signer, error) {
+	var secret []byte
+	if !auth.IsValidMode(config.AuthMode) {
+		return nil, fmt.Errorf("invalid authentication mode %q", config.AuthMode)
+	}
+	if config.AuthMode != auth.ModeNone {
+		var err error
+		secret, err = auth.LoadSecret(config.AuthSecretFile, config.AuthSecretEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth.NewSigner(config.AuthMode, secret)
+}
+
+// loadDictionary reads and registers the zstd dictionary of the configuration (0 if it is not set)
+func loadDictionary(config s.Config) (uint32, error) {
+	if len(config.CompressionDict) == 0 {
+		return 0, nil
+	}
+	if config.Compression != c.CodecZstd {
+		return 0, fmt.Errorf("compression dictionary needs the %s codec (current: %s)", c.CodecZstd, config.Compression)
+	}
+	dict, err := ioutil.ReadFile(config.CompressionDict)
+	if err != nil {
+		return 0, err
+	}
+	return c.RegisterZstdDict(dict)
+}
+
 // InitTransport returns the instance of the Transport structure
 func InitTransport(configFileName string, customFilterFunc s.CustomFilterFunc) (*Transport, error) {
 	var (
 		err       error
 		scheduler *s.Scheduler
 		config    s.Config
-		files     []s.File
-		packet    *rpc.LogMessage
-		reply     *rpc.Reply
-		xclient   rpcx.XClient
 		hostname  string
+		tlsConfig *tls.Config
 	)
 	t := new(Transport)
+	t.closed = make(chan bool)
 	submitOps := s.SubmitOperations{}
 	submitOps.Hot = t.hotSubmitFunc
 	submitOps.Cold = t.coldSubmitFunc
+	submitOps.Init = t.initSubmitFunc
 
 	scheduler, err = s.InitScheduler(configFileName, submitOps, customFilterFunc)
 	if err != nil {
@@ -104,39 +216,138 @@ func InitTransport(configFileName string, customFilterFunc s.CustomFilterFunc) (
 	t.namespace = fmt.Sprintf("%s:%s", t.scheduler.GetConfig().Namespace, hostname)
 	t.cold.meta.threshold = scheduler.GetConfig().ColdSendThreshold
 	t.cold.meta.timeout = time.Duration(scheduler.GetConfig().ColdTimeout) * time.Millisecond
-	t.cold.meta.start = time.Now()
-	t.compressor = &c.GzipComp{}
 	t.submit = Submit
+	t.session = newSession()
 	t.fileMap = make(map[string]uint8)
-
-	files = t.scheduler.GetConfig().Files
-	t.packetMap = make([]string, len(files))
-
-	for idx, file := range files {
-		t.fileMap[file.Filename] = uint8(idx)
-		t.packetMap[idx] = file.Filename
-	}
+	t.packetMap = []string{}
 
 	config = t.scheduler.GetConfig()
-	t.addr = getAddr(config.TargetIP, config.TargetPort)
+	t.setRetry(config)
+	t.requireAck = config.DeliveryAck
+	t.codec = config.Compression
+	t.framing = config.CompressionFraming
+	t.compressor, t.dictID, err = newCompressor(config)
+	if err != nil {
+		goto out
+	}
 
-	t.hot.xclient, _ = getXClient(t.addr, "HotPort")
-	t.cold.xclient, _ = getXClient(t.addr, "ColdPort")
+	t.signer, err = newSigner(config)
+	if err != nil {
+		goto out
+	}
+	tlsConfig, err = newTLSConfig(config)
+	if err != nil {
+		goto out
+	}
+	if !isValidStrategy(config.TargetStrategy) {
+		err = fmt.Errorf("invalid target strategy %q", config.TargetStrategy)
+		goto out
+	}
+	t.strategy = config.TargetStrategy
+	err = t.newSinks(config, sink.Source{Namespace: config.Namespace, Hostname: hostname})
+	if err != nil {
+		goto out
+	}
+	err = t.newRoutes(config)
+	if err != nil {
+		goto out
+	}
+	if hasCollector(config) {
+		t.endpoints, err = newEndpoints(config, t.retry.callTimeout, tlsConfig)
+		if err != nil {
+			goto out
+		}
+		t.hashOrder = newHashOrder(t.endpoints, t.namespace)
+		err = t.initSpool(config)
+		if err != nil {
+			goto out
+		}
+	}
+	if len(config.MetricsAddress) != 0 {
+		t.metricsServer, err = metrics.Serve(config.MetricsAddress, metrics.DefaultRegistry)
+		if err != nil {
+			goto out
+		}
+	}
 
-	xclient, _ = getXClient(t.addr, "Init")
-	packet = &rpc.LogMessage{}
-	packet.Namespace = t.namespace
-	packet.Files.MapTable = t.packetMap
-	reply = &rpc.Reply{}
-	err = xclient.Call(context.Background(), "Push", packet, reply)
+	err = t.initSubmitFunc(config.Files)
 	if err != nil {
 		goto out
 	}
+	go t.flushLoop()
+	if config.HealthCheck > 0 && len(t.endpoints) > 0 {
+		go t.healthLoop(time.Duration(config.HealthCheck)*time.Millisecond, probeTimeout(t.retry.callTimeout))
+	}
 
 out:
 	return t, exceptionHandler(t, err)
 }
 
+// updateFileMap assigns the index to the new files and releases the index of the removed files
+// The index of the existing file is never changed because the packets in flight use it.
+// The released index is reused only when there is no room in the file map table.
+func (t *Transport) updateFileMap(files []s.File) error {
+	alive := make(map[string]bool)
+	for _, file := range files {
+		alive[file.Filename] = true
+	}
+	for filename, idx := range t.fileMap {
+		if !alive[filename] {
+			delete(t.fileMap, filename)
+			t.packetMap[idx] = ""
+		}
+	}
+	for _, file := range files {
+		if _, ok := t.fileMap[file.Filename]; ok {
+			continue
+		}
+		if _, err := t.assignIndex(file.Filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignIndex assigns the index of the file map table to the file (t.mutex must be held)
+func (t *Transport) assignIndex(filename string) (uint8, error) {
+	idx := len(t.packetMap)
+	if idx > math.MaxUint8 {
+		idx = indexOf(t.packetMap, "")
+	} else {
+		t.packetMap = append(t.packetMap, "")
+	}
+	if idx < 0 {
+		return 0, fmt.Errorf("file map table is full (filename: %s)", filename)
+	}
+	t.fileMap[filename] = uint8(idx)
+	t.packetMap[idx] = filename
+	return uint8(idx), nil
+}
+
+// indexOf returns the first index of the value in the array (-1 if not found)
+func indexOf(arr []string, value string) int {
+	for i, v := range arr {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// initFiles updates the file map table and sends it to the collector
+// The codec of the cold packets is sent together in the metadata. The other
+// collectors receive the new version before the traffic moves to them.
+func (t *Transport) initFiles(files []s.File) error {
+	t.mutex.Lock()
+	err := t.updateFileMap(files)
+	t.mapVersion++
+	t.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.pushInit()
+}
+
 // Run executes the scheduler
 func (t *Transport) Run() error {
 	var err error
@@ -152,6 +363,22 @@ out:
 	return t.err
 }
 
+// Reload applies the configuration file to the scheduler, the cold buffering and the retry policy
+// Note that the current configuration is kept when the new one is invalid.
+func (t *Transport) Reload(configFileName string) error {
+	if t.scheduler == nil {
+		return errors.New("scheduler must be allocated")
+	}
+	err := t.scheduler.Reload(configFileName)
+	config := t.scheduler.GetConfig()
+	t.mutex.Lock()
+	t.cold.meta.threshold = config.ColdSendThreshold
+	t.cold.meta.timeout = time.Duration(config.ColdTimeout) * time.Millisecond
+	t.mutex.Unlock()
+	t.setRetry(config)
+	return err
+}
+
 func getInfo(message s.Message) rpc.LogInfo {
 	info := rpc.LogInfo{}
 	info.Length = message.Info.Length
@@ -184,20 +411,24 @@ func getPacket(messages []s.Message, fileMap map[string]uint8, packetMap []strin
 }
 
 // Submit submits the packet to server by using rpcx
-func Submit(packet *rpc.LogMessage, xclient rpcx.XClient) error {
+func Submit(ctx context.Context, packet *rpc.LogMessage, xclient rpcx.XClient) error {
 	reply := &rpc.Reply{}
-	err := xclient.Call(context.Background(), "Push", packet, reply)
+	err := xclient.Call(ctx, "Push", packet, reply)
 	return err
 }
 
-// hotSubmitFunc submits the hot messages
-func (t *Transport) hotSubmitFunc(messages []s.Message) error {
+// submitHot submits the hot messages to the collector
+func (t *Transport) submitHot(messages []s.Message) error {
 	var (
 		packet rpc.LogMessage
+		lines  []uint64
 		err    error
 	)
 
+	t.mutex.Lock()
 	packet, err = getPacket(messages, t.fileMap, t.packetMap)
+	t.mutex.Unlock()
+	lines = getLines(messages)
 	if err != nil {
 		goto exception
 	}
@@ -207,69 +438,85 @@ func (t *Transport) hotSubmitFunc(messages []s.Message) error {
 
 	packet.Namespace = t.namespace
 	packet.Files.MapTable = nil
-	for {
-		err = t.submit(&packet, t.hot.xclient)
-		if err == nil {
-			break
-		} else if !strings.Contains(err.Error(), "is full") {
-			goto exception
-		}
-		log.Println("hot port error detected:", err)
-		runtime.Gosched()
+	err = t.deliver("hot", &packet, lines, getTickets(messages))
+	if err != nil {
+		goto exception
 	}
 	return nil
 exception:
-	return exceptionHandler(t, err)
+	return err
 }
 
-// coldSubmitFunc submits the cold messages
-func (t *Transport) coldSubmitFunc(messages []s.Message) error {
+// submitCold buffers the cold messages and submits them to the collector if the threshold is exceeded
+// The expired packet is also submitted by the flusher without the new cold messages.
+func (t *Transport) submitCold(messages []s.Message) error {
 	var (
-		meta   *BufferingMetadata
 		err    error
 		packet rpc.LogMessage
+		lines  []uint64
 	)
 
+	t.mutex.Lock()
 	packet, err = getPacket(messages, t.fileMap, nil)
+	t.mutex.Unlock()
+	lines = getLines(messages)
 	if err != nil {
 		goto exception
 	}
 	if len(packet.Info) == 0 {
 		return nil
 	}
-	meta = &t.cold.meta
-	meta.packet.Info = append(meta.packet.Info, packet.Info...)
-	meta.packet.Buffer = append(meta.packet.Buffer, packet.Buffer...)
-	meta.packet.Files.Indexes = append(meta.packet.Files.Indexes, packet.Files.Indexes...)
-	if uint64(len(meta.packet.Buffer)) >= meta.threshold || time.Since(meta.start) >= meta.timeout {
-		meta.packet.Buffer, err = t.compressor.Compress(meta.packet.Buffer)
-		if err != nil {
-			goto exception
-		}
-		meta.packet.Namespace = t.namespace
-		meta.packet.Files.MapTable = nil
-		for {
-			err = t.submit(&meta.packet, t.cold.xclient)
-			if err == nil {
-				break
-			} else if !strings.Contains(err.Error(), "is full") {
-				goto exception
-			}
-			log.Println("cold port error detected:", err)
-			runtime.Gosched()
-		}
-		meta.packet = rpc.LogMessage{}
+	t.bufferCold(packet, lines, getTickets(messages))
+	err = t.flushCold(false)
+	if err != nil {
+		goto exception
 	}
 	return nil
 exception:
-	return exceptionHandler(t, err)
+	return err
+}
+
+// compress compresses the cold buffer and records the compression ratio
+func (t *Transport) compress(buffer []byte) ([]byte, error) {
+	compressed, err := t.compressor.Compress(buffer)
+	if err != nil {
+		return nil, err
+	}
+	uncompressedBytes.Add(float64(len(buffer)))
+	compressedBytes.Add(float64(len(compressed)))
+	if len(compressed) > 0 {
+		compressionRatio.Set(float64(len(buffer)) / float64(len(compressed)))
+	}
+	return compressed, nil
 }
 
 // Close closes the transport data structure
+// The lines left in the rings are submitted, and the pending cold packet is submitted
+// (or spooled) before the clients are closed.
 func (t *Transport) Close() {
-	if t.scheduler != nil {
+	t.close(true)
+}
+
+// close closes the transport and drains the rings of the scheduler if drain is set
+func (t *Transport) close(drain bool) {
+	if t.scheduler != nil && drain {
 		t.scheduler.Close()
+	} else if t.scheduler != nil {
+		t.scheduler.Abort()
+	}
+	if err := t.closeFlush(); err != nil {
+		log.Println("pending cold packet flush failed:", err)
+	}
+	t.closeRoutes()
+	t.closeSinks()
+	if t.closed != nil {
+		t.closeOnce.Do(func() { close(t.closed) })
+	}
+	t.closeSpool()
+	if t.metricsServer != nil {
+		t.metricsServer.Close()
+	}
+	for _, e := range t.endpoints {
+		e.close()
 	}
-	t.cold.Close()
-	t.hot.Close()
 }
@@ -0,0 +1,253 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	rpcx "github.com/smallnest/rpcx/client"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+const (
+	// StrategyFailover sends to the first healthy endpoint in the configured order
+	StrategyFailover = "failover"
+	// StrategyRoundRobin rotates the healthy endpoints on every submission
+	StrategyRoundRobin = "roundrobin"
+	// StrategyHash sends to the endpoint of the namespace on the consistent hash ring
+	StrategyHash = "hash"
+	// hashReplicas is the number of the virtual nodes of an endpoint on the hash ring
+	hashReplicas = 64
+)
+
+// serviceNames are the rpcx service names of the ports
+var serviceNames = map[string]string{
+	"hot":  "HotPort",
+	"cold": "ColdPort",
+	"init": "Init",
+}
+
+var endpointHealthy = metrics.DefaultRegistry.NewGauge("generator_endpoint_healthy", "Health of the collector endpoint (1: healthy, 0: unhealthy).", "endpoint")
+
+// endpoint is a collector which has the clients of the ports and its circuit breaker
+// mapVersion is the version of the file map table which the collector has received,
+// so the Init packet is sent again before the traffic moves to the collector.
+type endpoint struct {
+	addr       string
+	ports      map[string]*Port
+	breaker    *breaker
+	healthy    bool
+	mapVersion uint64
+	mutex      sync.Mutex
+}
+
+// ringNode is a virtual node of the endpoint on the hash ring
+type ringNode struct {
+	hash     uint32
+	endpoint *endpoint
+}
+
+// isValidStrategy checks the endpoint selection strategy is supported
+func isValidStrategy(strategy string) bool {
+	switch strategy {
+	case StrategyFailover, StrategyRoundRobin, StrategyHash:
+		return true
+	}
+	return false
+}
+
+// getTargets returns the addresses of the collectors
+// The targetIp and the targetPort are used when the targets aren't set.
+func getTargets(config s.Config) []string {
+	if len(config.Targets) == 0 {
+		return []string{getAddr(config.TargetIP, config.TargetPort)}
+	}
+	return config.Targets
+}
+
+// newEndpoints returns the endpoints of the collectors in the configured order
+func newEndpoints(config s.Config, timeout time.Duration, tlsConfig *tls.Config) ([]*endpoint, error) {
+	endpoints := []*endpoint{}
+	seen := make(map[string]bool)
+	for _, addr := range getTargets(config) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid target %q: %v", addr, err)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("duplicated target %q", addr)
+		}
+		seen[addr] = true
+		e := &endpoint{addr: addr, ports: make(map[string]*Port), breaker: &breaker{addr: addr}, healthy: true}
+		for name, service := range serviceNames {
+			xclient, _ := getXClient(addr, service, timeout, tlsConfig)
+			e.ports[name] = &Port{xclient: xclient}
+		}
+		e.breaker.setConfig(config)
+		endpointHealthy.Set(1, addr)
+		breakerState.Set(breakerClosed, addr)
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// newHashOrder returns the endpoints in the order of the hash ring from the key
+// The key keeps its endpoint when the other endpoints are added or removed.
+func newHashOrder(endpoints []*endpoint, key string) []*endpoint {
+	ring := []ringNode{}
+	for _, e := range endpoints {
+		for i := 0; i < hashReplicas; i++ {
+			ring = append(ring, ringNode{crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", e.addr, i))), e})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	order := []*endpoint{}
+	seen := make(map[*endpoint]bool)
+	for i := 0; i < len(ring) && len(order) < len(endpoints); i++ {
+		node := ring[(start+i)%len(ring)]
+		if !seen[node.endpoint] {
+			seen[node.endpoint] = true
+			order = append(order, node.endpoint)
+		}
+	}
+	return order
+}
+
+// client returns the rpcx client of the port (nil if the endpoint is nil)
+func (e *endpoint) client(name string) rpcx.XClient {
+	if e == nil || e.ports[name] == nil {
+		return nil
+	}
+	return e.ports[name].xclient
+}
+
+// getBreaker returns the circuit breaker of the endpoint (nil if the endpoint is nil)
+func (e *endpoint) getBreaker() *breaker {
+	if e == nil {
+		return nil
+	}
+	return e.breaker
+}
+
+// isHealthy checks the endpoint is healthy
+func (e *endpoint) isHealthy() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.healthy
+}
+
+// setHealthy changes the health of the endpoint
+// The unhealthy collector may lose the file map table, so it receives the Init packet again.
+func (e *endpoint) setHealthy(healthy bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !healthy {
+		e.mapVersion = 0
+	}
+	if e.healthy == healthy {
+		return
+	}
+	e.healthy = healthy
+	if healthy {
+		log.Printf("collector %s is healthy\n", e.addr)
+		endpointHealthy.Set(1, e.addr)
+	} else {
+		log.Printf("collector %s is unhealthy\n", e.addr)
+		endpointHealthy.Set(0, e.addr)
+	}
+}
+
+// getMapVersion returns the version of the file map table which the endpoint has received
+func (e *endpoint) getMapVersion() uint64 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.mapVersion
+}
+
+// setMapVersion records the version of the file map table sent to the endpoint
+func (e *endpoint) setMapVersion(version uint64) {
+	e.mutex.Lock()
+	e.mapVersion = version
+	e.mutex.Unlock()
+}
+
+// close closes the clients of the endpoint
+func (e *endpoint) close() {
+	for _, port := range e.ports {
+		port.Close()
+	}
+}
+
+// getOrder returns the endpoints in the order of the strategy
+func (t *Transport) getOrder() []*endpoint {
+	switch t.strategy {
+	case StrategyRoundRobin:
+		t.mutex.Lock()
+		start := t.roundRobin % len(t.endpoints)
+		t.roundRobin++
+		t.mutex.Unlock()
+		return append(append([]*endpoint{}, t.endpoints[start:]...), t.endpoints[:start]...)
+	case StrategyHash:
+		return t.hashOrder
+	}
+	return t.endpoints
+}
+
+// pickEndpoint returns the first healthy endpoint whose breaker isn't open in the order of the strategy
+// If every endpoint is unavailable, the retries go through all of them in turn.
+func (t *Transport) pickEndpoint(retry uint64) *endpoint {
+	if len(t.endpoints) == 0 {
+		return nil
+	}
+	order := t.getOrder()
+	for _, e := range order {
+		if e.isHealthy() && !e.breaker.isOpen() {
+			return e
+		}
+	}
+	return order[retry%uint64(len(order))]
+}
+
+// healthLoop probes the unhealthy endpoints until the transport is closed
+// The endpoint which accepts the connection becomes healthy again.
+func (t *Transport) healthLoop(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+		for _, e := range t.endpoints {
+			if !e.isHealthy() && probe(e.addr, timeout) {
+				e.setHealthy(true)
+			}
+		}
+	}
+}
+
+// probeTimeout returns the timeout of the health probe (1 second if the call timeout is disabled)
+func probeTimeout(callTimeout time.Duration) time.Duration {
+	if callTimeout == 0 {
+		return time.Second
+	}
+	return callTimeout
+}
+
+// probe checks the collector accepts the connection
+func probe(addr string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
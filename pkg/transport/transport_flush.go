@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"log"
+	"time"
+
+	"github.com/soyoslab/soy_log_collector/pkg/rpc"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+)
+
+const (
+	// minFlushInterval bounds the flusher's wake-up interval when the cold timeout is too short
+	minFlushInterval = time.Duration(10) * time.Millisecond
+	// closeFlushTimeout bounds the flush of the pending cold packet on close
+	closeFlushTimeout = time.Duration(5000) * time.Millisecond
+)
+
+// flushLoop submits the pending cold packet when it expires until the transport is closed
+// The pending packet is flushed even though no new cold message arrives.
+// The failed flush is logged and the next packet is flushed on time.
+func (t *Transport) flushLoop() {
+	for {
+		timer := time.NewTimer(t.flushDelay())
+		select {
+		case <-t.closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := t.flushCold(false); err != nil {
+			log.Println("pending cold packet flush failed:", err)
+		}
+	}
+}
+
+// closeFlush flushes the pending cold packet within closeFlushTimeout
+// If the flush takes longer, the transport is marked closed to stop its retries.
+func (t *Transport) closeFlush() error {
+	done := make(chan error, 1)
+	go func() {
+		done <- t.flushCold(true)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(closeFlushTimeout):
+	}
+	log.Println("pending cold packet flush timed out, the retries are stopped")
+	if t.closed != nil {
+		t.closeOnce.Do(func() { close(t.closed) })
+	}
+	return <-done
+}
+
+// flushDelay returns the time until the pending cold packet expires
+func (t *Transport) flushDelay() time.Duration {
+	t.mutex.Lock()
+	delay := t.cold.meta.timeout
+	t.mutex.Unlock()
+	t.flushMutex.Lock()
+	if len(t.cold.meta.packet.Info) > 0 {
+		delay -= time.Since(t.cold.meta.start)
+	}
+	t.flushMutex.Unlock()
+	if delay < minFlushInterval {
+		delay = minFlushInterval
+	}
+	return delay
+}
+
+// bufferCold appends the cold packet, its line sequences and its checkpoint tickets to the pending packet
+// The expiration of the pending packet starts from its first message.
+func (t *Transport) bufferCold(packet rpc.LogMessage, lines []uint64, tickets []*checkpoint.Ticket) {
+	t.flushMutex.Lock()
+	defer t.flushMutex.Unlock()
+	meta := &t.cold.meta
+	if len(meta.packet.Info) == 0 {
+		meta.start = time.Now()
+	}
+	meta.packet.Info = append(meta.packet.Info, packet.Info...)
+	meta.packet.Buffer = append(meta.packet.Buffer, packet.Buffer...)
+	meta.packet.Files.Indexes = append(meta.packet.Files.Indexes, packet.Files.Indexes...)
+	meta.lines = append(meta.lines, lines...)
+	meta.tickets = append(meta.tickets, tickets...)
+}
+
+// flushCold compresses and submits the pending cold packet if it exceeds the threshold or expires
+// If force is set, the pending packet is submitted regardless of the threshold and the timeout.
+// The pending packet is detached before the submission, so the failed packet is never sent twice,
+// and the new cold messages are buffered during the submission.
+func (t *Transport) flushCold(force bool) error {
+	var err error
+	t.mutex.Lock()
+	threshold, timeout := t.cold.meta.threshold, t.cold.meta.timeout
+	t.mutex.Unlock()
+	t.flushMutex.Lock()
+	meta := &t.cold.meta
+	if len(meta.packet.Info) == 0 {
+		t.flushMutex.Unlock()
+		return nil
+	}
+	if !force && uint64(len(meta.packet.Buffer)) < threshold && time.Since(meta.start) < timeout {
+		t.flushMutex.Unlock()
+		return nil
+	}
+	packet, lines, tickets := meta.packet, meta.lines, meta.tickets
+	meta.packet, meta.lines, meta.tickets = rpc.LogMessage{}, nil, nil
+	t.flushMutex.Unlock()
+	packet.Buffer, err = t.compress(packet.Buffer)
+	if err != nil {
+		return err
+	}
+	packet.Namespace = t.namespace
+	packet.Files.MapTable = nil
+	return t.deliver("cold", &packet, lines, tickets)
+}
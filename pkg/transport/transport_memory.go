@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/spool"
+)
+
+// packetQueue keeps the packets which wait for the collector in order
+// The disk spool and the memory queue have the same semantics.
+type packetQueue interface {
+	Push(record []byte) error
+	Front() ([]byte, uint64, error)
+	Remove(position uint64) error
+	Len() int64
+	SetEviction(maxAge time.Duration, evicted func([]byte))
+	Close() error
+}
+
+// memoryRecord is a packet in the memory queue
+type memoryRecord struct {
+	data   []byte
+	stored time.Time
+}
+
+// memoryQueue keeps the unacknowledged packets in the memory when the spool path isn't set
+// The packets are lost on close, but their lines are read again because their
+// checkpoint tickets aren't done.
+type memoryQueue struct {
+	records  []memoryRecord
+	size     int64
+	maxSize  int64
+	position uint64
+	maxAge   time.Duration
+	evicted  func([]byte)
+	closed   bool
+	mutex    sync.Mutex
+}
+
+// newMemoryQueue returns the memory queue which keeps up to maxSize bytes (zero means unlimited)
+func newMemoryQueue(maxSize int64) *memoryQueue {
+	return &memoryQueue{maxSize: maxSize}
+}
+
+// SetEviction makes Push evict the expired and the oldest packets instead of returning spool.ErrFull
+func (q *memoryQueue) SetEviction(maxAge time.Duration, evicted func([]byte)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.maxAge = maxAge
+	q.evicted = evicted
+}
+
+// Push appends the packet to the queue
+func (q *memoryQueue) Push(record []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return os.ErrClosed
+	}
+	n := int64(len(record))
+	for q.evicted != nil && len(q.records) > 0 {
+		expired := q.maxAge > 0 && time.Since(q.records[0].stored) > q.maxAge
+		if !expired && (q.maxSize <= 0 || q.size+n <= q.maxSize) {
+			break
+		}
+		evicted := q.records[0].data
+		q.remove()
+		q.evicted(evicted)
+	}
+	if q.maxSize > 0 && q.size+n > q.maxSize {
+		return spool.ErrFull
+	}
+	q.records = append(q.records, memoryRecord{data: record, stored: time.Now()})
+	q.size += n
+	return nil
+}
+
+// Front returns the first packet with its position without removing it
+func (q *memoryQueue) Front() ([]byte, uint64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return nil, 0, os.ErrClosed
+	}
+	if len(q.records) == 0 {
+		return nil, 0, spool.ErrEmpty
+	}
+	return q.records[0].data, q.position, nil
+}
+
+// Remove removes the first packet if it is still at the position
+func (q *memoryQueue) Remove(position uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return os.ErrClosed
+	}
+	if len(q.records) > 0 && position == q.position {
+		q.remove()
+	}
+	return nil
+}
+
+// remove removes the first packet (q.mutex must be held)
+func (q *memoryQueue) remove() {
+	q.size -= int64(len(q.records[0].data))
+	q.records[0] = memoryRecord{}
+	q.records = q.records[1:]
+	q.position++
+}
+
+// Len returns the number of the packets in the queue
+func (q *memoryQueue) Len() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return int64(len(q.records))
+}
+
+// Close drops the packets in the queue
+func (q *memoryQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.records = nil
+	q.size = 0
+	return nil
+}
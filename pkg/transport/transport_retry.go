@@ -0,0 +1,344 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rpcx "github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/share"
+	"github.com/soyoslab/soy_log_collector/pkg/rpc"
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+const (
+	// errorFatal is the error which cannot be solved by the retry (e.g. the collector rejects the packet)
+	errorFatal = iota
+	// errorRetryable is the error of the connection or the deadline
+	errorRetryable
+	// errorBackpressure is the error of the collector's full ring
+	errorBackpressure
+	// errorUnregistered is the error of the collector which lost the file map table (e.g. restarted)
+	errorUnregistered
+)
+
+// unregisteredMessage is the part of the collector's error when the namespace or the file index is unknown
+const unregisteredMessage = "is not registered"
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var (
+	// errClosed is returned when the transport is closed during the retry
+	errClosed = errors.New("transport is closed")
+	// errBreakerOpen is returned while the circuit breaker stops the submissions
+	errBreakerOpen = errors.New("circuit breaker is open")
+)
+
+// breakerStates are the names of the breaker states
+var breakerStates = []string{"closed", "open", "half-open"}
+
+var breakerState = metrics.DefaultRegistry.NewGauge("generator_breaker_state", "State of the circuit breaker (0: closed, 1: open, 2: half-open).", "endpoint")
+
+// retryPolicy contains the retry settings of the submission
+type retryPolicy struct {
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	maxAttempts    uint64
+	callTimeout    time.Duration
+}
+
+// breaker stops the submissions to an endpoint for a while after the consecutive failures
+// After the open timeout, a single submission probes the collector in the half-open state.
+type breaker struct {
+	addr        string
+	threshold   uint64
+	openTimeout time.Duration
+	failures    uint64
+	state       int
+	openedAt    time.Time
+	mutex       sync.Mutex
+}
+
+// newRetryPolicy makes the retry policy of the configuration
+func newRetryPolicy(config s.Config) retryPolicy {
+	return retryPolicy{
+		initialBackoff: time.Duration(config.RetryInitial) * time.Millisecond,
+		maxBackoff:     time.Duration(config.RetryMax) * time.Millisecond,
+		jitter:         float64(config.RetryJitter) / 100,
+		maxAttempts:    config.RetryMaxAttempts,
+		callTimeout:    time.Duration(config.CallTimeout) * time.Millisecond,
+	}
+}
+
+// backoff returns the delay before the retry (the first retry is 1)
+// The delay is doubled on every retry up to the max backoff and randomized by the jitter.
+func (p retryPolicy) backoff(retry uint64) time.Duration {
+	delay := float64(p.initialBackoff) * math.Pow(2, float64(retry-1))
+	if delay > float64(p.maxBackoff) {
+		delay = float64(p.maxBackoff)
+	}
+	delay += delay * p.jitter * (2*rand.Float64() - 1)
+	return time.Duration(delay)
+}
+
+// classifyError returns whether the error can be solved by the retry
+// The errors returned by the collector's handler are fatal except the full ring and
+// the unknown file map table, and the others are the errors of the connection. errClosed
+// is retryable, so the packet is kept in the spool when the transport is closed during the retry.
+func classifyError(err error) int {
+	var serviceError rpcx.ServiceError
+	switch {
+	case strings.Contains(err.Error(), "is full"):
+		return errorBackpressure
+	case strings.Contains(err.Error(), unregisteredMessage):
+		return errorUnregistered
+	case errors.As(err, &serviceError):
+		return errorFatal
+	}
+	return errorRetryable
+}
+
+// isRetryable checks the error is the connection error which is worth to retry later
+func isRetryable(err error) bool {
+	return classifyError(err) != errorFatal
+}
+
+// setConfig updates the threshold and the open timeout of the breaker
+// Zero threshold disables the breaker.
+func (b *breaker) setConfig(config s.Config) {
+	b.mutex.Lock()
+	b.threshold = config.BreakerThreshold
+	b.openTimeout = time.Duration(config.BreakerOpen) * time.Millisecond
+	b.mutex.Unlock()
+}
+
+// allow checks the submission can be started
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return errBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		return errBreakerOpen
+	}
+	return nil
+}
+
+// isOpen checks the breaker stops the submissions now
+// The open breaker whose timeout is over allows the probe, so it isn't open.
+func (b *breaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == breakerHalfOpen || (b.state == breakerOpen && time.Since(b.openedAt) < b.openTimeout)
+}
+
+// report records the result of the allowed submission
+// The collector is healthy if it replies, even though it rejects the packet.
+func (b *breaker) report(err error) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil || classifyError(err) != errorRetryable {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState changes the state of the breaker (b.mutex must be held)
+func (b *breaker) setState(state int) {
+	if b.state != state {
+		log.Printf("circuit breaker of %s is %s (previous: %s)\n", b.addr, breakerStates[state], breakerStates[b.state])
+	}
+	b.state = state
+	breakerState.Set(float64(state), b.addr)
+}
+
+// setRetry applies the retry and breaker settings of the configuration
+func (t *Transport) setRetry(config s.Config) {
+	t.mutex.Lock()
+	t.retry = newRetryPolicy(config)
+	t.mutex.Unlock()
+	for _, e := range t.endpoints {
+		e.breaker.setConfig(config)
+	}
+}
+
+// getRetryPolicy returns the current retry policy
+func (t *Transport) getRetryPolicy() retryPolicy {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.retry
+}
+
+// push submits the packet and its delivery metadata to the port of the endpoint picked by the strategy
+// The collector receives the current file map table first if it hasn't seen it yet.
+func (t *Transport) push(name string, packet *rpc.LogMessage, headers map[string]string) error {
+	return t.withRetry(name, func(e *endpoint, timeout time.Duration) error {
+		if err := t.syncInit(e, timeout); err != nil {
+			return err
+		}
+		return t.attempt(name, e, packet, headers, timeout)
+	})
+}
+
+// pushInit sends the current file map table to the endpoint picked by the strategy
+func (t *Transport) pushInit() error {
+	return t.withRetry("init", t.sendInit)
+}
+
+// withRetry calls the send function and retries the retryable errors with the exponential backoff
+// The full ring of the collector is retried until it has room, and the connection
+// errors are retried up to the max attempts. The fatal error is returned immediately.
+// The endpoint of the connection error becomes unhealthy, so the retry moves to the next one.
+// The collector which lost the file map table receives the Init packet again on the retry.
+func (t *Transport) withRetry(name string, send func(*endpoint, time.Duration) error) error {
+	policy := t.getRetryPolicy()
+	for retry := uint64(0); ; retry++ {
+		if retry > 0 {
+			if err := t.sleep(policy.backoff(retry)); err != nil {
+				return err
+			}
+		}
+		e := t.pickEndpoint(retry)
+		err := send(e, policy.callTimeout)
+		if err == nil {
+			return nil
+		}
+		class := classifyError(err)
+		if e != nil && class == errorRetryable && err != errBreakerOpen {
+			e.setHealthy(false)
+		}
+		if e != nil && class == errorUnregistered {
+			log.Printf("collector %s lost the file map table: %v\n", e.addr, err)
+			e.setMapVersion(0)
+		}
+		if class == errorFatal || (class != errorBackpressure && retry+1 >= policy.maxAttempts) {
+			return err
+		}
+		log.Printf("%s port error detected, retry: %v\n", name, err)
+	}
+}
+
+// syncInit sends the file map table to the endpoint if it has the old version
+func (t *Transport) syncInit(e *endpoint, timeout time.Duration) error {
+	if e == nil || e.getMapVersion() == t.getMapVersion() {
+		return nil
+	}
+	log.Printf("file map table is sent to %s before the traffic\n", e.addr)
+	return t.sendInit(e, timeout)
+}
+
+// sendInit sends the current file map table to the endpoint and records its version
+func (t *Transport) sendInit(e *endpoint, timeout time.Duration) error {
+	t.mutex.Lock()
+	packet := &rpc.LogMessage{}
+	packet.Namespace = t.namespace
+	packet.Files.MapTable = append([]string{}, t.packetMap...)
+	version := t.mapVersion
+	t.mutex.Unlock()
+	err := t.attempt("init", e, packet, nil, timeout)
+	if err == nil && e != nil {
+		e.setMapVersion(version)
+	}
+	return err
+}
+
+// getMapVersion returns the version of the current file map table
+func (t *Transport) getMapVersion() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.mapVersion
+}
+
+// attempt submits the packet to the endpoint once within the call timeout
+// If the acknowledgement is required, the reply must have the sequence of the packet.
+func (t *Transport) attempt(name string, e *endpoint, packet *rpc.LogMessage, headers map[string]string, timeout time.Duration) error {
+	breaker := e.getBreaker()
+	if err := breaker.allow(); err != nil {
+		submitErrors.Inc(name)
+		return err
+	}
+	metadata := t.getMetadata(name)
+	for key, value := range headers {
+		metadata[key] = value
+	}
+	t.signer.Sign(metadata, name, packet, time.Now())
+	reply := make(map[string]string)
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, metadata)
+	ctx = context.WithValue(ctx, share.ResMetaDataKey, reply)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	err := t.submit(ctx, packet, e.client(name))
+	if err == nil && t.requireAck && headers != nil {
+		err = checkAck(headers, reply)
+	}
+	submitLatency.Observe(time.Since(start).Seconds(), name)
+	breaker.report(err)
+	if err != nil {
+		submitErrors.Inc(name)
+		return err
+	}
+	submittedPackets.Inc(name)
+	submittedBytes.Add(float64(len(packet.Buffer)), name)
+	return nil
+}
+
+// getMetadata returns the rpcx metadata of the port
+// The Init packet carries the codec and the dictionary id, so the collector decompresses the cold packets without guessing.
+func (t *Transport) getMetadata(name string) map[string]string {
+	if name != "init" {
+		return map[string]string{}
+	}
+	metadata := map[string]string{MetaCompression: t.codec, MetaFraming: strconv.FormatBool(t.framing)}
+	if t.dictID != 0 {
+		metadata[MetaDictionary] = strconv.FormatUint(uint64(t.dictID), 10)
+	}
+	return metadata
+}
+
+// sleep waits for the backoff and returns errClosed if the transport is closed meanwhile
+func (t *Transport) sleep(delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-t.closed:
+		return errClosed
+	case <-timer.C:
+		return nil
+	}
+}
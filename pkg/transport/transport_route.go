@@ -0,0 +1,313 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+	"github.com/soyoslab/soy_log_generator/pkg/sink"
+)
+
+const (
+	// defaultBatchSize is the number of the messages sent to the sinks of the route at once
+	defaultBatchSize = 100
+	// defaultBatchTimeout is the interval to send the pending batches of the route
+	defaultBatchTimeout = time.Duration(1000) * time.Millisecond
+	// defaultQueueSize is the number of the messages queued in the route
+	defaultQueueSize = 1024
+)
+
+var (
+	routedMessages  = metrics.DefaultRegistry.NewCounter("generator_routed_messages_total", "Number of the messages queued to the route.", "route")
+	droppedMessages = metrics.DefaultRegistry.NewCounter("generator_route_dropped_messages_total", "Number of the messages dropped by the full queue of the route.", "route")
+)
+
+// routedMessage is the message queued in the route with its class
+type routedMessage struct {
+	class   string
+	message s.Message
+}
+
+// route copies the matching messages to its sinks by its own goroutine
+// The full queue drops the messages, so the slow sinks don't stall the others.
+// The mutex guards closed, so no message is queued after the queue is drained.
+type route struct {
+	name         string
+	files        []string
+	classes      map[string]bool
+	rules        map[string]bool
+	pattern      *regexp.Regexp
+	sinks        []namedSink
+	batchSize    int
+	batchTimeout time.Duration
+	queue        chan routedMessage
+	done         chan bool
+	closed       bool
+	mutex        sync.Mutex
+	wait         sync.WaitGroup
+}
+
+// toSet returns the set of the values (nil if there is no value)
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// newRoute makes the route of the config to the sinks
+// The name of the route defaults to its index.
+func newRoute(config s.Route, index int, sinks map[string]sink.Sink) (*route, error) {
+	var err error
+	r := &route{name: config.Name, files: config.Files, classes: toSet(config.Classes), rules: toSet(config.Rules)}
+	if len(r.name) == 0 {
+		r.name = fmt.Sprintf("route-%d", index)
+	}
+	for _, pattern := range r.files {
+		if _, err = filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("route %s: invalid file pattern %q", r.name, pattern)
+		}
+	}
+	for class := range r.classes {
+		if class != sink.Hot && class != sink.Cold {
+			return nil, fmt.Errorf("route %s: invalid class %q", r.name, class)
+		}
+	}
+	if len(config.Pattern) != 0 {
+		if r.pattern, err = regexp.Compile(config.Pattern); err != nil {
+			return nil, fmt.Errorf("route %s: %v", r.name, err)
+		}
+	}
+	if len(config.Sinks) == 0 {
+		return nil, fmt.Errorf("route %s: sinks must be specified", r.name)
+	}
+	for _, name := range config.Sinks {
+		output, ok := sinks[name]
+		if !ok {
+			return nil, fmt.Errorf("route %s: unknown sink %q", r.name, name)
+		}
+		r.sinks = append(r.sinks, namedSink{name: name, sink: output})
+	}
+	r.batchSize, r.batchTimeout = int(config.BatchSize), time.Duration(config.BatchTimeout)*time.Millisecond
+	if r.batchSize == 0 {
+		r.batchSize = defaultBatchSize
+	}
+	if r.batchTimeout == 0 {
+		r.batchTimeout = defaultBatchTimeout
+	}
+	queueSize := int(config.QueueSize)
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+	r.queue = make(chan routedMessage, queueSize)
+	r.done = make(chan bool)
+	return r, nil
+}
+
+// match checks the message of the class matches all the conditions of the route
+func (r *route) match(class string, message s.Message) bool {
+	if r.classes != nil && !r.classes[class] {
+		return false
+	}
+	if r.rules != nil && !r.rules[message.Info.Rule] {
+		return false
+	}
+	if len(r.files) > 0 {
+		matched := false
+		for _, pattern := range r.files {
+			if ok, _ := filepath.Match(pattern, message.Info.Filename); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return r.pattern == nil || r.pattern.Match(message.Data)
+}
+
+// push queues the message without blocking and reports whether it is queued
+// The message pushed after the route is closed is dropped, and the ticket of the dropped
+// message is left undone, so the restart replays it.
+func (r *route) push(class string, message s.Message) bool {
+	r.mutex.Lock()
+	queued := false
+	if !r.closed {
+		select {
+		case r.queue <- routedMessage{class: class, message: message}:
+			queued = true
+		default:
+		}
+	}
+	r.mutex.Unlock()
+	if queued {
+		routedMessages.Inc(r.name)
+		return true
+	}
+	droppedMessages.Inc(r.name)
+	return false
+}
+
+// run sends the queued messages in the batches until the route is closed
+// The queued messages are sent before it returns.
+func (r *route) run() {
+	defer r.wait.Done()
+	batches := make(map[string][]s.Message)
+	ticker := time.NewTicker(r.batchTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-r.queue:
+			batches[m.class] = append(batches[m.class], m.message)
+			if len(batches[m.class]) >= r.batchSize {
+				r.send(m.class, batches[m.class])
+				batches[m.class] = nil
+			}
+			continue
+		case <-ticker.C:
+		case <-r.done:
+			r.drain(batches)
+			return
+		}
+		for class, batch := range batches {
+			r.send(class, batch)
+			delete(batches, class)
+		}
+	}
+}
+
+// drain sends the pending batches and the queued messages
+// The queue is emptied under the mutex, so the messages pushed meanwhile aren't left in it.
+func (r *route) drain(batches map[string][]s.Message) {
+	r.mutex.Lock()
+	for len(r.queue) > 0 {
+		m := <-r.queue
+		batches[m.class] = append(batches[m.class], m.message)
+	}
+	r.mutex.Unlock()
+	for _, class := range []string{sink.Hot, sink.Cold} {
+		r.send(class, batches[class])
+	}
+}
+
+// send sends the batch to all the sinks of the route at the same time
+// The batch which a sink fails to send is dropped for the sink only, and its tickets are
+// left undone, so the restart replays it.
+func (r *route) send(class string, batch []s.Message) {
+	if len(batch) == 0 {
+		return
+	}
+	var wait sync.WaitGroup
+	for _, output := range r.sinks {
+		wait.Add(1)
+		go func(output namedSink) {
+			defer wait.Done()
+			r.sendTo(output, class, batch)
+		}(output)
+	}
+	wait.Wait()
+}
+
+// sendTo sends the batch to the sink of the route
+func (r *route) sendTo(output namedSink, class string, batch []s.Message) {
+	err := output.sink.Send(class, batch)
+	if err == nil {
+		sinkMessages.Add(float64(len(batch)), output.name, class)
+		return
+	}
+	sinkErrors.Inc(output.name, class)
+	log.Printf("route %s: %d %s messages to sink %s are dropped: %v\n", r.name, len(batch), class, output.name, err)
+}
+
+// close stops the route after sending the queued messages
+func (r *route) close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.done)
+	r.mutex.Unlock()
+	r.wait.Wait()
+}
+
+// newSinkRoute makes the route which queues all the messages to the primary sink
+// The sink is sent by the goroutine of the route, so a slow sink doesn't block the collector.
+func newSinkRoute(output namedSink) *route {
+	return &route{
+		name:         "sink:" + output.name,
+		sinks:        []namedSink{output},
+		batchSize:    defaultBatchSize,
+		batchTimeout: defaultBatchTimeout,
+		queue:        make(chan routedMessage, defaultQueueSize),
+		done:         make(chan bool),
+	}
+}
+
+// newRoutes makes the routes of the config and starts them
+// The sinks of the routes don't receive the other messages, and each of the other sinks
+// except the collector gets the route of all the messages.
+func (t *Transport) newRoutes(config s.Config) error {
+	sinks := make(map[string]sink.Sink)
+	for _, output := range t.sinks {
+		sinks[output.name] = output.sink
+	}
+	routed := make(map[string]bool)
+	for i, routeConfig := range config.Routes {
+		r, err := newRoute(routeConfig, i, sinks)
+		if err != nil {
+			return err
+		}
+		for _, output := range r.sinks {
+			routed[output.name] = true
+		}
+		t.routes = append(t.routes, r)
+	}
+	for i, output := range t.sinks {
+		if _, ok := output.sink.(collectorSink); ok || routed[output.name] {
+			t.sinks[i].routed = routed[output.name]
+			continue
+		}
+		t.routes = append(t.routes, newSinkRoute(output))
+		t.sinks[i].routed = true
+	}
+	for _, r := range t.routes {
+		r.wait.Add(1)
+		go r.run()
+	}
+	return nil
+}
+
+// closeRoutes stops the routes after sending the queued messages
+func (t *Transport) closeRoutes() {
+	for _, r := range t.routes {
+		r.close()
+	}
+}
+
+// matchRoutes returns the routes which match each message
+func (t *Transport) matchRoutes(class string, messages []s.Message) [][]*route {
+	matched := make([][]*route, len(messages))
+	if len(t.routes) == 0 {
+		return matched
+	}
+	for i, message := range messages {
+		for _, r := range t.routes {
+			if r.match(class, message) {
+				matched[i] = append(matched[i], r)
+			}
+		}
+	}
+	return matched
+}
@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/delivery"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+// newSession returns the session id which scopes the sequences of the transport
+// The spooled packets keep the session of the previous run, so they are deduplicated correctly.
+func newSession() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// getLines returns the line sequence of each message, which the scheduler assigned when it was read
+func getLines(messages []s.Message) []uint64 {
+	lines := make([]uint64, len(messages))
+	for i, message := range messages {
+		lines[i] = message.Info.Sequence
+	}
+	return lines
+}
+
+// newHeaders assigns the next packet sequence and returns the delivery metadata of the packet
+func (t *Transport) newHeaders(indexes []uint8, lines []uint64) map[string]string {
+	t.mutex.Lock()
+	t.sequence++
+	sequence := t.sequence
+	t.mutex.Unlock()
+	return map[string]string{
+		delivery.MetaSession:  t.session,
+		delivery.MetaSequence: strconv.FormatUint(sequence, 10),
+		delivery.MetaLines:    delivery.EncodeLines(indexes, lines),
+	}
+}
+
+// checkAck checks the collector acknowledged the sequence of the packet
+func checkAck(headers map[string]string, reply map[string]string) error {
+	if reply[delivery.MetaAck] != headers[delivery.MetaSequence] {
+		return fmt.Errorf("packet %s isn't acknowledged (ack: %q)", headers[delivery.MetaSequence], reply[delivery.MetaAck])
+	}
+	return nil
+}
+
+// getTickets returns the checkpoint tickets of the messages
+func getTickets(messages []s.Message) []*checkpoint.Ticket {
+	var tickets []*checkpoint.Ticket
+	for _, message := range messages {
+		if message.Ticket != nil {
+			tickets = append(tickets, message.Ticket)
+		}
+	}
+	return tickets
+}
+
+// hold keeps the checkpoint tickets of the packet until it is acknowledged
+func (t *Transport) hold(headers map[string]string, tickets []*checkpoint.Ticket) {
+	if len(tickets) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	if t.tickets == nil {
+		t.tickets = make(map[string][]*checkpoint.Ticket)
+	}
+	t.tickets[headers[delivery.MetaSequence]] = tickets
+	t.mutex.Unlock()
+}
+
+// release acknowledges the checkpoint tickets of the packet which leaves the transport
+// The packet spooled by the previous run has no tickets because its lines are read again.
+func (t *Transport) release(headers map[string]string) {
+	if headers[delivery.MetaSession] != t.session {
+		return
+	}
+	sequence := headers[delivery.MetaSequence]
+	t.mutex.Lock()
+	tickets := t.tickets[sequence]
+	delete(t.tickets, sequence)
+	t.mutex.Unlock()
+	for _, ticket := range tickets {
+		if err := ticket.Done(); err != nil {
+			log.Println("checkpoint update failed:", err)
+		}
+	}
+}
+
+// forget drops the checkpoint tickets of the packet which is lost before it is acknowledged
+// The tickets are never done, so the checkpoint stays behind their lines and
+// they are read again on the next run.
+func (t *Transport) forget(headers map[string]string) {
+	if headers[delivery.MetaSession] != t.session {
+		return
+	}
+	t.mutex.Lock()
+	delete(t.tickets, headers[delivery.MetaSequence])
+	t.mutex.Unlock()
+}
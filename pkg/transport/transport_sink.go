@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/soyoslab/soy_log_generator/pkg/metrics"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+	"github.com/soyoslab/soy_log_generator/pkg/sink"
+)
+
+var (
+	sinkMessages = metrics.DefaultRegistry.NewCounter("generator_sink_messages_total", "Number of the messages sent to the sink.", "sink", "class")
+	sinkErrors   = metrics.DefaultRegistry.NewCounter("generator_sink_errors_total", "Number of the failed sends to the sink.", "sink", "class")
+)
+
+// namedSink is the sink with its config name
+// The routed sink receives the messages of its routes (or of its own queue) only.
+type namedSink struct {
+	name   string
+	sink   sink.Sink
+	routed bool
+}
+
+// collectorSink is the Sink of the rpcx collector by the transport
+type collectorSink struct {
+	t *Transport
+}
+
+// Init sends the file map table to the collector
+func (c collectorSink) Init(files []s.File) error {
+	return c.t.initFiles(files)
+}
+
+// Send submits the hot messages or buffers the cold messages
+func (c collectorSink) Send(class string, messages []s.Message) error {
+	if class == sink.Hot {
+		return c.t.submitHot(messages)
+	}
+	return c.t.submitCold(messages)
+}
+
+// Flush submits the pending cold packet
+func (c collectorSink) Flush() error {
+	return c.t.flushCold(true)
+}
+
+// Close does nothing because the clients are closed by the transport
+func (c collectorSink) Close() error {
+	return nil
+}
+
+// getSinkConfigs returns the sink configs (the collector if nothing is specified)
+func getSinkConfigs(config s.Config) []s.Sink {
+	if len(config.Sinks) == 0 {
+		return []s.Sink{{Type: sink.TypeCollector}}
+	}
+	return config.Sinks
+}
+
+// hasCollector checks the collector is one of the sinks
+func hasCollector(config s.Config) bool {
+	for _, sinkConfig := range getSinkConfigs(config) {
+		if sinkConfig.Type == sink.TypeCollector {
+			return true
+		}
+	}
+	return false
+}
+
+// newSinks makes the sinks of the config
+// The names of the sinks must be unique and there is at most one collector.
+func (t *Transport) newSinks(config s.Config, source sink.Source) error {
+	names, collector := make(map[string]bool), false
+	for _, sinkConfig := range getSinkConfigs(config) {
+		var (
+			output sink.Sink
+			err    error
+		)
+		name := sink.GetName(sinkConfig)
+		if names[name] {
+			return fmt.Errorf("duplicated sink name %q", name)
+		}
+		names[name] = true
+		if sinkConfig.Type == sink.TypeCollector {
+			if collector {
+				return fmt.Errorf("collector sink is specified twice (name: %s)", name)
+			}
+			collector = true
+			output = collectorSink{t}
+		} else if output, err = sink.New(sinkConfig, source); err != nil {
+			return fmt.Errorf("sink %s: %v", name, err)
+		}
+		t.sinks = append(t.sinks, namedSink{name: name, sink: output})
+	}
+	return nil
+}
+
+// getSinks returns the sinks (the collector if they aren't made)
+func (t *Transport) getSinks() []namedSink {
+	if len(t.sinks) == 0 {
+		return []namedSink{{name: sink.TypeCollector, sink: collectorSink{t}}}
+	}
+	return t.sinks
+}
+
+// getPrimarySinks returns the sinks which receive all the messages synchronously
+func (t *Transport) getPrimarySinks() []namedSink {
+	sinks := []namedSink{}
+	for _, output := range t.getSinks() {
+		if !output.routed {
+			sinks = append(sinks, output)
+		}
+	}
+	return sinks
+}
+
+// dispatch sends the messages to the primary sinks and copies them to the matching routes
+// The primary sink is the collector unless it is routed, because the other sinks are queued.
+// The checkpoint ticket of the message is done after all of them deliver it, so the message
+// which a sink drops is replayed by the restart.
+// The failure of a sink doesn't stop the others, and only the collector's failure is returned.
+func (t *Transport) dispatch(class string, messages []s.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	sinks := t.getPrimarySinks()
+	matched := t.matchRoutes(class, messages)
+	for i, message := range messages {
+		refs := len(sinks)
+		for _, r := range matched[i] {
+			refs += len(r.sinks)
+		}
+		if refs == 0 {
+			sink.Acknowledge([]s.Message{message})
+		} else {
+			message.Ticket.Add(refs - 1)
+		}
+	}
+	for i, message := range messages {
+		for _, r := range matched[i] {
+			r.push(class, message)
+		}
+	}
+	var err error
+	for _, output := range sinks {
+		if sendErr := output.sink.Send(class, messages); sendErr != nil {
+			sinkErrors.Inc(output.name, class)
+			if _, ok := output.sink.(collectorSink); ok {
+				err = fmt.Errorf("sink %s: %v", output.name, sendErr)
+				continue
+			}
+			log.Printf("sink %s: %d %s messages are dropped: %v\n", output.name, len(messages), class, sendErr)
+			continue
+		}
+		sinkMessages.Add(float64(len(messages)), output.name, class)
+	}
+	return err
+}
+
+// hotSubmitFunc sends the hot messages to the sinks
+func (t *Transport) hotSubmitFunc(messages []s.Message) error {
+	return exceptionHandler(t, t.dispatch(sink.Hot, messages))
+}
+
+// coldSubmitFunc sends the cold messages to the sinks
+func (t *Transport) coldSubmitFunc(messages []s.Message) error {
+	return exceptionHandler(t, t.dispatch(sink.Cold, messages))
+}
+
+// initSubmitFunc sends the changed files to the sinks
+func (t *Transport) initSubmitFunc(files []s.File) error {
+	for _, output := range t.getSinks() {
+		if err := output.sink.Init(files); err != nil {
+			return fmt.Errorf("sink %s: %v", output.name, err)
+		}
+	}
+	return nil
+}
+
+// closeSinks closes the sinks which flush their pending messages
+func (t *Transport) closeSinks() {
+	for _, output := range t.sinks {
+		if err := output.sink.Close(); err != nil {
+			log.Printf("sink %s close failed: %v\n", output.name, err)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/soyoslab/soy_log_collector/pkg/rpc"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
+	"github.com/soyoslab/soy_log_generator/pkg/delivery"
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+	"github.com/soyoslab/soy_log_generator/pkg/spool"
+)
+
+// spoolRetryInterval is the interval to replay the spooled packets
+const spoolRetryInterval = time.Duration(1000) * time.Millisecond
+
+// spooledPacket is the record of the spool
+// Files is the file map table when the packet is spooled, so the file indexes
+// of the packet are converted to the table when it is replayed.
+type spooledPacket struct {
+	Port      string            `json:"port"`
+	Timestamp int64             `json:"timestamp"`
+	Packet    rpc.LogMessage    `json:"packet"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Files     []string          `json:"files,omitempty"`
+}
+
+// evictedPacket is the part of the spooled packet which is needed when it is evicted
+type evictedPacket struct {
+	Port      string            `json:"port"`
+	Timestamp int64             `json:"timestamp"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// initSpool opens the spool and starts the drainer if the spool path is specified
+// Without the spool path, the unacknowledged packets are kept in the memory for
+// the retransmission if the acknowledgement is required.
+func (t *Transport) initSpool(config s.Config) error {
+	if len(config.SpoolPath) != 0 {
+		queue, err := spool.Open(config.SpoolPath, 0, int64(config.SpoolMaxBytes))
+		if err != nil {
+			return err
+		}
+		queue.SetSyncInterval(time.Duration(config.SpoolSync) * time.Millisecond)
+		t.spool = queue
+	} else if t.requireAck {
+		t.spool = newMemoryQueue(int64(config.SpoolMaxBytes))
+	} else {
+		return nil
+	}
+	t.spoolMaxAge = time.Duration(config.SpoolMaxAge) * time.Second
+	t.spool.SetEviction(t.spoolMaxAge, t.evict)
+	t.drainKick = make(chan bool, 1)
+	t.drainDone = make(chan bool)
+	t.drainWait.Add(1)
+	go t.drain()
+	return nil
+}
+
+// deliver assigns the sequence to the packet and submits it or stores it to the spool when the collector is unreachable
+// While the spool has the packets, the new packets are also spooled to keep the order.
+// The unacknowledged packet is spooled with its sequence, so the collector deduplicates the retransmission.
+// The checkpoint tickets of the packet are done only when the collector accepts it.
+func (t *Transport) deliver(name string, packet *rpc.LogMessage, lines []uint64, tickets []*checkpoint.Ticket) error {
+	headers := t.newHeaders(packet.Files.Indexes, lines)
+	t.hold(headers, tickets)
+	if t.spool != nil && t.spool.Len() > 0 {
+		return t.store(name, packet, headers)
+	}
+	err := t.push(name, packet, headers)
+	if err == nil {
+		t.release(headers)
+		return nil
+	}
+	if t.spool != nil && isRetryable(err) {
+		log.Printf("%s port submit failed, the packet is spooled: %v\n", name, err)
+		return t.store(name, packet, headers)
+	}
+	t.forget(headers)
+	return err
+}
+
+// store appends the packet and its delivery metadata to the spool and wakes up the drainer
+// The spool evicts the expired and the oldest packets to make room. The packet
+// which doesn't fit in the spool by itself is sent directly by await.
+func (t *Transport) store(name string, packet *rpc.LogMessage, headers map[string]string) error {
+	t.mutex.Lock()
+	files := append([]string{}, t.packetMap...)
+	t.mutex.Unlock()
+	b, err := json.Marshal(spooledPacket{Port: name, Timestamp: time.Now().UnixNano(), Packet: *packet, Metadata: headers, Files: files})
+	if err != nil {
+		t.forget(headers)
+		return err
+	}
+	err = t.spool.Push(b)
+	if err == spool.ErrFull || err == spool.ErrTooLarge {
+		log.Printf("%s packet doesn't fit in the spool, wait for the collector: %v\n", name, err)
+		return t.await(name, packet, headers)
+	} else if err != nil {
+		t.forget(headers)
+		return err
+	}
+	select {
+	case t.drainKick <- true:
+	default:
+	}
+	return nil
+}
+
+// await blocks the submission until the packet which cannot be spooled is accepted by the collector
+// The packet is sent after the spooled packets are replayed to keep the order.
+func (t *Transport) await(name string, packet *rpc.LogMessage, headers map[string]string) error {
+	for {
+		if t.spool.Len() == 0 {
+			err := t.push(name, packet, headers)
+			if err == nil {
+				t.release(headers)
+				return nil
+			} else if !isRetryable(err) {
+				t.forget(headers)
+				return err
+			}
+		}
+		if err := t.sleep(spoolRetryInterval); err != nil {
+			t.forget(headers)
+			return err
+		}
+	}
+}
+
+// evict discards the packet which is evicted from the spool to make room
+// Its lines aren't delivered, so their checkpoint tickets are never done.
+func (t *Transport) evict(b []byte) {
+	entry := evictedPacket{}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		log.Println("broken spooled packet is evicted:", err)
+		return
+	}
+	log.Printf("%s packet is evicted from the spool (spooled at %v)\n", entry.Port, time.Unix(0, entry.Timestamp))
+	t.forget(entry.Metadata)
+}
+
+// drain replays the spooled packets until the transport is closed
+func (t *Transport) drain() {
+	defer t.drainWait.Done()
+	for {
+		select {
+		case <-t.drainDone:
+			return
+		case <-t.drainKick:
+		case <-time.After(spoolRetryInterval):
+		}
+		if err := t.replay(); err != nil {
+			log.Println("spooled packet replay failed, retry later:", err)
+		}
+	}
+}
+
+// replay submits the spooled packets in order
+// The packet is removed after the submission succeeds, so the failed packet is retried later.
+// The broken and expired packets and the packets rejected by the collector are discarded,
+// and only the checkpoint tickets of the accepted packets are done.
+// The packet which is evicted during the submission is not removed again.
+func (t *Transport) replay() error {
+	for t.spool.Len() > 0 {
+		b, position, err := t.spool.Front()
+		if err != nil {
+			return err
+		}
+		entry, accepted := spooledPacket{}, false
+		if err = json.Unmarshal(b, &entry); err != nil {
+			log.Println("broken spooled packet is discarded:", err)
+		} else if entry.Port != "hot" && entry.Port != "cold" {
+			log.Printf("spooled packet is discarded: invalid port name %q\n", entry.Port)
+		} else if t.spoolMaxAge > 0 && time.Since(time.Unix(0, entry.Timestamp)) > t.spoolMaxAge {
+			log.Printf("expired %s packet is discarded (spooled at %v)\n", entry.Port, time.Unix(0, entry.Timestamp))
+		} else if err = t.replayPacket(entry); err != nil && isRetryable(err) {
+			return err
+		} else if err != nil {
+			log.Printf("%s packet is rejected and discarded: %v\n", entry.Port, err)
+		} else {
+			accepted = true
+		}
+		if err = t.spool.Remove(position); err != nil {
+			return err
+		}
+		if accepted {
+			t.release(entry.Metadata)
+		} else {
+			t.forget(entry.Metadata)
+		}
+		select {
+		case <-t.drainDone:
+			return nil
+		default:
+		}
+	}
+	return nil
+}
+
+// replayPacket submits the spooled packet to its port
+func (t *Transport) replayPacket(entry spooledPacket) error {
+	if err := t.remap(&entry); err != nil {
+		return err
+	}
+	return t.push(entry.Port, &entry.Packet, entry.Metadata)
+}
+
+// remap converts the file indexes of the spooled packet to the current file map table
+// The file which has left the table is assigned again, so the collector receives
+// it by the Init packet before the replay.
+func (t *Transport) remap(entry *spooledPacket) error {
+	if len(entry.Files) == 0 {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	used := make(map[uint8]bool)
+	for _, idx := range entry.Packet.Files.Indexes {
+		used[idx] = true
+	}
+	indexes := make([]uint8, len(entry.Files))
+	for i, filename := range entry.Files {
+		idx, ok := t.fileMap[filename]
+		if !ok && used[uint8(i)] {
+			if len(filename) == 0 {
+				return fmt.Errorf("spooled packet has the released file index %d", i)
+			}
+			var err error
+			if idx, err = t.assignIndex(filename); err != nil {
+				return err
+			}
+			t.mapVersion++
+		}
+		indexes[i] = idx
+	}
+	for i, idx := range entry.Packet.Files.Indexes {
+		if int(idx) >= len(indexes) {
+			return fmt.Errorf("spooled packet has the invalid file index %d", idx)
+		}
+		entry.Packet.Files.Indexes[i] = indexes[idx]
+	}
+	if encoded, ok := entry.Metadata[delivery.MetaLines]; ok {
+		lineIndexes, lines, err := delivery.DecodeLines(encoded, len(entry.Packet.Files.Indexes))
+		if err != nil {
+			return err
+		}
+		for i, idx := range lineIndexes {
+			if int(idx) < len(indexes) {
+				lineIndexes[i] = indexes[idx]
+			}
+		}
+		entry.Metadata[delivery.MetaLines] = delivery.EncodeLines(lineIndexes, lines)
+	}
+	return nil
+}
+
+// closeSpool stops the drainer and closes the spool
+// The remaining packets are replayed on the next run.
+func (t *Transport) closeSpool() {
+	if t.spool == nil {
+		return
+	}
+	select {
+	case <-t.drainDone:
+		return
+	default:
+		close(t.drainDone)
+	}
+	t.drainWait.Wait()
+	if err := t.spool.Close(); err != nil {
+		log.Println("spool close failed:", err)
+	}
+}
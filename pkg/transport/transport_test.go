@@ -2,19 +2,40 @@ package transport
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	rpcx "github.com/smallnest/rpcx/client"
+	"github.com/smallnest/rpcx/share"
 	"github.com/soyoslab/soy_log_collector/pkg/rpc"
 	"github.com/soyoslab/soy_log_generator/internal/app/server"
+	"github.com/soyoslab/soy_log_generator/pkg/auth"
+	"github.com/soyoslab/soy_log_generator/pkg/checkpoint"
 	c "github.com/soyoslab/soy_log_generator/pkg/compressor"
+	"github.com/soyoslab/soy_log_generator/pkg/delivery"
 	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+	"github.com/soyoslab/soy_log_generator/pkg/sink"
 )
 
 const ConfigTest = `{
@@ -31,7 +52,7 @@ const ConfigTest = `{
 
 func TestPortClose(t *testing.T) {
 	addr := getAddr("localhost", "8972")
-	xclient, err := getXClient(addr, "HotPort")
+	xclient, err := getXClient(addr, "HotPort", time.Second, nil)
 	if err != nil {
 		t.Errorf("port close failed: %v", err)
 	}
@@ -137,8 +158,8 @@ func TestInvalidSubmit(t *testing.T) {
 	fileMap["test"] = 0
 	packetMap := []string{"test"}
 	packet, _ := getPacket(messages, fileMap, packetMap)
-	xclient, _ := getXClient("localhost:8972", "NONE")
-	err := Submit(&packet, xclient)
+	xclient, _ := getXClient("localhost:8972", "NONE", time.Second, nil)
+	err := Submit(context.Background(), &packet, xclient)
 	if err == nil {
 		t.Errorf("invalid submit requested but it works")
 	}
@@ -146,7 +167,7 @@ func TestInvalidSubmit(t *testing.T) {
 
 func validSubmitFunc(t *testing.T, trans *Transport, f func([]s.Message) error) {
 	messages := messageGeneration("test", 4, false)
-	trans.submit = func(msg *rpc.LogMessage, _ rpcx.XClient) error {
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
 		if msg == nil {
 			t.Errorf("invalid hot submit detected")
 		}
@@ -178,7 +199,7 @@ func TestColdSubmitFunc(t *testing.T) {
 }
 
 func invalidSubmitFunc(t *testing.T, target string, isCompressed bool, trans *Transport, f func([]s.Message) error) {
-	trans.submit = func(msg *rpc.LogMessage, _ rpcx.XClient) error {
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
 		if msg == nil {
 			t.Errorf("invalid hot submit detected")
 		}
@@ -196,7 +217,7 @@ func invalidSubmitFunc(t *testing.T, target string, isCompressed bool, trans *Tr
 		t.Errorf("%s invalid message info but it evaluates valid", target)
 	}
 
-	trans.submit = func(msg *rpc.LogMessage, _ rpcx.XClient) error {
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
 		return errors.New("test")
 	}
 	messages = messageGeneration("test", 4, isCompressed)
@@ -231,3 +252,1403 @@ func TestMain(m *testing.M) {
 	log.SetFlags(log.Lshortfile)
 	os.Exit(m.Run())
 }
+
+func TestUpdateFileMap(t *testing.T) {
+	trans := Transport{}
+	trans.fileMap = make(map[string]uint8)
+	trans.packetMap = []string{}
+	trans.updateFileMap([]s.File{{Filename: "a"}, {Filename: "b"}})
+	trans.updateFileMap([]s.File{{Filename: "b"}, {Filename: "c"}})
+	if trans.fileMap["b"] != 1 || trans.fileMap["c"] != 2 {
+		t.Errorf("index of the existing file is changed %v", trans.fileMap)
+	}
+	if _, ok := trans.fileMap["a"]; ok || trans.packetMap[0] != "" {
+		t.Errorf("removed file remains %v", trans.packetMap)
+	}
+
+	files := []s.File{}
+	for i := 0; i < 257; i++ {
+		files = append(files, s.File{Filename: fmt.Sprintf("file-%d", i)})
+	}
+	if err := trans.updateFileMap(files); err == nil {
+		t.Errorf("file map table overflow is accepted")
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-spool-test")
+	if err != nil {
+		log.Fatalf("spool directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	trans := Transport{}
+	trans.fileMap = map[string]uint8{"test1.txt": 0}
+	trans.packetMap = []string{"test1.txt"}
+	trans.namespace = "test"
+	if err = trans.initSpool(s.Config{SpoolPath: dir, SpoolMaxAge: 60}); err != nil {
+		t.Fatalf("spool initialization failed %v", err)
+	}
+	defer trans.closeSpool()
+
+	submitted := make(chan string, 4)
+	online := int32(0)
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
+		if atomic.LoadInt32(&online) == 0 {
+			return errors.New("connection refused")
+		}
+		submitted <- string(msg.Buffer)
+		return nil
+	}
+	for _, data := range []string{"first", "second"} {
+		if err = trans.hotSubmitFunc(messageGeneration(data, uint64(len(data)), false)); err != nil {
+			t.Errorf("unreachable collector closes the transport %v", err)
+		}
+	}
+	if trans.spool.Len() != 2 {
+		t.Fatalf("failed packets aren't spooled (length: %d)", trans.spool.Len())
+	}
+
+	atomic.StoreInt32(&online, 1)
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case data := <-submitted:
+			if data != expected {
+				t.Errorf("spooled packets aren't replayed in order (expected: %s, result: %s)", expected, data)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("spooled packet isn't replayed")
+		}
+	}
+}
+
+func TestSpoolRemap(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-spool-remap-test")
+	if err != nil {
+		log.Fatalf("spool directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	trans := Transport{}
+	trans.fileMap = map[string]uint8{"other.txt": 0, "test1.txt": 1}
+	trans.packetMap = []string{"other.txt", "test1.txt"}
+	trans.namespace = "test"
+	if err = trans.initSpool(s.Config{SpoolPath: dir}); err != nil {
+		t.Fatalf("spool initialization failed %v", err)
+	}
+	defer trans.closeSpool()
+
+	submitted := make(chan []uint8, 1)
+	online := int32(0)
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
+		if atomic.LoadInt32(&online) == 0 {
+			return errors.New("connection refused")
+		}
+		submitted <- msg.Files.Indexes
+		return nil
+	}
+	if err = trans.hotSubmitFunc(messageGeneration("remap", 5, false)); err != nil {
+		t.Errorf("unreachable collector closes the transport %v", err)
+	}
+	trans.mutex.Lock()
+	trans.updateFileMap([]s.File{{Filename: "other.txt"}, {Filename: "new.txt"}})
+	trans.mutex.Unlock()
+
+	atomic.StoreInt32(&online, 1)
+	select {
+	case indexes := <-submitted:
+		trans.mutex.Lock()
+		defer trans.mutex.Unlock()
+		if len(indexes) != 1 || trans.packetMap[indexes[0]] != "test1.txt" {
+			t.Errorf("spooled packet isn't remapped (indexes: %v, table: %v)", indexes, trans.packetMap)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("spooled packet isn't replayed")
+	}
+}
+
+func TestCheckpointAck(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-checkpoint-test")
+	if err != nil {
+		log.Fatalf("spool directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file, _ := os.Create(filepath.Join(dir, "test1.txt"))
+	defer file.Close()
+	file.WriteString("first\nsecond\n")
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	tracker := checkpoint.NewTracker(registry, file.Name(), file)
+
+	trans := Transport{}
+	trans.fileMap = map[string]uint8{"test1.txt": 0}
+	trans.packetMap = []string{"test1.txt"}
+	trans.session = newSession()
+	trans.compressor = &c.GzipComp{}
+	if err = trans.initSpool(s.Config{SpoolPath: filepath.Join(dir, "spool")}); err != nil {
+		t.Fatalf("spool initialization failed %v", err)
+	}
+	defer trans.closeSpool()
+	online := int32(0)
+	trans.submit = func(_ context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		if atomic.LoadInt32(&online) == 0 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	for i, offset := range []int64{6, 13} {
+		messages := messageGeneration("test", 4, false)
+		messages[0].Ticket = tracker.At(offset).Track()
+		if i == 0 {
+			err = trans.hotSubmitFunc(messages)
+		} else {
+			err = trans.coldSubmitFunc(messages)
+		}
+		if err != nil {
+			t.Fatalf("unreachable collector closes the transport %v", err)
+		}
+	}
+	if err = trans.flushCold(true); err != nil {
+		t.Fatalf("cold packet flush failed %v", err)
+	}
+	if _, ok := registry.Get(file.Name()); ok || tracker.Pending() != 2 {
+		t.Fatalf("unacknowledged lines are committed (pending: %d)", tracker.Pending())
+	}
+
+	atomic.StoreInt32(&online, 1)
+	deadline := time.Now().Add(time.Second * 5)
+	for tracker.Pending() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if entry, _ := registry.Get(file.Name()); entry.Offset != 13 {
+		t.Errorf("acknowledged lines aren't committed (offset: %d, pending: %d)", entry.Offset, tracker.Pending())
+	}
+}
+
+func TestSpoolDiscardTickets(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-spool-discard-test")
+	if err != nil {
+		log.Fatalf("spool directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file, _ := os.Create(filepath.Join(dir, "test1.txt"))
+	defer file.Close()
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	state := int32(0)
+	submit := func(_ context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		switch atomic.LoadInt32(&state) {
+		case 0:
+			return errors.New("connection refused")
+		case 1:
+			return rpcx.ServiceError("invalid packet")
+		}
+		return nil
+	}
+	newTransport := func(config s.Config) *Transport {
+		trans := &Transport{}
+		trans.fileMap = map[string]uint8{"test1.txt": 0}
+		trans.packetMap = []string{"test1.txt"}
+		trans.session = newSession()
+		trans.compressor = &c.GzipComp{}
+		trans.submit = submit
+		if err = trans.initSpool(config); err != nil {
+			t.Fatalf("spool initialization failed %v", err)
+		}
+		return trans
+	}
+
+	trans := newTransport(s.Config{SpoolPath: filepath.Join(dir, "spool")})
+	tracker := checkpoint.NewTracker(registry, file.Name(), file)
+	messages := messageGeneration("test", 4, false)
+	messages[0].Ticket = tracker.At(6).Track()
+	if err = trans.hotSubmitFunc(messages); err != nil {
+		t.Fatalf("unreachable collector closes the transport %v", err)
+	}
+	atomic.StoreInt32(&state, 1)
+	deadline := time.Now().Add(time.Second * 5)
+	for trans.spool.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	trans.closeSpool()
+	if trans.spool.Len() != 0 || tracker.Pending() != 1 {
+		t.Errorf("rejected packet is counted as done (spooled: %d, pending: %d)", trans.spool.Len(), tracker.Pending())
+	}
+
+	atomic.StoreInt32(&state, 0)
+	trans = newTransport(s.Config{SpoolPath: filepath.Join(dir, "full"), SpoolMaxBytes: 1})
+	defer trans.closeSpool()
+	tracker = checkpoint.NewTracker(registry, file.Name()+".full", file)
+	messages = messageGeneration("test", 4, false)
+	messages[0].Ticket = tracker.At(6).Track()
+	done := make(chan error)
+	go func() {
+		done <- trans.hotSubmitFunc(messages)
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("full spool doesn't block the submission %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	if tracker.Pending() != 1 {
+		t.Errorf("packet which doesn't fit in the spool is counted as done (pending: %d)", tracker.Pending())
+	}
+	atomic.StoreInt32(&state, 2)
+	if err = <-done; err != nil || tracker.Pending() != 0 {
+		t.Errorf("blocked packet isn't delivered (pending: %d, err: %v)", tracker.Pending(), err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	trans := Transport{}
+	trans.closed = make(chan bool)
+	trans.setRetry(s.Config{RetryInitial: 1, RetryMax: 4, RetryJitter: 20, RetryMaxAttempts: 3, BreakerThreshold: 10})
+	attempts := 0
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	if err := trans.push("hot", &rpc.LogMessage{}, nil); err != nil || attempts != 3 {
+		t.Errorf("retryable error isn't retried (attempts: %d, err: %v)", attempts, err)
+	}
+
+	attempts = 0
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		attempts++
+		return rpcx.ServiceError("invalid packet")
+	}
+	if err := trans.push("hot", &rpc.LogMessage{}, nil); err == nil || attempts != 1 {
+		t.Errorf("fatal error is retried (attempts: %d, err: %v)", attempts, err)
+	}
+
+	attempts = 0
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		attempts++
+		if attempts < 5 {
+			return rpcx.ServiceError("ring is full")
+		}
+		return nil
+	}
+	if err := trans.push("hot", &rpc.LogMessage{}, nil); err != nil || attempts != 5 {
+		t.Errorf("full ring isn't retried until it has room (attempts: %d, err: %v)", attempts, err)
+	}
+
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		if _, ok := ctx.Deadline(); ok {
+			t.Errorf("zero call timeout sets the deadline")
+		}
+		return errors.New("connection refused")
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		trans.Close()
+	}()
+	trans.setRetry(s.Config{RetryInitial: 1000, RetryMax: 1000, RetryMaxAttempts: 3})
+	if err := trans.push("hot", &rpc.LogMessage{}, nil); err != errClosed {
+		t.Errorf("close doesn't stop the retry %v", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := new(breaker)
+	b.setConfig(s.Config{BreakerThreshold: 2, BreakerOpen: 20})
+	failure := errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		if err := b.allow(); err != nil {
+			t.Fatalf("closed breaker stops the submission %v", err)
+		}
+		b.report(failure)
+	}
+	if err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("breaker isn't opened after the consecutive failures")
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker doesn't probe after the open timeout %v", err)
+	}
+	if err := b.allow(); err != errBreakerOpen {
+		t.Errorf("half-open breaker allows the concurrent submission")
+	}
+	b.report(failure)
+	if err := b.allow(); err != errBreakerOpen {
+		t.Fatalf("failed probe doesn't open the breaker")
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	b.allow()
+	b.report(rpcx.ServiceError("invalid packet"))
+	if err := b.allow(); err != nil || b.state != breakerClosed {
+		t.Errorf("replying collector doesn't close the breaker %v", err)
+	}
+}
+
+func TestColdFlush(t *testing.T) {
+	trans := Transport{}
+	trans.fileMap = map[string]uint8{"test": 0}
+	trans.packetMap = []string{"test"}
+	trans.namespace = "test"
+	trans.compressor = &c.GzipComp{}
+	trans.closed = make(chan bool)
+	trans.cold.meta.threshold = 4096
+	trans.cold.meta.timeout = time.Millisecond * 50
+	submitted := make(chan int, 4)
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
+		submitted <- len(msg.Info)
+		return nil
+	}
+	go trans.flushLoop()
+
+	if err := trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Fatalf("cold data buffering failed: %v", err)
+	}
+	select {
+	case n := <-submitted:
+		if n != 1 {
+			t.Errorf("expired packet has invalid messages (expected: 1, result: %d)", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expired cold packet isn't flushed without the new input")
+	}
+
+	trans.mutex.Lock()
+	trans.cold.meta.timeout = time.Hour
+	trans.mutex.Unlock()
+	if err := trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Fatalf("cold data buffering failed: %v", err)
+	}
+	select {
+	case <-submitted:
+		t.Fatalf("cold packet is flushed before it expires")
+	case <-time.After(time.Millisecond * 100):
+	}
+	trans.Close()
+	select {
+	case <-submitted:
+	default:
+		t.Errorf("pending cold packet is discarded by close")
+	}
+}
+
+func TestColdFlushFailure(t *testing.T) {
+	trans := Transport{}
+	trans.fileMap = map[string]uint8{"test": 0}
+	trans.packetMap = []string{"test"}
+	trans.namespace = "test"
+	trans.compressor = &c.GzipComp{}
+	trans.closed = make(chan bool)
+	trans.cold.meta.threshold = 4096
+	trans.cold.meta.timeout = time.Millisecond * 50
+	submitted := make(chan int, 4)
+	release := make(chan bool)
+	calls := int32(0)
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			return rpcx.ServiceError("invalid packet")
+		case 2:
+			<-release
+		}
+		submitted <- len(msg.Info)
+		return nil
+	}
+	go trans.flushLoop()
+	defer trans.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+			t.Fatalf("cold data buffering failed: %v", err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&calls) <= int32(i) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("flusher stops after the failed flush (calls: %d)", atomic.LoadInt32(&calls))
+	}
+	buffered := make(chan bool)
+	go func() {
+		trans.bufferCold(rpc.LogMessage{Info: []rpc.LogInfo{{Length: 4}}, Buffer: []byte("test")}, nil, nil)
+		close(buffered)
+	}()
+	select {
+	case <-buffered:
+	case <-time.After(time.Second):
+		t.Errorf("cold message is blocked by the submission")
+	}
+	close(release)
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Errorf("blocked cold packet isn't submitted")
+	}
+}
+
+// setupConfig writes the configuration which has the %q verb of the test file
+func setupConfig(format string) (string, string) {
+	testFile, err := os.CreateTemp("", "transport-config-test")
+	if err != nil {
+		log.Fatalf("test file creation failed: %v", err)
+	}
+	testFile.Close()
+	configFile, err := os.CreateTemp("", "transport-config")
+	if err != nil {
+		log.Fatalf("config file creation failed: %v", err)
+	}
+	fmt.Fprintf(configFile, format, testFile.Name())
+	configFile.Close()
+	return testFile.Name(), configFile.Name()
+}
+
+func TestCompression(t *testing.T) {
+	testFileName, configFileName := setupConfig(`{"compression":"zstd","compressionLevel":3,"coldSendThresholdBytes":0,"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("initialize the transport failed %v", err)
+	}
+	defer trans.Close()
+	if _, ok := trans.compressor.(*c.ZstdComp); !ok {
+		t.Errorf("configured codec isn't used %T", trans.compressor)
+	}
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("collector can't decompress the cold packet: %v", err)
+	}
+
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		metadata, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+		if metadata[MetaCompression] != "zstd" || metadata[MetaFraming] != "false" {
+			t.Errorf("codec isn't sent with the init packet %v", metadata)
+		}
+		return nil
+	}
+	if err = trans.initSubmitFunc(trans.scheduler.GetConfig().Files); err != nil {
+		t.Errorf("init packet submission failed %v", err)
+	}
+}
+
+func TestInvalidCompression(t *testing.T) {
+	testFileName, configFileName := setupConfig(`{"compression":"brotli","files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	if _, err := InitTransport(configFileName, nil); err == nil {
+		t.Errorf("unknown codec is accepted")
+	}
+}
+
+func TestCompressionFraming(t *testing.T) {
+	testFileName, configFileName := setupConfig(`{"compression":"s2","compressionFraming":true,"coldSendThresholdBytes":0,"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("initialize the transport failed %v", err)
+	}
+	defer trans.Close()
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("collector can't decompress the framed cold packet: %v", err)
+	}
+
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
+		buffer, err := c.DecompressAuto(msg.Buffer)
+		if err != nil || string(buffer) != "test" {
+			t.Errorf("framed cold packet isn't decompressed automatically %v", err)
+		}
+		return nil
+	}
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("framed cold packet submission failed %v", err)
+	}
+}
+
+func TestCompressionDictionary(t *testing.T) {
+	samples := [][]byte{}
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("2021-07-19 INFO [worker-%d] job %d finished status=ok\n", i%8, i)))
+	}
+	dict, err := c.TrainZstdDict(samples, 1024, 40001)
+	if err != nil {
+		t.Fatalf("dictionary training failed %v", err)
+	}
+	dictFile, err := os.CreateTemp("", "zstd-dict")
+	if err != nil {
+		t.Fatalf("dictionary file creation failed %v", err)
+	}
+	dictFile.Write(dict)
+	dictFile.Close()
+	defer os.Remove(dictFile.Name())
+
+	testFileName, configFileName := setupConfig(fmt.Sprintf(`{"compression":"zstd","compressionDictionary":%q,"coldSendThresholdBytes":0,"files":[{"filename":%%q}]}`, dictFile.Name()))
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("initialize the transport failed %v", err)
+	}
+	defer trans.Close()
+	if zstd, ok := trans.compressor.(*c.ZstdComp); !ok || zstd.DictID != 40001 {
+		t.Errorf("dictionary isn't used by the compressor %#v", trans.compressor)
+	}
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("collector can't decompress the cold packet by the dictionary: %v", err)
+	}
+
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		metadata, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+		if metadata[MetaDictionary] != "40001" {
+			t.Errorf("dictionary id isn't sent with the init packet %v", metadata)
+		}
+		return nil
+	}
+	if err = trans.initSubmitFunc(trans.scheduler.GetConfig().Files); err != nil {
+		t.Errorf("init packet submission failed %v", err)
+	}
+}
+
+func TestInvalidCompressionDictionary(t *testing.T) {
+	testFileName, configFileName := setupConfig(`{"compression":"gzip","compressionDictionary":"zstd-dict.bin","files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	if _, err := InitTransport(configFileName, nil); err == nil {
+		t.Errorf("dictionary is accepted without the zstd codec")
+	}
+}
+
+// writeCertificate writes the PEM certificate and key signed by the parent (self-signed if nil)
+func writeCertificate(dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		log.Fatalf("key generation failed: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		log.Fatalf("certificate creation failed: %v", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	certificate, _ := x509.ParseCertificate(der)
+	return certificate, key
+}
+
+// setupTLS writes the CA, the server and the client certificates and runs the mutual TLS server
+func setupTLS(dir string, address string) {
+	now := time.Now()
+	ca, caKey := writeCertificate(dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test-ca"}, NotBefore: now, NotAfter: now.Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCertificate(dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "collector"}, NotBefore: now, NotAfter: now.Add(time.Hour),
+		DNSNames: []string{"collector.test"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCertificate(dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "generator"}, NotBefore: now, NotAfter: now.Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	certificate, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		log.Fatalf("server certificate load failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	go server.RunTLS(address, &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	time.Sleep(time.Duration(200) * time.Millisecond)
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-tls")
+	if err != nil {
+		t.Fatalf("certificate directory creation failed %v", err)
+	}
+	defer os.RemoveAll(dir)
+	setupTLS(dir, "localhost:8973")
+
+	base := fmt.Sprintf(`"targetPort":"8973","tls":true,"tlsCaFile":%q,"tlsServerName":"collector.test","retryMaxAttempts":1`, filepath.Join(dir, "ca.pem"))
+	client := fmt.Sprintf(`"tlsCertFile":%q,"tlsKeyFile":%q`, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+
+	testFileName, configFileName := setupConfig(`{` + base + `,` + client + `,"tlsMinVersion":"1.3","coldSendThresholdBytes":0,"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("mutual tls connection failed %v", err)
+	}
+	if err = trans.hotSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("hot packet submission over tls failed %v", err)
+	}
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("cold packet submission over tls failed %v", err)
+	}
+	trans.Close()
+
+	invalidConfigs := map[string]string{
+		"no-client-certificate": `{` + base + `,"files":[{"filename":%q}]}`,
+		"wrong-server-name":     `{` + strings.Replace(base, "collector.test", "other.test", 1) + `,` + client + `,"files":[{"filename":%q}]}`,
+		"plain-tcp":             `{"targetPort":"8973","retryMaxAttempts":1,"callTimeoutMilli":500,"files":[{"filename":%q}]}`,
+		"invalid-version":       `{` + base + `,` + client + `,"tlsMinVersion":"2.0","files":[{"filename":%q}]}`,
+		"key-without-cert":      `{` + base + `,"tlsKeyFile":"client-key.pem","files":[{"filename":%q}]}`,
+	}
+	for name, format := range invalidConfigs {
+		testFileName, configFileName := setupConfig(format)
+		if _, err = InitTransport(configFileName, nil); err == nil {
+			t.Errorf("%s: invalid tls connection is accepted", name)
+		}
+		os.Remove(testFileName)
+		os.Remove(configFileName)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	verifier := &auth.Verifier{Mode: auth.ModeHMAC, Secret: []byte("s3cret")}
+	go server.RunAuth("localhost:8974", verifier)
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	os.Setenv("GENERATOR_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("GENERATOR_TEST_SECRET")
+
+	testFileName, configFileName := setupConfig(`{"targetPort":"8974","authMode":"hmac","authSecretEnv":"GENERATOR_TEST_SECRET","coldSendThresholdBytes":0,"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("signed init packet is rejected %v", err)
+	}
+	if err = trans.hotSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("signed hot packet is rejected %v", err)
+	}
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("signed cold packet is rejected %v", err)
+	}
+	trans.Close()
+
+	invalidConfigs := map[string]string{
+		"unauthenticated": `{"targetPort":"8974","files":[{"filename":%q}]}`,
+		"wrong-mode":      `{"targetPort":"8974","authMode":"token","authSecretEnv":"GENERATOR_TEST_SECRET","files":[{"filename":%q}]}`,
+		"invalid-mode":    `{"targetPort":"8974","authMode":"basic","files":[{"filename":%q}]}`,
+		"empty-secret":    `{"targetPort":"8974","authMode":"hmac","authSecretEnv":"GENERATOR_TEST_EMPTY","files":[{"filename":%q}]}`,
+	}
+	for name, format := range invalidConfigs {
+		testFileName, configFileName := setupConfig(format)
+		if _, err = InitTransport(configFileName, nil); err == nil {
+			t.Errorf("%s: unauthenticated transport is accepted", name)
+		}
+		os.Remove(testFileName)
+		os.Remove(configFileName)
+	}
+}
+
+// setupEndpoints returns the transport which has the endpoints of the addresses
+func setupEndpoints(t *testing.T, strategy string, addrs ...string) *Transport {
+	trans := &Transport{}
+	trans.closed = make(chan bool)
+	trans.namespace = "test"
+	trans.strategy = strategy
+	trans.fileMap = map[string]uint8{"test": 0}
+	trans.packetMap = []string{"test"}
+	trans.setRetry(s.Config{RetryInitial: 1, RetryMax: 4, RetryMaxAttempts: 3})
+	endpoints, err := newEndpoints(s.Config{Targets: addrs}, time.Second, nil)
+	if err != nil {
+		t.Fatalf("endpoint creation failed %v", err)
+	}
+	trans.endpoints = endpoints
+	trans.hashOrder = newHashOrder(endpoints, trans.namespace)
+	return trans
+}
+
+// getEndpointAddr returns the address of the endpoint which has the client
+func getEndpointAddr(trans *Transport, xclient rpcx.XClient) string {
+	for _, e := range trans.endpoints {
+		for _, port := range e.ports {
+			if port.xclient == xclient {
+				return e.addr
+			}
+		}
+	}
+	return ""
+}
+
+func TestEndpointBreaker(t *testing.T) {
+	addrs := []string{"10.0.0.1:8972", "10.0.0.2:8972"}
+	trans := setupEndpoints(t, StrategyFailover, addrs...)
+	defer trans.Close()
+	trans.setRetry(s.Config{RetryInitial: 1, RetryMax: 4, RetryMaxAttempts: 3, BreakerThreshold: 1, BreakerOpen: 60000})
+	sent := make(map[string]bool)
+	trans.submit = func(_ context.Context, _ *rpc.LogMessage, xclient rpcx.XClient) error {
+		addr := getEndpointAddr(trans, xclient)
+		if addr == addrs[0] {
+			return errors.New("connection refused")
+		}
+		sent[addr] = true
+		return nil
+	}
+	trans.endpoints[0].breaker.allow()
+	trans.endpoints[0].breaker.report(errors.New("connection refused"))
+	if e := trans.pickEndpoint(0); e.addr != addrs[1] {
+		t.Errorf("failover doesn't skip the endpoint of the open breaker %s", e.addr)
+	}
+	if err := trans.endpoints[1].breaker.allow(); err != nil {
+		t.Errorf("open breaker of an endpoint stops the others %v", err)
+	}
+	if err := trans.push("hot", &rpc.LogMessage{}, nil); err != nil || !sent[addrs[1]] {
+		t.Errorf("packet isn't sent to the endpoint of the closed breaker %v", err)
+	}
+}
+
+func TestEndpointStrategy(t *testing.T) {
+	addrs := []string{"10.0.0.1:8972", "10.0.0.2:8972", "10.0.0.3:8972"}
+	trans := setupEndpoints(t, StrategyFailover, addrs...)
+	defer trans.Close()
+	if e := trans.pickEndpoint(0); e.addr != addrs[0] {
+		t.Errorf("failover doesn't pick the first endpoint %s", e.addr)
+	}
+	trans.endpoints[0].setHealthy(false)
+	if e := trans.pickEndpoint(0); e.addr != addrs[1] {
+		t.Errorf("failover doesn't skip the unhealthy endpoint %s", e.addr)
+	}
+	trans.endpoints[1].setHealthy(false)
+	trans.endpoints[2].setHealthy(false)
+	if e := trans.pickEndpoint(1); e.addr != addrs[1] {
+		t.Errorf("retries don't go through the unhealthy endpoints %s", e.addr)
+	}
+
+	trans = setupEndpoints(t, StrategyRoundRobin, addrs...)
+	defer trans.Close()
+	for i := 0; i < 6; i++ {
+		if e := trans.pickEndpoint(0); e.addr != addrs[i%3] {
+			t.Errorf("round-robin doesn't rotate the endpoints (expected: %s, result: %s)", addrs[i%3], e.addr)
+		}
+	}
+
+	owners := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		key := fmt.Sprintf("namespace-%d", i)
+		owner := newHashOrder(setupEndpoints(t, StrategyHash, addrs...).endpoints, key)[0].addr
+		owners[owner] = true
+		remaining := []string{}
+		for _, addr := range addrs {
+			if addr == owner || len(remaining) == 0 {
+				remaining = append(remaining, addr)
+			}
+		}
+		if newHashOrder(setupEndpoints(t, StrategyHash, remaining...).endpoints, key)[0].addr != owner {
+			t.Errorf("removed endpoint moves the namespace %s", key)
+		}
+	}
+	if len(owners) != len(addrs) {
+		t.Errorf("namespaces aren't distributed to the endpoints %v", owners)
+	}
+	if _, err := newEndpoints(s.Config{Targets: []string{"10.0.0.1"}}, time.Second, nil); err == nil {
+		t.Errorf("target without the port is accepted")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listener creation failed %v", err)
+	}
+	defer listener.Close()
+	primary, secondary := listener.Addr().String(), "10.0.0.2:8972"
+	trans := setupEndpoints(t, StrategyFailover, primary, secondary)
+	defer trans.Close()
+
+	sent := []string{}
+	down := true
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, xclient rpcx.XClient) error {
+		addr := getEndpointAddr(trans, xclient)
+		if addr == primary && down {
+			return errors.New("connection refused")
+		}
+		if msg.Files.MapTable != nil {
+			sent = append(sent, "init@"+addr)
+		} else {
+			sent = append(sent, "hot@"+addr)
+		}
+		return nil
+	}
+	if err = trans.initSubmitFunc(nil); err != nil {
+		t.Fatalf("init packet isn't sent to the secondary %v", err)
+	}
+	if err = trans.push("hot", &rpc.LogMessage{}, nil); err != nil {
+		t.Fatalf("hot packet isn't sent to the secondary %v", err)
+	}
+	expected := []string{"init@" + secondary, "hot@" + secondary}
+	if strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Errorf("invalid failover (expected: %v, result: %v)", expected, sent)
+	}
+
+	down = false
+	go trans.healthLoop(time.Millisecond*10, time.Second)
+	for i := 0; i < 100 && !trans.endpoints[0].isHealthy(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !trans.endpoints[0].isHealthy() {
+		t.Fatalf("recovered endpoint isn't healthy")
+	}
+	sent = []string{}
+	if err = trans.push("hot", &rpc.LogMessage{}, nil); err != nil {
+		t.Fatalf("hot packet isn't sent to the primary %v", err)
+	}
+	expected = []string{"init@" + primary, "hot@" + primary}
+	if strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Errorf("file map table isn't sent before the traffic moves (expected: %v, result: %v)", expected, sent)
+	}
+}
+
+func TestMultipleTargets(t *testing.T) {
+	testFileName, configFileName := setupConfig(`{"targets":["127.0.0.1:1","localhost:8972"],"retryInitialBackoffMilli":1,"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("unreachable target isn't failed over %v", err)
+	}
+	defer trans.Close()
+	if err = trans.hotSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("hot packet submission failed %v", err)
+	}
+
+	testFileName, configFileName = setupConfig(`{"targets":["localhost:8972"],"targetStrategy":"random","files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	if _, err = InitTransport(configFileName, nil); err == nil {
+		t.Errorf("invalid target strategy is accepted")
+	}
+}
+
+func TestCollectorRestart(t *testing.T) {
+	testFileName, configFileName := setupConfig(`{"retryInitialBackoffMilli":1,"coldSendThresholdBytes":0,"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("initialize the transport failed %v", err)
+	}
+	defer trans.Close()
+	server.Reset()
+	if err = trans.hotSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("file map table isn't sent again to the restarted collector %v", err)
+	}
+	server.Reset()
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("file map table isn't sent again to the restarted collector %v", err)
+	}
+
+	trans = setupEndpoints(t, StrategyFailover, "10.0.0.1:8972")
+	defer trans.Close()
+	sent := []string{}
+	reset := false
+	trans.submit = func(_ context.Context, msg *rpc.LogMessage, _ rpcx.XClient) error {
+		if msg.Files.MapTable != nil {
+			sent = append(sent, "init")
+			return nil
+		}
+		sent = append(sent, "hot")
+		if reset {
+			reset = false
+			return errors.New("read: connection reset by peer")
+		}
+		return nil
+	}
+	if err = trans.initSubmitFunc(nil); err != nil {
+		t.Fatalf("init packet submission failed %v", err)
+	}
+	reset = true
+	if err = trans.push("hot", &rpc.LogMessage{}, nil); err != nil {
+		t.Fatalf("hot packet isn't retried after the connection reset %v", err)
+	}
+	expected := []string{"init", "hot", "init", "hot"}
+	if strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Errorf("init packet isn't sent again after the connection reset (expected: %v, result: %v)", expected, sent)
+	}
+}
+
+func TestDeliveryAck(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-ack-test")
+	if err != nil {
+		log.Fatalf("spool directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	trans := setupEndpoints(t, StrategyFailover, "10.0.0.1:8972")
+	trans.fileMap = map[string]uint8{"test1.txt": 0}
+	trans.packetMap = []string{"test1.txt"}
+	trans.session = "session"
+	trans.requireAck = true
+	if err = trans.initSpool(s.Config{SpoolPath: dir}); err != nil {
+		t.Fatalf("spool initialization failed %v", err)
+	}
+	defer trans.Close()
+
+	sent := make(chan map[string]string, 8)
+	acked := int32(0)
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		metadata := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+		sent <- metadata
+		if atomic.LoadInt32(&acked) == 1 {
+			ctx.Value(share.ResMetaDataKey).(map[string]string)[delivery.MetaAck] = metadata[delivery.MetaSequence]
+		}
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		messages := append(messageGeneration("test", 4, false), messageGeneration("line", 4, false)...)
+		messages[0].Info.Sequence, messages[1].Info.Sequence = uint64(2*i+1), uint64(2*i+2)
+		if err = trans.hotSubmitFunc(messages); err != nil {
+			t.Fatalf("hot packet submission failed %v", err)
+		}
+	}
+	if trans.spool.Len() != 2 {
+		t.Fatalf("unacknowledged packets aren't kept (spooled: %d)", trans.spool.Len())
+	}
+	first := <-sent
+	if first[delivery.MetaSession] != "session" || first[delivery.MetaSequence] != "1" || first[delivery.MetaLines] != "0:1:2" {
+		t.Errorf("invalid delivery metadata %v", first)
+	}
+
+	atomic.StoreInt32(&acked, 1)
+	expected := []string{"1:0:1:2", "2:0:3:2"}
+	for len(expected) > 0 {
+		select {
+		case metadata := <-sent:
+			if metadata[delivery.MetaSequence]+":"+metadata[delivery.MetaLines] == expected[0] {
+				expected = expected[1:]
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("unacknowledged packets aren't retransmitted with their sequences %v", expected)
+		}
+	}
+}
+
+func TestRetransmission(t *testing.T) {
+	trans := setupEndpoints(t, StrategyFailover, "10.0.0.1:8972")
+	trans.requireAck = true
+	if err := trans.initSpool(s.Config{}); err != nil {
+		t.Fatalf("retransmission queue initialization failed %v", err)
+	}
+	defer trans.Close()
+
+	sent := make(chan string, 8)
+	acked := int32(0)
+	trans.submit = func(ctx context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		metadata := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+		sent <- metadata[delivery.MetaSequence]
+		if atomic.LoadInt32(&acked) == 1 {
+			ctx.Value(share.ResMetaDataKey).(map[string]string)[delivery.MetaAck] = metadata[delivery.MetaSequence]
+		}
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := trans.hotSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+			t.Fatalf("unacknowledged packet closes the transport without the spool %v", err)
+		}
+	}
+	if trans.spool.Len() != 2 {
+		t.Fatalf("unacknowledged packets aren't kept without the spool (kept: %d)", trans.spool.Len())
+	}
+
+	atomic.StoreInt32(&acked, 1)
+	expected := []string{"1", "2"}
+	for len(expected) > 0 {
+		select {
+		case sequence := <-sent:
+			if sequence == expected[0] {
+				expected = expected[1:]
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("unacknowledged packets aren't retransmitted %v", expected)
+		}
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	testFileName, configFileName := setupConfig(`{"deliveryAck":true,"coldSendThresholdBytes":0,"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("initialize the transport failed %v", err)
+	}
+	defer trans.Close()
+	if err = trans.hotSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("hot packet isn't acknowledged %v", err)
+	}
+	if err = trans.coldSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Errorf("cold packet isn't acknowledged %v", err)
+	}
+
+	duplicates := server.Duplicates()
+	packet := &rpc.LogMessage{Namespace: trans.namespace, Buffer: []byte("test"), Info: []rpc.LogInfo{{Length: 4}}, Files: rpc.LogFile{Indexes: []uint8{0}}}
+	headers := trans.newHeaders(packet.Files.Indexes, []uint64{100})
+	for i := 0; i < 2; i++ {
+		if err = trans.push("hot", packet, headers); err != nil {
+			t.Errorf("retransmitted packet isn't acknowledged %v", err)
+		}
+	}
+	if server.Duplicates() != duplicates+1 {
+		t.Errorf("retransmitted packet isn't deduplicated (duplicates: %d)", server.Duplicates()-duplicates)
+	}
+}
+
+func TestSinks(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-sink-test")
+	if err != nil {
+		log.Fatalf("sink directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	bodies := make(chan []byte, 4)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer httpServer.Close()
+
+	path := filepath.Join(dir, "archive.ndjson")
+	format := fmt.Sprintf(`{"targetPort":"1","sinks":[{"name":"archive","type":"file","path":%q},{"type":"http","url":%q,"format":"json"}],"files":[{"filename":%%q}]}`, path, httpServer.URL)
+	testFileName, configFileName := setupConfig(format)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	trans, err := InitTransport(configFileName, nil)
+	if err != nil {
+		t.Fatalf("initialize the transport without the collector failed %v", err)
+	}
+	if err = trans.hotSubmitFunc(messageGeneration("test", 4, false)); err != nil {
+		t.Fatalf("hot messages aren't sent to the sinks %v", err)
+	}
+	trans.Close()
+
+	select {
+	case body := <-bodies:
+		if !strings.Contains(string(body), `"class":"hot"`) || !strings.Contains(string(body), `"line":"test"`) {
+			t.Errorf("invalid http sink body %s", body)
+		}
+	default:
+		t.Errorf("http sink doesn't receive the messages")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil || !strings.Contains(string(b), `"line":"test"`) {
+		t.Errorf("file sink doesn't write the messages %s (%v)", b, err)
+	}
+
+	testFileName, configFileName = setupConfig(`{"sinks":[{"type":"stdout"},{"type":"stdout"}],"files":[{"filename":%q}]}`)
+	defer os.Remove(testFileName)
+	defer os.Remove(configFileName)
+	if _, err = InitTransport(configFileName, nil); err == nil {
+		t.Errorf("duplicated sink names are accepted")
+	}
+}
+
+type failingSink struct{}
+
+func (failingSink) Init(files []s.File) error                     { return nil }
+func (failingSink) Send(class string, messages []s.Message) error { return errors.New("unavailable") }
+func (failingSink) Flush() error                                  { return nil }
+func (failingSink) Close() error                                  { return nil }
+
+type blockingSink struct {
+	release chan bool
+	sent    int32
+}
+
+func (b *blockingSink) Init(files []s.File) error { return nil }
+func (b *blockingSink) Send(class string, messages []s.Message) error {
+	<-b.release
+	atomic.AddInt32(&b.sent, int32(len(messages)))
+	sink.Acknowledge(messages)
+	return nil
+}
+func (b *blockingSink) Flush() error { return nil }
+func (b *blockingSink) Close() error { return nil }
+
+func TestRouteMatch(t *testing.T) {
+	sinks := map[string]sink.Sink{"archive": failingSink{}}
+	invalid := []s.Route{
+		{Sinks: []string{"unknown"}},
+		{},
+		{Classes: []string{"warm"}, Sinks: []string{"archive"}},
+		{Files: []string{"["}, Sinks: []string{"archive"}},
+		{Pattern: "(", Sinks: []string{"archive"}},
+	}
+	for i, config := range invalid {
+		if _, err := newRoute(config, i, sinks); err == nil {
+			t.Errorf("invalid route is accepted %+v", config)
+		}
+	}
+
+	r, err := newRoute(s.Route{Files: []string{"/var/log/auth*"}, Classes: []string{sink.Hot}, Rules: []string{"auth"}, Pattern: "failed", Sinks: []string{"archive"}}, 0, sinks)
+	if err != nil {
+		t.Fatalf("route creation failed %v", err)
+	}
+	message := s.Message{Info: s.FileInfo{Filename: "/var/log/auth.log", Rule: "auth"}, Data: []byte("login failed")}
+	if r.name != "route-0" || !r.match(sink.Hot, message) {
+		t.Errorf("route doesn't match the message")
+	}
+	if r.match(sink.Cold, message) {
+		t.Errorf("route matches the other class")
+	}
+	message.Info.Rule = "error"
+	if r.match(sink.Hot, message) {
+		t.Errorf("route matches the other rule")
+	}
+	message.Info.Rule, message.Info.Filename = "auth", "/var/log/syslog"
+	if r.match(sink.Hot, message) {
+		t.Errorf("route matches the other file")
+	}
+	message.Info.Filename, message.Data = "/var/log/auth.log", []byte("login succeeded")
+	if r.match(sink.Hot, message) {
+		t.Errorf("route matches the other line")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-route-test")
+	if err != nil {
+		log.Fatalf("checkpoint directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file, _ := os.Create(filepath.Join(dir, "test1.txt"))
+	defer file.Close()
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	tracker := checkpoint.NewTracker(registry, file.Name(), file)
+
+	var primary, security, archive bytes.Buffer
+	slow := &blockingSink{release: make(chan bool)}
+	trans := &Transport{}
+	trans.sinks = []namedSink{
+		{name: "main", sink: sink.NewWriter(&primary, sink.Source{})},
+		{name: "security", sink: sink.NewWriter(&security, sink.Source{})},
+		{name: "archive", sink: sink.NewWriter(&archive, sink.Source{})},
+		{name: "broken", sink: failingSink{}},
+		{name: "slow", sink: slow},
+	}
+	err = trans.newRoutes(s.Config{Routes: []s.Route{
+		{Name: "security", Classes: []string{sink.Hot}, Rules: []string{"auth"}, Sinks: []string{"security", "broken"}, BatchSize: 1},
+		{Name: "archive", Classes: []string{sink.Cold}, Sinks: []string{"archive"}, BatchTimeout: 10},
+		{Name: "slow", Sinks: []string{"slow"}, BatchSize: 1, QueueSize: 1},
+	}})
+	if err != nil {
+		t.Fatalf("route creation failed %v", err)
+	}
+
+	messages := func(rule string, lines ...string) []s.Message {
+		result := []s.Message{}
+		for _, line := range lines {
+			message := s.Message{Info: s.FileInfo{Filename: "test1.txt", Rule: rule}, Data: []byte(line)}
+			message.Ticket = tracker.At(int64(len(line))).Track()
+			result = append(result, message)
+		}
+		return result
+	}
+	submitted := make(chan bool)
+	go func() {
+		trans.hotSubmitFunc(messages("auth", "auth failed"))
+		trans.hotSubmitFunc(messages("error", "disk error"))
+		trans.coldSubmitFunc(messages("", "cold1", "cold2", "cold3"))
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("slow sink stalls the other sinks")
+	}
+	close(slow.release)
+	trans.closeRoutes()
+
+	if n := strings.Count(primary.String(), "\n"); n != 5 {
+		t.Errorf("primary sink doesn't receive all the messages (%d)", n)
+	}
+	if strings.Count(security.String(), "\n") != 1 || !strings.Contains(security.String(), "auth failed") {
+		t.Errorf("invalid routed hot messages %q", security.String())
+	}
+	if n := strings.Count(archive.String(), "\n"); n != 3 || strings.Contains(archive.String(), "failed") {
+		t.Errorf("invalid routed cold messages %q", archive.String())
+	}
+	if sent := atomic.LoadInt32(&slow.sent); sent == 0 || sent >= 5 {
+		t.Errorf("slow sink isn't isolated by its queue (sent: %d)", sent)
+	}
+	if tracker.Pending() != 5 {
+		t.Errorf("message dropped by the route is acknowledged (pending: %d)", tracker.Pending())
+	}
+}
+
+func TestSinkFailure(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-sink-failure-test")
+	if err != nil {
+		log.Fatalf("checkpoint directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file, _ := os.Create(filepath.Join(dir, "test1.txt"))
+	defer file.Close()
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	tracker := checkpoint.NewTracker(registry, file.Name(), file)
+
+	var primary bytes.Buffer
+	trans := &Transport{}
+	trans.sinks = []namedSink{
+		{name: "broken", sink: failingSink{}},
+		{name: "main", sink: sink.NewWriter(&primary, sink.Source{})},
+	}
+	messages := messageGeneration("test", 4, false)
+	messages[0].Ticket = tracker.At(5).Track()
+	if err = trans.dispatch(sink.Hot, messages); err != nil {
+		t.Errorf("failure of the sink stops the transport %v", err)
+	}
+	if strings.Count(primary.String(), "\n") != len(messages) {
+		t.Errorf("failure of the sink stops the other sinks %q", primary.String())
+	}
+	if tracker.Pending() != 1 {
+		t.Errorf("ticket of the message dropped by the sink is done (pending: %d)", tracker.Pending())
+	}
+
+	trans.sinks = []namedSink{{name: "collector", sink: collectorSink{trans}}, {name: "main", sink: sink.NewWriter(&primary, sink.Source{})}}
+	trans.submit = func(_ context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		return rpcx.ServiceError("invalid packet")
+	}
+	if err = trans.dispatch(sink.Hot, messageGeneration("test", 4, false)); err == nil {
+		t.Errorf("failure of the collector is ignored")
+	}
+}
+
+type waitingSink struct {
+	started chan bool
+	release chan bool
+}
+
+func (w waitingSink) Init(files []s.File) error { return nil }
+func (w waitingSink) Send(class string, messages []s.Message) error {
+	w.started <- true
+	<-w.release
+	sink.Acknowledge(messages)
+	return nil
+}
+func (w waitingSink) Flush() error { return nil }
+func (w waitingSink) Close() error { return nil }
+
+func TestRouteSend(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-route-send-test")
+	if err != nil {
+		log.Fatalf("checkpoint directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file, _ := os.Create(filepath.Join(dir, "test1.txt"))
+	defer file.Close()
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	tracker := checkpoint.NewTracker(registry, file.Name(), file)
+
+	trans := &Transport{}
+	trans.submit = func(_ context.Context, _ *rpc.LogMessage, _ rpcx.XClient) error {
+		return rpcx.ServiceError("invalid packet")
+	}
+	started, release := make(chan bool, 2), make(chan bool)
+	sinks := map[string]sink.Sink{
+		"collector": collectorSink{trans},
+		"first":     waitingSink{started: started, release: release},
+		"second":    waitingSink{started: started, release: release},
+	}
+	r, err := newRoute(s.Route{Sinks: []string{"collector", "first", "second"}}, 0, sinks)
+	if err != nil {
+		t.Fatalf("route creation failed %v", err)
+	}
+	message := s.Message{Data: []byte("line"), Ticket: tracker.At(5).Track()}
+	message.Ticket.Add(len(r.sinks) - 1)
+	sent := make(chan bool)
+	go func() {
+		r.send(sink.Hot, []s.Message{message})
+		close(sent)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("sinks of the route aren't sent at the same time")
+		}
+	}
+	close(release)
+	<-sent
+	if tracker.Pending() != 1 {
+		t.Errorf("ticket of the batch which the collector fails to send is done (pending: %d)", tracker.Pending())
+	}
+}
+
+func TestSlowSink(t *testing.T) {
+	var primary bytes.Buffer
+	slow := &blockingSink{release: make(chan bool)}
+	trans := &Transport{}
+	trans.sinks = []namedSink{
+		{name: "slow", sink: slow},
+		{name: "main", sink: sink.NewWriter(&primary, sink.Source{})},
+	}
+	if err := trans.newRoutes(s.Config{}); err != nil {
+		t.Fatalf("sink queue creation failed %v", err)
+	}
+	if len(trans.getPrimarySinks()) != 0 || len(trans.routes) != 2 {
+		t.Fatalf("sinks aren't queued (routes: %d)", len(trans.routes))
+	}
+	submitted := make(chan error)
+	go func() {
+		submitted <- trans.hotSubmitFunc(messageGeneration("test", 4, false))
+	}()
+	select {
+	case err := <-submitted:
+		if err != nil {
+			t.Errorf("hot messages aren't queued to the sinks %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("slow sink blocks the submission")
+	}
+	close(slow.release)
+	trans.closeRoutes()
+	if sent := atomic.LoadInt32(&slow.sent); sent != 1 || strings.Count(primary.String(), "\n") != 1 {
+		t.Errorf("queued messages aren't sent on close (slow: %d, main: %q)", sent, primary.String())
+	}
+}
+
+func TestRouteClose(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport-route-close-test")
+	if err != nil {
+		log.Fatalf("checkpoint directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	file, _ := os.Create(filepath.Join(dir, "test1.txt"))
+	defer file.Close()
+	registry, _ := checkpoint.Open(filepath.Join(dir, "checkpoint.json"))
+	tracker := checkpoint.NewTracker(registry, file.Name(), file)
+
+	var output bytes.Buffer
+	r, err := newRoute(s.Route{Sinks: []string{"main"}, QueueSize: 8}, 0, map[string]sink.Sink{"main": sink.NewWriter(&output, sink.Source{})})
+	if err != nil {
+		t.Fatalf("route creation failed %v", err)
+	}
+	r.wait.Add(1)
+	go r.run()
+	closed := make(chan bool)
+	go func() {
+		r.close()
+		close(closed)
+	}()
+	queued := 0
+	for i, after := 0, 0; after < 100; i++ {
+		if r.push(sink.Hot, s.Message{Data: []byte("line"), Ticket: tracker.At(int64(i+1) * 5).Track()}) {
+			queued++
+		}
+		select {
+		case <-closed:
+			after++
+		default:
+		}
+	}
+	if sent := strings.Count(output.String(), "\n"); sent != queued || len(r.queue) != 0 {
+		t.Errorf("message pushed during the close is lost (sent: %d, queued: %d)", sent, queued)
+	}
+}
@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	s "github.com/soyoslab/soy_log_generator/pkg/scheduler"
+)
+
+// tlsVersions are the names of the supported minimum TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig returns the TLS configuration of the collector connection (nil if TLS is disabled)
+// The server name is the target address if it isn't set. The system CA pool
+// is used when the CA bundle isn't set, and the client
+// certificate is presented for the mutual TLS when it is set.
+func newTLSConfig(config s.Config) (*tls.Config, error) {
+	if !config.TLS {
+		return nil, nil
+	}
+	version, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls min version %q", config.TLSMinVersion)
+	}
+	tlsConfig := &tls.Config{ServerName: config.TLSServerName, MinVersion: version}
+	if len(config.TLSCAFile) != 0 {
+		bundle, err := ioutil.ReadFile(config.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificate in the tls ca bundle %s", config.TLSCAFile)
+		}
+	}
+	if len(config.TLSCertFile) != 0 || len(config.TLSKeyFile) != 0 {
+		if len(config.TLSCertFile) == 0 || len(config.TLSKeyFile) == 0 {
+			return nil, errors.New("tls client certificate and key must be set together")
+		}
+		certificate, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,189 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Backend is the generic interface of the file event sources
+// Both of *fsnotify.Watcher and *Poller satisfy this interface.
+type Backend interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+}
+
+// pollState contains the last observed state of a path
+type pollState struct {
+	info  os.FileInfo
+	names map[string]bool
+}
+
+// Poller is the stat-polling backend for the filesystems which don't deliver the fsnotify events
+// It compares the size, modification time and identity of the files,
+// and the entries of the directories on every interval.
+type Poller struct {
+	states   map[string]*pollState
+	interval time.Duration
+	events   chan fsnotify.Event
+	done     chan bool
+	mutex    sync.Mutex
+}
+
+// NewPoller creates Poller structure
+// Note that this function start to run the polling goroutine
+func NewPoller(interval time.Duration) *Poller {
+	p := new(Poller)
+	p.states = make(map[string]*pollState)
+	p.interval = interval
+	p.events = make(chan fsnotify.Event)
+	p.done = make(chan bool)
+	go p.run()
+	return p
+}
+
+// SetInterval changes the polling interval
+func (p *Poller) SetInterval(interval time.Duration) {
+	p.mutex.Lock()
+	p.interval = interval
+	p.mutex.Unlock()
+}
+
+// Events returns the channel which delivers the detected events
+func (p *Poller) Events() <-chan fsnotify.Event {
+	return p.events
+}
+
+// Add starts to poll the file or directory
+func (p *Poller) Add(name string) error {
+	state, err := getPollState(name)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.states[name] = state
+	p.mutex.Unlock()
+	return nil
+}
+
+// Remove stops to poll the file or directory
+func (p *Poller) Remove(name string) error {
+	p.mutex.Lock()
+	delete(p.states, name)
+	p.mutex.Unlock()
+	return nil
+}
+
+// Close stops the polling goroutine
+func (p *Poller) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+	return nil
+}
+
+// getPollState observes the current state of the path
+func getPollState(name string) (*pollState, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	state := &pollState{info: info}
+	if !info.IsDir() {
+		return state, nil
+	}
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	state.names = make(map[string]bool)
+	for _, entry := range entries {
+		state.names[entry.Name()] = true
+	}
+	return state, nil
+}
+
+// run polls the paths until the Poller is closed
+func (p *Poller) run() {
+	for {
+		p.mutex.Lock()
+		interval := p.interval
+		p.mutex.Unlock()
+		select {
+		case <-p.done:
+			return
+		case <-time.After(interval):
+		}
+		for _, event := range p.poll() {
+			select {
+			case p.events <- event:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+// poll compares the paths with the last states and returns the events
+func (p *Poller) poll() []fsnotify.Event {
+	events := []fsnotify.Event{}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, last := range p.states {
+		state, err := getPollState(name)
+		if os.IsNotExist(err) {
+			if last.info != nil {
+				events = append(events, fsnotify.Event{Name: name, Op: fsnotify.Remove})
+			}
+			p.states[name] = &pollState{}
+			continue
+		} else if err != nil {
+			continue
+		}
+		events = append(events, compareFile(name, last, state)...)
+		events = append(events, compareDir(name, last, state)...)
+		p.states[name] = state
+	}
+	return events
+}
+
+// compareFile returns the event of the file which is created, replaced or written
+func compareFile(name string, last *pollState, state *pollState) []fsnotify.Event {
+	if state.info.IsDir() {
+		return nil
+	}
+	if last.info == nil || !os.SameFile(last.info, state.info) {
+		return []fsnotify.Event{{Name: name, Op: fsnotify.Create}}
+	}
+	if last.info.Size() != state.info.Size() || !last.info.ModTime().Equal(state.info.ModTime()) {
+		return []fsnotify.Event{{Name: name, Op: fsnotify.Write}}
+	}
+	return nil
+}
+
+// compareDir returns the events of the entries which are created or removed in the directory
+func compareDir(name string, last *pollState, state *pollState) []fsnotify.Event {
+	events := []fsnotify.Event{}
+	if !state.info.IsDir() {
+		return events
+	}
+	for entry := range state.names {
+		if !last.names[entry] {
+			events = append(events, fsnotify.Event{Name: filepath.Join(name, entry), Op: fsnotify.Create})
+		}
+	}
+	for entry := range last.names {
+		if !state.names[entry] {
+			events = append(events, fsnotify.Event{Name: filepath.Join(name, entry), Op: fsnotify.Remove})
+		}
+	}
+	return events
+}
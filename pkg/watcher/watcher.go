@@ -2,7 +2,12 @@ package watcher
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"sync/atomic"
 
@@ -12,7 +17,25 @@ import (
 
 // FileInfo structure contains the Buffering structure's pointer
 type FileInfo struct {
-	buffer *buffering.Buffering
+	buffer   *buffering.Buffering
+	watchDir bool
+	reader   *reader
+}
+
+// reader reads the lines of a file in its own goroutine
+// The line processing function can wait (e.g. the block overflow policy of the scheduler),
+// so the waiting file doesn't stop the Spectator and the other files.
+type reader struct {
+	kick    chan chan bool
+	done    chan bool
+	stopped chan bool
+	stop    sync.Once
+	mutex   sync.Mutex
+}
+
+// newReader makes the reader whose goroutine is not started yet
+func newReader() *reader {
+	return &reader{kick: make(chan chan bool, 1), done: make(chan bool), stopped: make(chan bool)}
 }
 
 // GetBuffer returns the pointer of the buffering structure
@@ -20,13 +43,42 @@ func (f *FileInfo) GetBuffer() *buffering.Buffering {
 	return f.buffer
 }
 
+// maxDrainedFiles is the number of the drained files to remember
+const maxDrainedFiles = 256
+
+// maxReaderWait is the time for which the Spectator waits for the reader of the file
+// The files are read in the order of the events unless a reader waits longer than this.
+const maxReaderWait = time.Duration(100) * time.Millisecond
+
+const (
+	// BackendFsnotify watches the files by the fsnotify (inotify, kqueue, ...)
+	BackendFsnotify = "fsnotify"
+	// BackendPolling watches the files by polling the stat
+	BackendPolling = "polling"
+	// DefaultPollingInterval is the polling interval of the polling backend
+	DefaultPollingInterval = time.Duration(1000) * time.Millisecond
+)
+
+// DirectoryEventFunc is the function pointer which receives the events of the watched directories
+type DirectoryEventFunc func(event fsnotify.Event) error
+
 // Watcher structure contains the fsnotify structures and being watched files information
+// Note that the parent directories are also watched
+// to follow the file which is renamed, removed and created by the log rotation.
 type Watcher struct {
-	infoTable    map[string]FileInfo
-	notifier     *fsnotify.Watcher
-	workingGroup *sync.WaitGroup
-	isStop       uint32
-	errors       chan error
+	infoTable          map[string]FileInfo
+	dirTable           map[string]int
+	backendTable       map[string]Backend
+	defaultBackend     string
+	drained            []os.FileInfo
+	notifier           *fsnotify.Watcher
+	poller             *Poller
+	workingGroup       *sync.WaitGroup
+	isStop             uint32
+	errors             chan error
+	failures           chan error
+	directoryEventFunc DirectoryEventFunc
+	mutex              sync.Mutex
 }
 
 // NewWatcher creates Watcher structure
@@ -36,10 +88,15 @@ func NewWatcher() (*Watcher, error) {
 	watcher := new(Watcher)
 	watcher.workingGroup = new(sync.WaitGroup)
 	watcher.infoTable = make(map[string]FileInfo)
+	watcher.dirTable = make(map[string]int)
+	watcher.backendTable = make(map[string]Backend)
+	watcher.defaultBackend = BackendFsnotify
 	watcher.notifier, err = fsnotify.NewWatcher()
+	watcher.poller = NewPoller(DefaultPollingInterval)
 
 	watcher.workingGroup.Add(1)
 	watcher.errors = make(chan error)
+	watcher.failures = make(chan error, 1)
 	atomic.StoreUint32(&watcher.isStop, 0)
 	go watcher.Spectator()
 
@@ -54,52 +111,369 @@ func (w *Watcher) GetErrorChannel() <-chan error {
 // AddFile adds a file to the Watcher.
 // During the adding file, this also creates the buffering structure
 func (w *Watcher) AddFile(filename string, lineProcessingFunction func(string, interface{}) error) error {
-	buffer, err := buffering.NewBuffering(filename, lineProcessingFunction)
+	return w.AddFileWithOptions(filename, lineProcessingFunction, buffering.Options{Start: buffering.StartAtEnd})
+}
+
+// AddFileWithOptions adds a file to the Watcher with the buffering options
+func (w *Watcher) AddFileWithOptions(filename string, lineProcessingFunction func(string, interface{}) error, options buffering.Options) error {
+	return w.AddFileWithBackend(filename, lineProcessingFunction, options, "")
+}
+
+// AddFileWithBackend adds a file to the Watcher which is watched by the backend
+// Empty backend means the default backend of the Watcher.
+func (w *Watcher) AddFileWithBackend(filename string, lineProcessingFunction func(string, interface{}) error, options buffering.Options, backend string) error {
+	var info FileInfo
+	if err := isValidBackend(backend); err != nil {
+		return err
+	}
+	buffer, err := buffering.NewBufferingWithOptions(filename, lineProcessingFunction, options)
 	if err != nil {
 		goto exception
 	}
-	w.infoTable[filename] = FileInfo{buffer}
-	err = w.notifier.Add(filename)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	info, err = w.watchFile(filename, w.getBackend(backend))
+	if err != nil {
+		buffer.Close()
+		goto exception
+	}
+	info.buffer = buffer
+	info.reader = newReader()
+	w.infoTable[filename] = info
+	go w.read(filename, info.reader)
 
 exception:
 	return err
 }
 
+// watchFile watches the file and its parent directory by the backend
+// The polling backend doesn't need the directory because it checks the path itself.
+func (w *Watcher) watchFile(filename string, backend string) (FileInfo, error) {
+	info := FileInfo{}
+	if backend == BackendPolling {
+		return info, w.addPath(filename, backend)
+	}
+	err := w.addDir(filepath.Dir(filename), backend)
+	if err != nil {
+		return info, err
+	}
+	info.watchDir = true
+	// the file itself is also watched because the directory doesn't report
+	// the writes on the target of the symbolic link
+	err = w.addPath(filename, backend)
+	if err != nil {
+		w.removeDir(filepath.Dir(filename))
+	}
+	return info, err
+}
+
+// isValidBackend checks the backend name is supported
+func isValidBackend(backend string) error {
+	switch backend {
+	case "", BackendFsnotify, BackendPolling:
+		return nil
+	}
+	return fmt.Errorf("invalid watcher backend %q", backend)
+}
+
+// getBackend returns the default backend if the backend is not specified
+func (w *Watcher) getBackend(backend string) string {
+	if len(backend) == 0 {
+		return w.defaultBackend
+	}
+	return backend
+}
+
+// SetBackend sets the default backend and the polling interval
+func (w *Watcher) SetBackend(backend string, pollingInterval time.Duration) error {
+	if err := isValidBackend(backend); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	if len(backend) != 0 {
+		w.defaultBackend = backend
+	}
+	w.mutex.Unlock()
+	if pollingInterval > 0 {
+		w.poller.SetInterval(pollingInterval)
+	}
+	return nil
+}
+
+// addPath watches the path by the backend
+// If the fsnotify cannot watch the path (e.g. the inotify watch limit is exhausted),
+// the poller watches it instead.
+func (w *Watcher) addPath(name string, backend string) error {
+	if backend != BackendPolling {
+		err := w.notifier.Add(name)
+		if err == nil {
+			w.backendTable[name] = w.notifier
+			return nil
+		}
+		log.Printf("fsnotify cannot watch %s, fall back to the polling: %v\n", name, err)
+	}
+	if err := w.poller.Add(name); err != nil {
+		return err
+	}
+	w.backendTable[name] = w.poller
+	return nil
+}
+
+// removePath stops watching the path
+func (w *Watcher) removePath(name string) error {
+	backend, ok := w.backendTable[name]
+	if !ok {
+		return nil
+	}
+	delete(w.backendTable, name)
+	return backend.Remove(name)
+}
+
+// WatchDir watches the directory without any file by the default backend
+// The events in it are passed to the directory event function.
+func (w *Watcher) WatchDir(dir string) error {
+	return w.WatchDirWithBackend(dir, "")
+}
+
+// WatchDirWithBackend watches the directory without any file by the backend
+// Empty backend means the default backend of the Watcher.
+func (w *Watcher) WatchDirWithBackend(dir string, backend string) error {
+	if err := isValidBackend(backend); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.addDir(dir, w.getBackend(backend))
+}
+
+// UnwatchDir stops watching the directory which is added by WatchDir
+func (w *Watcher) UnwatchDir(dir string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.removeDir(dir)
+}
+
+// SetDirectoryEventFunction sets the function which receives the events of the watched directories
+// Note that the function runs in the Spectator goroutine.
+func (w *Watcher) SetDirectoryEventFunction(f DirectoryEventFunc) {
+	w.mutex.Lock()
+	w.directoryEventFunc = f
+	w.mutex.Unlock()
+}
+
+// IsDrained checks the file was already read until EOF and closed by the Watcher
+// For example, the rotated file which matches the pattern again is drained.
+func (w *Watcher) IsDrained(filename string) bool {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, drained := range w.drained {
+		if os.SameFile(stat, drained) {
+			return true
+		}
+	}
+	return false
+}
+
+// addDrained remembers the file which is drained
+func (w *Watcher) addDrained(file *os.File) {
+	stat, err := file.Stat()
+	if err != nil {
+		return
+	}
+	w.mutex.Lock()
+	w.drained = append(w.drained, stat)
+	if len(w.drained) > maxDrainedFiles {
+		w.drained = w.drained[len(w.drained)-maxDrainedFiles:]
+	}
+	w.mutex.Unlock()
+}
+
+// addDir watches the directory if it is not watched yet
+// The directory which is already watched by the fsnotify is also polled if the backend is
+// the polling, because the fsnotify misses the changes of the other clients on NFS.
+func (w *Watcher) addDir(dir string, backend string) error {
+	if w.dirTable[dir] == 0 {
+		if err := w.addPath(dir, backend); err != nil {
+			return err
+		}
+	} else if backend == BackendPolling && w.backendTable[dir] != Backend(w.poller) {
+		if err := w.poller.Add(dir); err != nil {
+			return err
+		}
+	}
+	w.dirTable[dir]++
+	return nil
+}
+
+// removeDir stops watching the directory if there is no file to watch in it
+func (w *Watcher) removeDir(dir string) error {
+	w.dirTable[dir]--
+	if w.dirTable[dir] > 0 {
+		return nil
+	}
+	delete(w.dirTable, dir)
+	w.poller.Remove(dir)
+	return w.removePath(dir)
+}
+
 // GetFileInfoTable return FileInfoTable
 func (w *Watcher) GetFileInfoTable() map[string]FileInfo {
-	return w.infoTable
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	table := make(map[string]FileInfo, len(w.infoTable))
+	for filename, info := range w.infoTable {
+		table[filename] = info
+	}
+	return table
 }
 
 // GetFileInfo returns the FileInfo structure pointer in the Watcher structure
 func (w *Watcher) GetFileInfo(filename string) (FileInfo, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	if info, ok := w.infoTable[filename]; ok {
 		return info, nil
 	}
 	return FileInfo{}, errors.New("cannot find the buffering structure")
 }
 
+// read processes the file whenever it is kicked until the reader is done
+// The failure is passed to the Spectator, which stops the Watcher.
+func (w *Watcher) read(filename string, r *reader) {
+	defer close(r.stopped)
+	for {
+		var processed chan bool
+		select {
+		case <-r.done:
+			return
+		case processed = <-r.kick:
+		}
+		err := w.ProcessFile(filename)
+		close(processed)
+		if err != nil {
+			select {
+			case w.failures <- err:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// kickReader makes the reader of the file process it and waits for it up to maxReaderWait
+// The kicks while the reader is waiting are merged into one, and the file
+// removed after the event is ignored.
+func (w *Watcher) kickReader(filename string) error {
+	info, err := w.GetFileInfo(filename)
+	if err != nil {
+		return nil
+	}
+	processed := make(chan bool)
+	select {
+	case info.reader.kick <- processed:
+	default:
+		return nil
+	}
+	select {
+	case <-processed:
+	case <-time.After(maxReaderWait):
+	}
+	return nil
+}
+
+// stopReader stops the reader of the file and waits for it
+func stopReader(info FileInfo) {
+	if info.reader == nil {
+		return
+	}
+	info.reader.stop.Do(func() {
+		close(info.reader.done)
+	})
+	<-info.reader.stopped
+}
+
 // ProcessFile prcesses each lines in a file
+// The file is processed by one goroutine at a time.
 func (w *Watcher) ProcessFile(filename string) error {
 	info, err := w.GetFileInfo(filename)
 	if err != nil {
 		goto exception
 	}
+	info.reader.mutex.Lock()
+	defer info.reader.mutex.Unlock()
+	err = w.followRotation(filename, info)
+	if err != nil {
+		goto exception
+	}
 	info.buffer.UpdateToValidOffset()
 	_, err = info.buffer.DoReadLines(filename, info.buffer.GetFile())
 exception:
 	return err
 }
 
+// followRotation drains the rotated file until EOF and reopens the path
+// If the path doesn't exist yet, the reopen is retried on the next event.
+func (w *Watcher) followRotation(filename string, info FileInfo) error {
+	rotated, err := info.buffer.IsRotated()
+	if err != nil || !rotated {
+		return err
+	}
+	_, err = info.buffer.DoReadLines(filename, info.buffer.GetFile())
+	if err != nil {
+		return err
+	}
+	w.addDrained(info.buffer.GetFile())
+	err = info.buffer.Reopen()
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// the poller checks the path, but the fsnotify watches the rotated inode
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.backendTable[filename] == Backend(w.notifier) {
+		return w.notifier.Add(filename)
+	}
+	return nil
+}
+
 // EventProcessor is generic event processor.
-// Note that you must take care of other case always returns it is valid state
+// Note that the events of the other files in the watched directories are passed
+// to the directory event function, and the events of the path which isn't
+// watched anymore (e.g. the file removed by the rescan or the reload) are ignored.
 func (w *Watcher) EventProcessor(event fsnotify.Event) error {
 	var err error = nil
-	if event.Op&fsnotify.Write == fsnotify.Write {
-		err = w.ProcessFile(event.Name)
+	w.mutex.Lock()
+	_, isFile := w.infoTable[event.Name]
+	isDir := w.dirTable[filepath.Dir(event.Name)] > 0
+	directoryEventFunc := w.directoryEventFunc
+	w.mutex.Unlock()
+	if !isFile && !isDir {
+		return nil
+	}
+	if isFile && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+		err = w.kickReader(event.Name)
+	}
+	if err == nil && isDir && directoryEventFunc != nil && event.Op&(fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+		err = directoryEventFunc(event)
 	}
 	return err
 }
 
+// isWatched checks the file or its parent directory is being watched
+// The poller can deliver the event of the path which is removed during the polling.
+func (w *Watcher) isWatched(name string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, isFile := w.infoTable[name]
+	return isFile || w.dirTable[filepath.Dir(name)] > 0
+}
+
 // GetNotifier returns the fsnotify.Watcher's address
 func (w *Watcher) GetNotifier() *fsnotify.Watcher {
 	return w.notifier
@@ -114,14 +488,27 @@ func (w *Watcher) Spectator() {
 			goto exception
 		}
 		select {
-		case event, _ := <-w.notifier.Events:
+		case event, ok := <-w.notifier.Events:
+			if !ok {
+				goto exception
+			}
 			err = w.EventProcessor(event)
 			if err != nil {
 				goto exception
 			}
 			// something to do
+		case event := <-w.poller.Events():
+			if !w.isWatched(event.Name) {
+				continue
+			}
+			err = w.EventProcessor(event)
+			if err != nil {
+				goto exception
+			}
 		case err, _ = <-w.notifier.Errors:
 			goto exception
+		case err = <-w.failures:
+			goto exception
 		}
 	}
 exception:
@@ -137,9 +524,18 @@ func (w *Watcher) Remove(filename string) error {
 	if err != nil {
 		return err
 	}
+	stopReader(info)
+	w.addDrained(info.GetBuffer().GetFile())
 	info.GetBuffer().Close()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	delete(w.infoTable, filename)
-	return w.notifier.Remove(filename)
+	// the watch of the removed file is already released by the notifier
+	w.removePath(filename)
+	if !info.watchDir {
+		return nil
+	}
+	return w.removeDir(filepath.Dir(filename))
 }
 
 // Wait waits the working group in the watcher
@@ -153,10 +549,17 @@ func (w *Watcher) stop() {
 }
 
 // Close frees resources
+// The Spectator is stopped first, so it never reads the closed buffers.
 func (w *Watcher) Close() error {
 	var err error = nil
 
-	for _, info := range w.infoTable {
+	w.stop()
+	w.notifier.Close()
+	w.poller.Close()
+	w.Wait()
+
+	for _, info := range w.GetFileInfoTable() {
+		stopReader(info)
 		if info.buffer != nil {
 			info.buffer.Close()
 			info.buffer = nil
@@ -164,9 +567,5 @@ func (w *Watcher) Close() error {
 			err = errors.New("nil buffer detected")
 		}
 	}
-
-	w.stop()
-	w.notifier.Close()
-	w.Wait()
 	return err
 }
@@ -5,11 +5,14 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/soyoslab/soy_log_generator/pkg/buffering"
 )
 
 func setup() (*Watcher, error) {
@@ -96,17 +99,17 @@ func TestSpectatorOneFile(t *testing.T) {
 
 	sampleString := []string{"test1\n", "test2\n", "test3\n"}
 
-	index := 0
+	var index int32 = 0
 	err := w.AddFile(file.Name(), func(str string, args interface{}) error {
 		rv := reflect.ValueOf(args)
 		file := rv.Index(1).Interface().(*os.File)
 		if cur, _ := file.Seek(0, io.SeekCurrent); cur%6 != 0 {
 			t.Errorf("invalid write pointer")
 		}
-		if sampleString[index] != str {
+		if sampleString[atomic.LoadInt32(&index)] != str {
 			t.Errorf("write Detection Failed")
 		}
-		index++
+		atomic.AddInt32(&index, 1)
 		return nil
 	})
 	if err != nil {
@@ -116,11 +119,23 @@ func TestSpectatorOneFile(t *testing.T) {
 		file.WriteString(str)
 		file.Sync()
 	}
-	if index != 3 {
+	if !waitCount(&index, 3, time.Second*5) {
 		t.Errorf("event detection failed")
 	}
 }
 
+// waitCount waits until the counter reaches the target or the timeout expires
+func waitCount(counter *int32, target int32, timeout time.Duration) bool {
+	start := time.Now()
+	for time.Since(start) < timeout {
+		if atomic.LoadInt32(counter) == target {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return atomic.LoadInt32(counter) == target
+}
+
 func TestSpectatorThreeFile(t *testing.T) {
 	w, _ := setup()
 	defer teardown(w)
@@ -160,6 +175,32 @@ func TestSpectatorThreeFile(t *testing.T) {
 	// finish
 }
 
+func TestWaitingReader(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+	waiting, other := makeFile("test-waiting-reader-1-"), makeFile("test-waiting-reader-2-")
+	defer waiting.Close()
+	defer other.Close()
+
+	release := make(chan bool)
+	var count int32 = 0
+	w.AddFile(waiting.Name(), func(str string, args interface{}) error {
+		<-release
+		return nil
+	})
+	w.AddFile(other.Name(), func(str string, args interface{}) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	waiting.WriteString("wait\n")
+	time.Sleep(maxReaderWait)
+	other.WriteString("other\n")
+	if !waitCount(&count, 1, time.Second*5) {
+		t.Errorf("waiting file stops the other files")
+	}
+	close(release)
+}
+
 func TestInvalidGetFileInfo(t *testing.T) {
 	w, _ := setup()
 	defer teardown(w)
@@ -226,10 +267,217 @@ func TestInvalidSpectatorEventName(t *testing.T) {
 	event := fsnotify.Event{}
 	event.Op = fsnotify.Write
 	w.GetNotifier().Events <- event
+	err := errors.New("test")
+	w.GetNotifier().Errors <- err
 	w.Wait()
 	select {
-	case _ = <-w.GetErrorChannel():
+	case e := <-w.GetErrorChannel():
+		if e != err {
+			t.Errorf("event of the unknown path stops the spectator %v", e)
+		}
 	default:
 		t.Errorf("invalid event processor state test failed")
 	}
 }
+
+func TestRemovedFileEvent(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+	file := makeFile("test-removed-event-")
+	defer os.Remove(file.Name())
+	if err := w.AddFile(file.Name(), func(str string, args interface{}) error { return nil }); err != nil {
+		t.Fatalf("add file failed %v", err)
+	}
+	w.Remove(file.Name())
+	for _, op := range []fsnotify.Op{fsnotify.Write, fsnotify.Chmod, fsnotify.Create} {
+		if err := w.EventProcessor(fsnotify.Event{Name: file.Name(), Op: op}); err != nil {
+			t.Errorf("%v event of the removed file fails %v", op, err)
+		}
+	}
+	w.GetNotifier().Events <- fsnotify.Event{Name: file.Name(), Op: fsnotify.Write}
+	err := errors.New("test")
+	w.GetNotifier().Errors <- err
+	w.Wait()
+	if e := <-w.GetErrorChannel(); e != err {
+		t.Errorf("write event of the removed file stops the spectator %v", e)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+
+	file := makeFile("test-rotation")
+	filename := file.Name()
+	defer os.Remove(filename + ".1")
+
+	var count int32 = 0
+	lines := make(chan string, 8)
+	err := w.AddFile(filename, func(str string, args interface{}) error {
+		lines <- str
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("add file failed %v", err)
+	}
+	file.WriteString("old1\n")
+	if !waitCount(&count, 1, time.Second*5) {
+		t.Fatalf("write detection failed")
+	}
+	os.Rename(filename, filename+".1")
+	file.WriteString("old2\n")
+	file.Close()
+	newFile, _ := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+	newFile.WriteString("new1\n")
+	newFile.Close()
+	if !waitCount(&count, 3, time.Second*5) {
+		t.Fatalf("rotation detection failed (%d lines)", atomic.LoadInt32(&count))
+	}
+	expected := []string{"old1\n", "old2\n", "new1\n"}
+	for _, str := range expected {
+		if line := <-lines; line != str {
+			t.Errorf("rotated lines are out of order %s <> %s", line, str)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+
+	file := makeFile("test-truncation")
+	defer file.Close()
+
+	var count int32 = 0
+	lines := make(chan string, 8)
+	err := w.AddFile(file.Name(), func(str string, args interface{}) error {
+		lines <- str
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("add file failed %v", err)
+	}
+	file.WriteString("before-truncation\n")
+	if !waitCount(&count, 1, time.Second*5) {
+		t.Fatalf("write detection failed")
+	}
+	file.Truncate(0)
+	file.WriteAt([]byte("after\n"), 0)
+	if !waitCount(&count, 2, time.Second*5) {
+		t.Fatalf("truncation detection failed")
+	}
+	<-lines
+	if line := <-lines; line != "after\n" {
+		t.Errorf("truncated file isn't read from the beginning (%s)", line)
+	}
+}
+
+func TestPollingBackend(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+	if err := w.SetBackend("invalid", 0); err == nil {
+		t.Errorf("invalid backend is accepted")
+	}
+	w.SetBackend(BackendPolling, time.Duration(10)*time.Millisecond)
+
+	file := makeFile("test-polling")
+	defer file.Close()
+	var count int32 = 0
+	err := w.AddFileWithOptions(file.Name(), func(str string, args interface{}) error {
+		atomic.AddInt32(&count, 1)
+		return nil
+	}, buffering.Options{Start: buffering.StartAtEnd})
+	if err != nil {
+		t.Fatalf("add file failed %v", err)
+	}
+	if _, ok := w.backendTable[file.Name()].(*Poller); !ok {
+		t.Errorf("file isn't watched by the poller")
+	}
+	file.WriteString("test1\n")
+	if !waitCount(&count, 1, time.Second*5) {
+		t.Errorf("polling write detection failed")
+	}
+	if err = w.Remove(file.Name()); err != nil {
+		t.Errorf("remove failed %v", err)
+	}
+}
+
+func TestPollingDirectory(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+	w.SetBackend(BackendPolling, time.Duration(10)*time.Millisecond)
+	dir, _ := os.MkdirTemp("", "test-polling-directory")
+	defer os.RemoveAll(dir)
+
+	created := make(chan string, 4)
+	w.SetDirectoryEventFunction(func(event fsnotify.Event) error {
+		if event.Op&fsnotify.Create == fsnotify.Create {
+			created <- event.Name
+		}
+		return nil
+	})
+	if err := w.WatchDir(dir); err != nil {
+		t.Fatalf("watch directory failed %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "new.log"), []byte{}, 0644)
+	select {
+	case name := <-created:
+		if name != filepath.Join(dir, "new.log") {
+			t.Errorf("invalid created file %s", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("polling create detection failed")
+	}
+}
+
+func TestPollingDirectoryWithBackend(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+	dir, _ := os.MkdirTemp("", "test-polling-directory-backend")
+	defer os.RemoveAll(dir)
+
+	if err := w.WatchDirWithBackend(dir, "nfs"); err == nil {
+		t.Errorf("invalid backend is accepted")
+	}
+	if err := w.WatchDir(dir); err != nil {
+		t.Fatalf("watch directory failed %v", err)
+	}
+	if err := w.WatchDirWithBackend(dir, BackendPolling); err != nil {
+		t.Fatalf("watch directory failed %v", err)
+	}
+	w.poller.mutex.Lock()
+	_, polled := w.poller.states[dir]
+	w.poller.mutex.Unlock()
+	if !polled {
+		t.Errorf("directory of the polling backend isn't polled")
+	}
+	w.UnwatchDir(dir)
+	w.UnwatchDir(dir)
+	w.poller.mutex.Lock()
+	_, polled = w.poller.states[dir]
+	w.poller.mutex.Unlock()
+	if polled {
+		t.Errorf("unwatched directory is still polled")
+	}
+}
+
+func TestFallbackToPolling(t *testing.T) {
+	w, _ := setup()
+	defer teardown(w)
+	file := makeFile("test-fallback")
+	defer file.Close()
+	defer os.Remove(file.Name())
+	// the closed notifier refuses to watch like the exhausted inotify watch limit
+	w.GetNotifier().Close()
+	w.mutex.Lock()
+	err := w.addPath(file.Name(), BackendFsnotify)
+	w.mutex.Unlock()
+	if err != nil {
+		t.Fatalf("fallback failed %v", err)
+	}
+	if _, ok := w.backendTable[file.Name()].(*Poller); !ok {
+		t.Errorf("file isn't watched by the poller after the fallback")
+	}
+}
@@ -17,6 +17,48 @@ export GENERATOR_POLLING_INTERVAL_MILLIS=1000
 export GENERATOR_HOT_RING_THRESHOLD=0
 export GENERATOR_COLD_RING_THRESHOLD=0
 export GENERATOR_COLD_SEND_THRESHOLD_BYTES=4096
+export GENERATOR_CHECKPOINT_PATH=/var/lib/generator/checkpoint.json
+export GENERATOR_WATCHER_BACKEND=fsnotify
+export GENERATOR_WATCHER_POLLING_INTERVAL_MILLIS=1000
+export GENERATOR_HOT_OVERFLOW_POLICY=block
+export GENERATOR_COLD_OVERFLOW_POLICY=spill
+export GENERATOR_OVERFLOW_SAMPLE_RATE=10
+export GENERATOR_SPILL_PATH=/var/lib/generator/spill
+export GENERATOR_SPILL_MAX_BYTES=1073741824
+export GENERATOR_SPOOL_PATH=/var/lib/generator/spool
+export GENERATOR_SPOOL_MAX_BYTES=1073741824
+export GENERATOR_SPOOL_MAX_AGE_SEC=86400
+export GENERATOR_METRICS_ADDRESS=:9100
+export GENERATOR_RETRY_INITIAL_BACKOFF_MILLIS=100
+export GENERATOR_RETRY_MAX_BACKOFF_MILLIS=10000
+export GENERATOR_RETRY_JITTER_PERCENT=20
+export GENERATOR_RETRY_MAX_ATTEMPTS=5
+export GENERATOR_CALL_TIMEOUT_MILLIS=5000
+export GENERATOR_BREAKER_FAILURE_THRESHOLD=5
+export GENERATOR_BREAKER_OPEN_MILLIS=10000
+export GENERATOR_COMPRESSION=gzip
+export GENERATOR_COMPRESSION_LEVEL=0
+export GENERATOR_COMPRESSION_FRAMING=false
+export GENERATOR_COMPRESSION_DICTIONARY=""
+export GENERATOR_TLS=false
+export GENERATOR_TLS_CA_FILE=""
+export GENERATOR_TLS_CERT_FILE=""
+export GENERATOR_TLS_KEY_FILE=""
+export GENERATOR_TLS_SERVER_NAME=""
+export GENERATOR_TLS_MIN_VERSION=1.2
+export GENERATOR_AUTH_MODE=none
+export GENERATOR_AUTH_SECRET_FILE=""
+export GENERATOR_AUTH_SECRET_ENV=""
+export GENERATOR_TARGETS=""
+export GENERATOR_TARGET_STRATEGY=failover
+export GENERATOR_HEALTH_CHECK_MILLIS=5000
+export GENERATOR_DELIVERY_ACK=false
+export GENERATOR_CHECKPOINT_ON_ACK=false
+export GENERATOR_SINKS=""
+export GENERATOR_ROUTES=""
+export GENERATOR_CHECKPOINT_SAVE_INTERVAL_MILLIS=1000
+export GENERATOR_SPILL_SYNC_INTERVAL_MILLIS=1000
+export GENERATOR_SPOOL_SYNC_INTERVAL_MILLIS=0
 export GENERATOR_FILES='[
   {"filename":"test1.txt", "hotFilter":["error","critical"]},
   {"filename":"test2.txt", "hotFilter":["critical","warn"]}
@@ -46,9 +88,28 @@ def assign_config_contents(d: map, k: str, v):
         "coldRingThreshold",
         "coldSendThresholdBytes",
         "pollingIntervalMilli",
+        "watcherPollingIntervalMilli",
+        "overflowSampleRate",
+        "spillMaxBytes",
+        "spoolMaxBytes",
+        "spoolMaxAgeSec",
+        "retryInitialBackoffMilli",
+        "retryMaxBackoffMilli",
+        "retryJitterPercent",
+        "retryMaxAttempts",
+        "callTimeoutMilli",
+        "breakerFailureThreshold",
+        "breakerOpenMilli",
+        "compressionLevel",
+        "healthCheckMilli",
+        "checkpointSaveIntervalMilli",
+        "spillSyncIntervalMilli",
+        "spoolSyncIntervalMilli",
     ]:
         d[k] = int(v)
-    elif k in ["files"]:
+    elif k in ["compressionFraming", "tls", "deliveryAck", "checkpointOnAck"]:
+        d[k] = v.lower() == "true"
+    elif k in ["files", "targets", "sinks", "routes"]:
         d[k] = ast.literal_eval(v)
     else:
         d[k] = v
@@ -102,6 +163,216 @@ if __name__ == "__main__":
         "pollingIntervalMilli",
         get_value_from_environment("GENERATOR_POLLING_INTERVAL_MILLIS"),
     )
+    assign_config_contents(
+        configContents,
+        "checkpointPath",
+        get_value_from_environment("GENERATOR_CHECKPOINT_PATH"),
+    )
+    assign_config_contents(
+        configContents,
+        "watcherBackend",
+        get_value_from_environment("GENERATOR_WATCHER_BACKEND"),
+    )
+    assign_config_contents(
+        configContents,
+        "watcherPollingIntervalMilli",
+        get_value_from_environment("GENERATOR_WATCHER_POLLING_INTERVAL_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "hotOverflowPolicy",
+        get_value_from_environment("GENERATOR_HOT_OVERFLOW_POLICY"),
+    )
+    assign_config_contents(
+        configContents,
+        "coldOverflowPolicy",
+        get_value_from_environment("GENERATOR_COLD_OVERFLOW_POLICY"),
+    )
+    assign_config_contents(
+        configContents,
+        "overflowSampleRate",
+        get_value_from_environment("GENERATOR_OVERFLOW_SAMPLE_RATE"),
+    )
+    assign_config_contents(
+        configContents,
+        "spillPath",
+        get_value_from_environment("GENERATOR_SPILL_PATH"),
+    )
+    assign_config_contents(
+        configContents,
+        "spillMaxBytes",
+        get_value_from_environment("GENERATOR_SPILL_MAX_BYTES"),
+    )
+    assign_config_contents(
+        configContents,
+        "spoolPath",
+        get_value_from_environment("GENERATOR_SPOOL_PATH"),
+    )
+    assign_config_contents(
+        configContents,
+        "spoolMaxBytes",
+        get_value_from_environment("GENERATOR_SPOOL_MAX_BYTES"),
+    )
+    assign_config_contents(
+        configContents,
+        "spoolMaxAgeSec",
+        get_value_from_environment("GENERATOR_SPOOL_MAX_AGE_SEC"),
+    )
+    assign_config_contents(
+        configContents,
+        "metricsAddress",
+        get_value_from_environment("GENERATOR_METRICS_ADDRESS"),
+    )
+    assign_config_contents(
+        configContents,
+        "retryInitialBackoffMilli",
+        get_value_from_environment("GENERATOR_RETRY_INITIAL_BACKOFF_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "retryMaxBackoffMilli",
+        get_value_from_environment("GENERATOR_RETRY_MAX_BACKOFF_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "retryJitterPercent",
+        get_value_from_environment("GENERATOR_RETRY_JITTER_PERCENT"),
+    )
+    assign_config_contents(
+        configContents,
+        "retryMaxAttempts",
+        get_value_from_environment("GENERATOR_RETRY_MAX_ATTEMPTS"),
+    )
+    assign_config_contents(
+        configContents,
+        "callTimeoutMilli",
+        get_value_from_environment("GENERATOR_CALL_TIMEOUT_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "breakerFailureThreshold",
+        get_value_from_environment("GENERATOR_BREAKER_FAILURE_THRESHOLD"),
+    )
+    assign_config_contents(
+        configContents,
+        "breakerOpenMilli",
+        get_value_from_environment("GENERATOR_BREAKER_OPEN_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "compression",
+        get_value_from_environment("GENERATOR_COMPRESSION"),
+    )
+    assign_config_contents(
+        configContents,
+        "compressionLevel",
+        get_value_from_environment("GENERATOR_COMPRESSION_LEVEL"),
+    )
+    assign_config_contents(
+        configContents,
+        "compressionFraming",
+        get_value_from_environment("GENERATOR_COMPRESSION_FRAMING"),
+    )
+    assign_config_contents(
+        configContents,
+        "compressionDictionary",
+        get_value_from_environment("GENERATOR_COMPRESSION_DICTIONARY"),
+    )
+    assign_config_contents(
+        configContents,
+        "tls",
+        get_value_from_environment("GENERATOR_TLS"),
+    )
+    assign_config_contents(
+        configContents,
+        "tlsCaFile",
+        get_value_from_environment("GENERATOR_TLS_CA_FILE"),
+    )
+    assign_config_contents(
+        configContents,
+        "tlsCertFile",
+        get_value_from_environment("GENERATOR_TLS_CERT_FILE"),
+    )
+    assign_config_contents(
+        configContents,
+        "tlsKeyFile",
+        get_value_from_environment("GENERATOR_TLS_KEY_FILE"),
+    )
+    assign_config_contents(
+        configContents,
+        "tlsServerName",
+        get_value_from_environment("GENERATOR_TLS_SERVER_NAME"),
+    )
+    assign_config_contents(
+        configContents,
+        "tlsMinVersion",
+        get_value_from_environment("GENERATOR_TLS_MIN_VERSION"),
+    )
+    assign_config_contents(
+        configContents,
+        "authMode",
+        get_value_from_environment("GENERATOR_AUTH_MODE"),
+    )
+    assign_config_contents(
+        configContents,
+        "authSecretFile",
+        get_value_from_environment("GENERATOR_AUTH_SECRET_FILE"),
+    )
+    assign_config_contents(
+        configContents,
+        "authSecretEnv",
+        get_value_from_environment("GENERATOR_AUTH_SECRET_ENV"),
+    )
+    assign_config_contents(
+        configContents,
+        "targets",
+        get_value_from_environment("GENERATOR_TARGETS"),
+    )
+    assign_config_contents(
+        configContents,
+        "targetStrategy",
+        get_value_from_environment("GENERATOR_TARGET_STRATEGY"),
+    )
+    assign_config_contents(
+        configContents,
+        "healthCheckMilli",
+        get_value_from_environment("GENERATOR_HEALTH_CHECK_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "deliveryAck",
+        get_value_from_environment("GENERATOR_DELIVERY_ACK"),
+    )
+    assign_config_contents(
+        configContents,
+        "checkpointOnAck",
+        get_value_from_environment("GENERATOR_CHECKPOINT_ON_ACK"),
+    )
+    assign_config_contents(
+        configContents,
+        "sinks",
+        get_value_from_environment("GENERATOR_SINKS"),
+    )
+    assign_config_contents(
+        configContents,
+        "routes",
+        get_value_from_environment("GENERATOR_ROUTES"),
+    )
+    assign_config_contents(
+        configContents,
+        "checkpointSaveIntervalMilli",
+        get_value_from_environment("GENERATOR_CHECKPOINT_SAVE_INTERVAL_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "spillSyncIntervalMilli",
+        get_value_from_environment("GENERATOR_SPILL_SYNC_INTERVAL_MILLIS"),
+    )
+    assign_config_contents(
+        configContents,
+        "spoolSyncIntervalMilli",
+        get_value_from_environment("GENERATOR_SPOOL_SYNC_INTERVAL_MILLIS"),
+    )
     assign_config_contents(
         configContents, "files", get_value_from_environment("GENERATOR_FILES")
     )